@@ -0,0 +1,43 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"via/logging"
+	"via/proxy"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// startAdmin 启动管理接口的HTTP服务，/metrics提供gatherer中的Prometheus指标，/limits提供limiter的限制状态
+func startAdmin(address string, gatherer prometheus.Gatherer, limiter *proxy.Limiter) (*http.Server, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+	mux.Handle("/metrics", promhttp.HandlerFor(gatherer, promhttp.HandlerOpts{}))
+	mux.HandleFunc("/limits", func(w http.ResponseWriter, r *http.Request) {
+		usage := []proxy.LimitUsage{}
+		if limiter != nil {
+			usage = limiter.Usage()
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(usage)
+	})
+
+	server := &http.Server{Handler: mux}
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			logging.Errorf("admin endpoint stopped: %v", err)
+		}
+	}()
+	logging.Infof("starting VIA admin endpoint at: %s", address)
+	return server, nil
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"via/logging"
+	"via/proxy"
+	"via/via"
+)
+
+// 与集群中其他VIA实例断开后重新watch的间隔，每次失败加倍
+const (
+	clusterMinBackoff = time.Second
+	clusterMaxBackoff = 10 * time.Second
+)
+
+// clusterPeer 把集群中另一个VIA实例上注册的task服务同步到本VIA的registry。
+// 本VIA直接拨号同步来的task服务转发调用，所以集群中的VIA实例都需要能连接所有task服务
+type clusterPeer struct {
+	address     string
+	client      via.VIAServiceClient
+	server      *VIAServer
+	expireAfter time.Duration //断开多久后删除从此实例同步来的task服务
+
+	tasks map[instanceKey]*proxy.SignupTask //从此实例同步来的实例，只在run的goroutine中访问
+}
+
+// instanceKey 标识一个task服务实例
+type instanceKey struct {
+	key     proxy.TaskKey
+	address string
+}
+
+func taskInstanceKey(info *via.TaskInfo) instanceKey {
+	return instanceKey{key: proxy.NewTaskKey(info.TaskId, info.PartyId, info.ServiceType), address: info.Address}
+}
+
+// joinCluster 开始从集群中的其他VIA实例同步task服务，直到ctx取消。需要在提供服务之前调用。
+// 拨号其他VIA实例使用回拨task服务的拨号选项
+func (t *VIAServer) joinCluster(ctx context.Context, addresses []string, expireAfter time.Duration) error {
+	for _, address := range addresses {
+		conn, err := grpc.Dial(address, t.dialOpts...)
+		if err != nil {
+			return err
+		}
+		t.peers = append(t.peers, &clusterPeer{
+			address:     address,
+			client:      via.NewVIAServiceClient(conn),
+			server:      t,
+			expireAfter: expireAfter,
+			tasks:       make(map[instanceKey]*proxy.SignupTask),
+		})
+	}
+	for _, peer := range t.peers {
+		go peer.run(ctx)
+	}
+	return nil
+}
+
+// run 重复watch此实例注册的task服务，断开超过expireAfter时删除从它同步来的实例
+func (p *clusterPeer) run(ctx context.Context) {
+	backoff := clusterMinBackoff
+	disconnected := time.Now()
+	for {
+		synced, err := p.sync(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if synced {
+			logging.Warnf("lost the watch of VIA %s of the cluster: %v", p.address, err)
+			disconnected, backoff = time.Now(), clusterMinBackoff
+		} else if backoff == clusterMinBackoff {
+			logging.Warnf("failed to sync task servers from VIA %s of the cluster: %v", p.address, err)
+		} else {
+			logging.Debugf("failed to sync task servers from VIA %s of the cluster: %v", p.address, err)
+		}
+		if len(p.tasks) > 0 && time.Since(disconnected) >= p.expireAfter {
+			logging.Warnf("removing %d task servers synced from VIA %s, disconnected since %v", len(p.tasks), p.address, disconnected)
+			for k, task := range p.tasks {
+				p.remove(k, task)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > clusterMaxBackoff {
+			backoff = clusterMaxBackoff
+		}
+	}
+}
+
+// sync watch此实例注册的task服务并同步到本VIA，直到stream断开，返回是否已完成同步
+func (p *clusterPeer) sync(ctx context.Context) (bool, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stream, err := p.client.WatchTasks(ctx, &via.WatchTasksReq{LocalOnly: true})
+	if err != nil {
+		return false, err
+	}
+	seen := make(map[instanceKey]bool)
+	synced := false
+	for {
+		event, err := stream.Recv()
+		if err != nil {
+			return synced, err
+		}
+		if event.Type == via.TaskEvent_SYNCED {
+			//重新连接时，删除断开期间已在此实例上注销的实例
+			for k, task := range p.tasks {
+				if !seen[k] {
+					p.remove(k, task)
+				}
+			}
+			synced = true
+			logging.Infof("synced %d task servers from VIA %s of the cluster", len(p.tasks), p.address)
+			continue
+		}
+		if event.Task == nil {
+			continue
+		}
+		k := taskInstanceKey(event.Task)
+		if event.Type == via.TaskEvent_REMOVED {
+			if task, ok := p.tasks[k]; ok {
+				p.remove(k, task)
+			}
+			continue
+		}
+		seen[k] = true
+		p.add(k, event.Task)
+	}
+}
+
+func (p *clusterPeer) add(k instanceKey, info *via.TaskInfo) {
+	//同一地址重新注册时，已有的连接仍然可用
+	if _, ok := p.tasks[k]; ok {
+		return
+	}
+	//本VIA上注册的同一地址的实例优先
+	for _, instance := range p.server.registry.Lookup(k.key) {
+		if instance.Address == k.address && instance.Origin == "" {
+			return
+		}
+	}
+	conn, err := p.server.dial(context.Background(), k.address)
+	if err != nil {
+		logging.Warnf("failed to dial task server %s synced from VIA %s: %v", k.address, p.address, err)
+		return
+	}
+	task := &proxy.SignupTask{TaskId: info.TaskId, PartyId: info.PartyId, ServiceType: k.key.ServiceType,
+		Address: k.address, Conn: conn, Owner: info.Owner, Origin: p.address}
+	replaced, err := p.server.registry.Register(task)
+	if err != nil {
+		conn.Close()
+		logging.Warnf("failed to register task server %s synced from VIA %s, %+v: %v", k.address, p.address, k.key, err)
+		return
+	}
+	if replaced != nil {
+		replaced.Close(false)
+	}
+	p.tasks[k] = task
+	logging.Infof("registered task server %s synced from VIA %s, %+v", k.address, p.address, k.key)
+}
+
+// remove 删除同步来的实例。实例可能已被本VIA上注册的同一地址的实例替换，仍然需要关闭它的连接
+func (p *clusterPeer) remove(k instanceKey, task *proxy.SignupTask) {
+	delete(p.tasks, k)
+	p.server.registry.Delete(task)
+	task.Close(false)
+	logging.Infof("unregistered task server %s synced from VIA %s, %+v", k.address, p.address, k.key)
+}
+
+// forwardToPeers 把注销请求转发给集群中的其他VIA实例，注销在它们上面注册的实例，返回是否有实例被注销。
+// 转发的请求带有跳数，收到转发的请求的VIA实例不再转发
+func (t *VIAServer) forwardToPeers(ctx context.Context, call func(ctx context.Context, client via.VIAServiceClient) (*via.Boolean, error)) (bool, error) {
+	if len(t.peers) == 0 {
+		return false, nil
+	}
+	hops, err := hopCount(ctx)
+	if err != nil || hops > 0 {
+		return false, err
+	}
+	//注册认证的token随请求转发，集群中的VIA实例需要使用相同的注册认证配置。配置校验保证集群只使用token认证
+	md := metadata.Pairs(proxy.MetadataHopCountKey, "1")
+	in, _ := metadata.FromIncomingContext(ctx)
+	for _, key := range []string{proxy.MetadataSignupKeyIdKey, proxy.MetadataSignupTimestampKey, proxy.MetadataSignupNonceKey, proxy.MetadataSignupTokenKey} {
+		if values := in.Get(key); len(values) > 0 {
+			md.Set(key, values...)
+		}
+	}
+	outCtx := metadata.NewOutgoingContext(ctx, md)
+
+	results := make(chan bool, len(t.peers))
+	for _, peer := range t.peers {
+		go func(peer *clusterPeer) {
+			resp, err := call(outCtx, peer.client)
+			if err != nil {
+				logging.Warnf("failed to forward the request to VIA %s of the cluster: %v", peer.address, err)
+			}
+			results <- err == nil && resp.Result
+		}(peer)
+	}
+	forwarded := false
+	for range t.peers {
+		if <-results {
+			forwarded = true
+		}
+	}
+	return forwarded, nil
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"via/proxy"
+	"via/via"
+)
+
+// testVIA 是集群测试中的一个VIA实例，在同一进程中提供注册服务和代理服务
+type testVIA struct {
+	address  string
+	registry proxy.Registry
+	server   *grpc.Server
+	client   via.VIAServiceClient
+	conn     *grpc.ClientConn
+}
+
+// startCluster 启动n个互相同步task服务的VIA实例
+func startCluster(t *testing.T, n int, expireAfter time.Duration) []*testVIA {
+	listeners := make([]net.Listener, n)
+	for i := range listeners {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		listeners[i] = listener
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	vias := make([]*testVIA, n)
+	for i, listener := range listeners {
+		var peers []string
+		for j, peer := range listeners {
+			if j != i {
+				peers = append(peers, peer.Addr().String())
+			}
+		}
+		registry := proxy.NewMemoryRegistry()
+		service := NewVIAServer(registry, nil, nil, []grpc.DialOption{grpc.WithInsecure()}, nil)
+		if err := service.joinCluster(ctx, peers, expireAfter); err != nil {
+			t.Fatal(err)
+		}
+		server := newProxyServer(nil, proxy.GetDirector(registry))
+		via.RegisterVIAServiceServer(server, service)
+		go server.Serve(listener)
+		t.Cleanup(server.Stop)
+
+		conn, err := grpc.Dial(listener.Addr().String(), grpc.WithInsecure())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		vias[i] = &testVIA{address: listener.Addr().String(), registry: registry, server: server, client: via.NewVIAServiceClient(conn), conn: conn}
+	}
+	return vias
+}
+
+// startTaskServer 启动一个提供grpc.health.v1的task服务，返回它的地址
+func startTaskServer(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := grpc.NewServer()
+	healthpb.RegisterHealthServer(server, health.NewServer())
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+	return listener.Addr().String()
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func registered(v *testVIA, key proxy.TaskKey, origin string) func() bool {
+	return func() bool {
+		instances := v.registry.Lookup(key)
+		return len(instances) == 1 && instances[0].Origin == origin
+	}
+}
+
+func unregistered(v *testVIA, key proxy.TaskKey) func() bool {
+	return func() bool { return len(v.registry.Lookup(key)) == 0 }
+}
+
+// checkTask 通过VIA实例v调用注册的task服务
+func checkTask(t *testing.T, v *testVIA, taskId, partyId string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	ctx = metadata.AppendToOutgoingContext(ctx, proxy.MetadataTaskIdKey, taskId, proxy.MetadataPartyIdKey, partyId)
+	resp, err := healthpb.NewHealthClient(v.conn).Check(ctx, &healthpb.HealthCheckRequest{})
+	if err != nil {
+		t.Fatalf("failed to call task %s of party %s: %v", taskId, partyId, err)
+	}
+	if resp.Status != healthpb.HealthCheckResponse_SERVING {
+		t.Fatalf("unexpected health status: %v", resp.Status)
+	}
+}
+
+func TestClusterRoutesTasksOfPeers(t *testing.T) {
+	vias := startCluster(t, 3, time.Minute)
+	ctx := context.Background()
+	key := proxy.NewTaskKey("task", "p1", "")
+
+	address := startTaskServer(t)
+	if _, err := vias[0].client.Signup(ctx, &via.SignupReq{TaskId: "task", PartyId: "p1", Address: address}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the task to be synced", registered(vias[1], key, vias[0].address))
+	waitFor(t, "the task to be synced", registered(vias[2], key, vias[0].address))
+	for _, v := range vias {
+		checkTask(t, v, "task", "p1")
+	}
+	if !registered(vias[0], key, "")() {
+		t.Fatalf("expected the task to stay local on the instance it signed up at")
+	}
+
+	resp, err := vias[1].client.ListTasks(ctx, &via.ListTasksReq{TaskId: "task"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Tasks) != 1 || resp.Tasks[0].Origin != vias[0].address {
+		t.Fatalf("expected the synced task with its origin, got %v", resp.Tasks)
+	}
+	//同步来的实例不在localOnly的watch中，不会再同步给其他实例
+	watch, err := vias[1].client.WatchTasks(ctx, &via.WatchTasksReq{LocalOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event, err := watch.Recv(); err != nil || event.Type != via.TaskEvent_SYNCED {
+		t.Fatalf("expected no local task before SYNCED, got %v, %v", event, err)
+	}
+
+	//在其他实例上注销时转发给注册的实例，同步来的实例随之删除
+	unregisterResp, err := vias[2].client.Unregister(ctx, &via.UnregisterReq{TaskId: "task", PartyId: "p1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !unregisterResp.Result {
+		t.Fatalf("expected the unregister to be forwarded to the instance the task signed up at")
+	}
+	for _, v := range vias {
+		waitFor(t, "the task to be unregistered", unregistered(v, key))
+	}
+}
+
+func TestClusterEndTask(t *testing.T) {
+	vias := startCluster(t, 2, time.Minute)
+	ctx := context.Background()
+	first, second := proxy.NewTaskKey("task", "p1", ""), proxy.NewTaskKey("task", "p2", "")
+
+	if _, err := vias[0].client.Signup(ctx, &via.SignupReq{TaskId: "task", PartyId: "p1", Address: startTaskServer(t)}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := vias[1].client.Signup(ctx, &via.SignupReq{TaskId: "task", PartyId: "p2", Address: startTaskServer(t)}); err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range vias {
+		waitFor(t, "the parties to be synced", func() bool {
+			return len(v.registry.Lookup(first)) == 1 && len(v.registry.Lookup(second)) == 1
+		})
+	}
+
+	resp, err := vias[1].client.EndTask(ctx, &via.EndTaskReq{TaskId: "task"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !resp.Result {
+		t.Fatalf("expected the task to be ended")
+	}
+	for _, v := range vias {
+		waitFor(t, "the task to be ended on every instance", func() bool {
+			return len(v.registry.List()) == 0
+		})
+	}
+}
+
+func TestClusterExpiresTasksOfLostPeer(t *testing.T) {
+	vias := startCluster(t, 2, 0)
+	key := proxy.NewTaskKey("task", "p1", "")
+
+	if _, err := vias[0].client.Signup(context.Background(), &via.SignupReq{TaskId: "task", PartyId: "p1", Address: startTaskServer(t)}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the task to be synced", func() bool { return len(vias[1].registry.Lookup(key)) == 1 })
+
+	vias[0].server.Stop()
+	waitFor(t, "the task of the lost instance to expire", unregistered(vias[1], key))
+}
@@ -1,197 +1,457 @@
 package main
 
 import (
-	"crypto/tls"
-	"crypto/x509"
-	"errors"
 	"flag"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials"
-	"google.golang.org/grpc/peer"
-	"io/ioutil"
-	"log"
+	"google.golang.org/grpc/keepalive"
+	"io"
 	"net"
 	"os"
 	"os/signal"
 	"syscall"
 	"time"
 	"via/conf"
+	"via/logging"
 	"via/proxy"
+	"via/tlsutil"
 	"via/via"
 )
 
-var (
-	address    string
-	tlsFile    string
-	tlsEnabled = false
-)
+var configFile string
 
 func init() {
-	flag.StringVar(&address, "address", ":10031", "VIA service listen address")
-	flag.StringVar(&tlsFile, "tls", "", "TLS config file")
+	flag.StringVar(&configFile, "config", "", "VIA config file, see conf/via.yml")
+}
+
+func main() {
 	flag.Parse()
+	config, err := conf.LoadConfig(configFile)
+	if err != nil {
+		logging.Fatalf("failed to load config: %v", err)
+	}
+	accessLog, err := setupLog(config.Log)
+	if err != nil {
+		logging.Fatalf("failed to setup log: %v", err)
+	}
 
-	if len(tlsFile) > 0 {
-		tlsEnabled = true
+	// 对远程VIA的监听(address)和本地task服务的内部监听(internal.address)各自使用自己的SSL配置
+	reloader, err := newReloader("VIA", &config.Tls)
+	if err != nil {
+		logging.Fatalf("failed to load TLS credentials: %v", err)
 	}
-}
+	reloaders := []*tlsutil.Reloader{reloader}
+	serverOpts, dialOpts := grpcOptions(config, reloader)
+	// 未开启内部监听时，task服务和远程VIA使用相同的监听和拨号选项
+	internalServerOpts, taskDialOpts := serverOpts, dialOpts
+	if config.InternalEnabled() {
+		internalReloader, err := newReloader("VIA internal", &config.Internal.Tls)
+		if err != nil {
+			logging.Fatalf("failed to load internal TLS credentials: %v", err)
+		}
+		reloaders = append(reloaders, internalReloader)
+		internalServerOpts, taskDialOpts = grpcOptions(config, internalReloader)
+	}
+	go reloadOnSignal(reloaders...)
 
-type VIAServer struct{}
+	// 存放注册的任务服务进程信息，注册服务和代理服务共用
+	registry, persistentRegistry, err := newRegistry(config.Registry)
+	if err != nil {
+		logging.Fatalf("failed to open registry: %v", err)
+	}
 
-func NewVIAServer() *VIAServer {
-	return &VIAServer{}
-}
+	// 租约过期的task由lessor从registry中驱逐
+	var lessor *proxy.Lessor
+	if config.Registry.LeaseTTL > 0 {
+		lessor = proxy.NewLessor(registry, config.Registry.LeaseTTL)
+		go lessor.Run(context.Background())
+	}
 
-func (t *VIAServer) Signup(ctx context.Context, req *via.SignupReq) (*via.Boolean, error) {
+	// 健康检查失败的task服务实例不再转发，直到再次检查通过
+	if healthCheck := config.Registry.HealthCheck; healthCheck.Interval > 0 {
+		go proxy.NewHealthChecker(registry, healthCheck.Interval, healthCheck.Timeout, healthCheck.Service).Run(context.Background())
+	}
 
-	signupTask := &proxy.SignupTask{TaskId: req.TaskId, PartyId: req.PartyId, ServiceType: req.ServiceType, Address: req.Address}
+	lb, err := proxy.NewBalancer(config.Registry.Balancer, config.Registry.HashKey)
+	if err != nil {
+		logging.Fatalf("failed to create balancer: %v", err)
+	}
+	// 两个监听都记录转发记录，只保留可信的远程VIA带来的转发记录
+	forwarder, err := newForwarder(config.Forwarding)
+	if err != nil {
+		logging.Fatalf("failed to create forwarder: %v", err)
+	}
+	directorOpts := []proxy.DirectorOption{proxy.WithBalancer(lb), proxy.WithForwarder(forwarder)}
+	// 本地task服务只需要连接本VIA，调用远程参与方时由本VIA按路由表和参与方目录转发给它所在的VIA
+	var routes *proxy.RouteTable
+	if len(config.Routing.AllRoutes()) > 0 {
+		routes, err = newRouteTable(config.Routing, dialOpts)
+		if err != nil {
+			logging.Fatalf("failed to load routes: %v", err)
+		}
+		routes.SetLocal(config.Address, config.Internal.Address)
+	}
+	var authorizer *proxy.Authorizer
+	if config.Auth.Enabled() {
+		if authorizer, err = newAuthorizer(config.Auth); err != nil {
+			logging.Fatalf("failed to load auth rules: %v", err)
+		}
+	}
+	// 内部监听上的调用方是本机构内网中的task服务，和注册服务一样信任它们，不用auth的白名单校验：
+	// auth的规则是远程VIA的证书身份，内部监听可以不使用SSL。它们对远程参与方的调用由远程VIA按本VIA的证书校验
+	internalDirector := proxy.GetDirector(registry, append([]proxy.DirectorOption{proxy.WithRoutes(routes)}, directorOpts...)...)
+	// 开启内部监听时，address只接受远程VIA的调用并只转发到本地task服务，不按路由再转发给其他VIA
+	if !config.InternalEnabled() && routes != nil {
+		directorOpts = append(directorOpts, proxy.WithRoutes(routes))
+	}
+	// auth的白名单只校验转发到本地task服务的调用；没有内部监听时，本地task服务对远程参与方的调用按路由转发，
+	// 不用远程VIA的规则校验，由远程VIA按本VIA的证书校验
+	if authorizer != nil {
+		directorOpts = append(directorOpts, proxy.WithAuthorizer(authorizer))
+	}
+	director := proxy.GetDirector(registry, directorOpts...)
 
-	log.Printf("收到注册请求：%v", req)
+	var signupAuth *proxy.SignupAuthenticator
+	if config.Signup.AuthEnabled() {
+		signupAuth, err = newSignupAuthenticator(config.Signup)
+		if err != nil {
+			logging.Fatalf("failed to load signup authentication: %v", err)
+		}
+	}
+	viaService := NewVIAServer(registry, lessor, signupAuth, taskDialOpts, routes)
+	if persistentRegistry != nil {
+		restoreRegistry(persistentRegistry, viaService, lessor)
+	}
+	// 集群中的VIA实例互相同步注册的task服务，任意实例都可以转发到它们
+	if len(config.Cluster.Peers) > 0 {
+		logging.Infof("syncing task servers with the VIA instances of the cluster: %v", config.Cluster.Peers)
+		if err := viaService.joinCluster(context.Background(), config.Cluster.Peers, config.Cluster.ExpireAfter); err != nil {
+			logging.Fatalf("failed to join the cluster: %v", err)
+		}
+	}
 
-	//得到调用者信息，然后proxy连上它，以便后续转发数据流
-	if _, ok := peer.FromContext(ctx); ok {
-		//获得conn
+	// 转发的stream和注册的任务的指标，由管理接口的/metrics提供
+	metricsRegistry := prometheus.NewRegistry()
+	metricsRegistry.MustRegister(prometheus.NewGoCollector(), prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}))
+	metrics, err := proxy.NewMetrics(metricsRegistry, registry, forwarder)
+	if err != nil {
+		logging.Fatalf("failed to register metrics: %v", err)
+	}
+	go metrics.Run(context.Background())
 
-		var conn *grpc.ClientConn
-		var err error
-		if tlsEnabled {
-			log.Printf("回拨local task server with secure, %s", signupTask.Address)
-			conn, err = grpc.DialContext(ctx, signupTask.Address, grpc.WithDefaultCallOptions(grpc.ForceCodec(proxy.Codec())), grpc.WithTransportCredentials(tlsCredentialsAsClient))
-		} else {
-			log.Printf("回拨local task server with insecure, %s", signupTask.Address)
-			conn, err = grpc.DialContext(ctx, signupTask.Address, grpc.WithDefaultCallOptions(grpc.ForceCodec(proxy.Codec())), grpc.WithInsecure())
+	handlerOpts := []proxy.HandlerOption{proxy.WithMetrics(metrics)}
+	if accessLog != nil {
+		handlerOpts = append(handlerOpts, proxy.WithAccessLog(accessLog))
+	}
+	tracerProvider, err := newTracerProvider(config.Tracing)
+	if err != nil {
+		logging.Fatalf("failed to create tracing exporter: %v", err)
+	}
+	if tracerProvider != nil {
+		logging.Infof("exporting spans of the proxied streams to %s", config.Tracing.Exporter)
+		handlerOpts = append(handlerOpts, proxy.WithTracer(tracerProvider.Tracer("via/proxy")))
+	}
+	var limiter *proxy.Limiter
+	if len(config.Limits) > 0 {
+		if limiter, err = newLimiter(config.Limits, forwarder, metricsRegistry); err != nil {
+			logging.Fatalf("failed to create limits: %v", err)
 		}
+		handlerOpts = append(handlerOpts, proxy.WithLimiter(limiter))
+	}
+	if len(config.Interceptors) > 0 {
+		interceptors, err := newInterceptors(config.Interceptors)
+		if err != nil {
+			logging.Fatalf("failed to create interceptors: %v", err)
+		}
+		handlerOpts = append(handlerOpts, proxy.WithFrameInterceptors(interceptors...))
+	}
 
+	viaServer := newProxyServer(serverOpts, director, handlerOpts...)
+	shutdowns := []func(){viaServer.GracefulStop}
+
+	//注册本身提供的服务，开启内部监听时只在内部监听上提供，address只接受远程VIA的调用
+	if config.InternalEnabled() {
+		internalServer := newProxyServer(internalServerOpts, internalDirector, handlerOpts...)
+		via.RegisterVIAServiceServer(internalServer, viaService)
+		serve("VIA internal Server", config.Internal.Address, internalServer, len(config.Internal.Tls.Mode) > 0)
+		shutdowns = append(shutdowns, internalServer.GracefulStop)
+		//远程VIA只能在address上询问本VIA的参与方是否已注册
+		via.RegisterVIAServiceServer(viaServer, peerVIAServer{server: viaService, authorizer: authorizer})
+	} else {
+		via.RegisterVIAServiceServer(viaServer, viaService)
+	}
+	serve("VIA Server", config.Address, viaServer, config.TlsEnabled())
+
+	if len(config.Admin.Address) > 0 {
+		adminServer, err := startAdmin(config.Admin.Address, metricsRegistry, limiter)
 		if err != nil {
-			log.Printf("回拨local task server失败")
-			return &via.Boolean{Result: false}, err
+			logging.Fatalf("failed to start admin endpoint: %v", err)
 		}
+		shutdowns = append(shutdowns, func() { adminServer.Close() })
+	}
 
-		//用taskId_partyId作为请求者的唯一标识，把conn保存到map中。
-		signupTask.Conn = conn
-		proxy.RegisteredTaskMap[signupTask.TaskId+"_"+signupTask.PartyId] = signupTask
+	// 服务停止后再导出剩余的span
+	if tracerProvider != nil {
+		shutdowns = append(shutdowns, func() { tracerProvider.Shutdown(context.Background()) })
+	}
+	if persistentRegistry != nil {
+		shutdowns = append(shutdowns, func() { persistentRegistry.Close() })
+	}
 
-		log.Printf("回拨local task server成功")
+	waitForGracefulShutdown(shutdowns...)
+}
 
-		return &via.Boolean{Result: true}, nil
-	} else {
-		log.Printf("获取local task server节点信息失败")
-		return &via.Boolean{Result: false}, errors.New("failed to retrieve the task server peer info")
+// setupLog 按配置设置日志级别和输出，返回access log的writer，未配置accessFile时返回nil
+func setupLog(logConfig conf.Log) (io.Writer, error) {
+	level, err := logging.ParseLevel(logConfig.Level)
+	if err != nil {
+		return nil, err
+	}
+	logging.SetLevel(level)
+	rotation := logging.Rotation{
+		MaxSize:    logConfig.Rotate.MaxSize,
+		MaxBackups: logConfig.Rotate.MaxBackups,
+		MaxAge:     logConfig.Rotate.MaxAge,
+		Compress:   logConfig.Rotate.Compress,
+	}
+	if len(logConfig.File) > 0 {
+		logging.SetOutput(logging.NewFile(logConfig.File, rotation))
+	}
+	if len(logConfig.AccessFile) > 0 {
+		return logging.NewFile(logConfig.AccessFile, rotation), nil
 	}
+	return nil, nil
 }
 
-func main() {
-	//via提供的代理服务
-	viaListener, err := net.Listen("tcp", address)
+// newReloader 加载tlsConfig中VIA的证书，mode为空时返回nil。
+// 证书文件变化或收到SIGHUP时重新加载证书，只影响新建立的连接
+func newReloader(name string, tlsConfig *conf.Tls) (*tlsutil.Reloader, error) {
+	if len(tlsConfig.Mode) == 0 {
+		return nil, nil
+	}
+	logging.Infof("%s SSL mode: %s, CA: %v", name, tlsConfig.Mode, tlsConfig.CaPaths())
+	reloader, err := tlsutil.NewReloader(tlsConfig.ViaOptions())
 	if err != nil {
-		log.Fatalf("failed to listen: %v", err)
-	}
-
-	var viaServer *grpc.Server
-	if tlsEnabled {
-		log.Printf("starting VIA Server with secure at: %s", address)
-		//把所有服务都作为非注册服务，通过TransparentHandler来处理
-		viaServer = grpc.NewServer(
-			grpc.Creds(tlsCredentialsAsServer),
-			grpc.ForceServerCodec(proxy.Codec()),
-			grpc.UnknownServiceHandler(proxy.TransparentHandler(proxy.GetDirector())),
-		)
-	} else {
-		log.Printf("starting VIA Server with insecure at: %s", address)
-		//把所有服务都作为非注册服务，通过TransparentHandler来处理
-		viaServer = grpc.NewServer(
-			grpc.ForceServerCodec(proxy.Codec()),
-			grpc.UnknownServiceHandler(proxy.TransparentHandler(proxy.GetDirector())),
-		)
+		return nil, err
 	}
+	if tlsConfig.ReloadInterval > 0 {
+		go reloader.Watch(context.Background(), tlsConfig.ReloadInterval)
+	}
+	return reloader, nil
+}
 
-	//注册本身提供的服务
-	via.RegisterVIAServiceServer(viaServer, NewVIAServer())
+// newProxyServer 创建gRPC服务，把所有服务都作为非注册服务，通过TransparentHandler来处理
+func newProxyServer(serverOpts []grpc.ServerOption, director proxy.StreamDirector, handlerOpts ...proxy.HandlerOption) *grpc.Server {
+	opts := append([]grpc.ServerOption(nil), serverOpts...)
+	opts = append(opts,
+		grpc.ForceServerCodec(proxy.Codec()),
+		grpc.UnknownServiceHandler(proxy.TransparentHandler(director, handlerOpts...)),
+	)
+	return grpc.NewServer(opts...)
+}
 
+// serve 在address上启动server
+func serve(name, address string, server *grpc.Server, secure bool) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		logging.Fatalf("failed to listen: %v", err)
+	}
+	if secure {
+		logging.Infof("starting %s with secure at: %s", name, address)
+	} else {
+		logging.Infof("starting %s with insecure at: %s", name, address)
+	}
 	go func() {
-		viaServer.Serve(viaListener)
+		server.Serve(listener)
 	}()
-
-	waitForGracefulShutdown(viaServer)
 }
 
-func waitForGracefulShutdown(viaServer *grpc.Server) {
-	interruptChan := make(chan os.Signal, 1)
-	signal.Notify(interruptChan, os.Interrupt, syscall.SIGINT, syscall.SIGTERM)
+// grpcOptions 按配置返回VIA服务的选项，以及VIA拨号task服务和远程VIA时的选项。reloader为nil时不使用SSL
+func grpcOptions(config *conf.Config, reloader *tlsutil.Reloader) ([]grpc.ServerOption, []grpc.DialOption) {
+	var serverOpts []grpc.ServerOption
+	var dialOpts []grpc.DialOption
 
-	<-interruptChan
+	if reloader != nil {
+		serverOpts = append(serverOpts, grpc.Creds(reloader.ServerCredentials()))
+		dialOpts = append(dialOpts, grpc.WithTransportCredentials(reloader.ClientCredentials()))
+	} else {
+		dialOpts = append(dialOpts, grpc.WithInsecure())
+	}
 
-	_, cancel := context.WithTimeout(context.Background(), time.Second*10)
-	defer cancel()
-	viaServer.GracefulStop()
+	if config.KeepAlive.Time > 0 || config.KeepAlive.Timeout > 0 {
+		serverOpts = append(serverOpts, grpc.KeepaliveParams(keepalive.ServerParameters{
+			Time:    config.KeepAlive.Time,
+			Timeout: config.KeepAlive.Timeout,
+		}))
+	}
+	if config.KeepAlive.MinTime > 0 || config.KeepAlive.PermitWithoutStream {
+		serverOpts = append(serverOpts, grpc.KeepaliveEnforcementPolicy(keepalive.EnforcementPolicy{
+			MinTime:             config.KeepAlive.MinTime,
+			PermitWithoutStream: config.KeepAlive.PermitWithoutStream,
+		}))
+	}
 
-	log.Println("Shutting down VIA server.")
-	os.Exit(0)
+	// 转发的消息在VIA的服务端和客户端都要受相同的大小限制
+	if n := config.Message.MaxRecvSize; n > 0 {
+		serverOpts = append(serverOpts, grpc.MaxRecvMsgSize(n))
+		dialOpts = append(dialOpts, grpc.WithDefaultCallOptions(grpc.MaxCallRecvMsgSize(n)))
+	}
+	if n := config.Message.MaxSendSize; n > 0 {
+		serverOpts = append(serverOpts, grpc.MaxSendMsgSize(n))
+		dialOpts = append(dialOpts, grpc.WithDefaultCallOptions(grpc.MaxCallSendMsgSize(n)))
+	}
+	return serverOpts, dialOpts
 }
 
-var tlsCredentialsAsClient credentials.TransportCredentials
-var tlsCredentialsAsServer credentials.TransportCredentials
-var tlsConfig *conf.TlsConfig
-
-func init() {
-	if !tlsEnabled {
-		return
+// reloadOnSignal 收到SIGHUP时重新加载证书，未使用SSL的监听没有reloader(nil)
+func reloadOnSignal(reloaders ...*tlsutil.Reloader) {
+	hupChan := make(chan os.Signal, 1)
+	signal.Notify(hupChan, syscall.SIGHUP)
+	for range hupChan {
+		logging.Infof("received SIGHUP, reloading TLS certificates")
+		for _, reloader := range reloaders {
+			if reloader == nil {
+				continue
+			}
+			if err := reloader.Reload(); err != nil {
+				logging.Errorf("failed to reload TLS certificates, keep using the current ones: %v", err)
+			}
+		}
 	}
+}
 
-	tlsConfig = conf.LoadTlsConfig(tlsFile)
-
-	// Load via's certificate and private key
-	viaCert, err := tls.LoadX509KeyPair(tlsConfig.Tls.ViaCertFile, tlsConfig.Tls.ViaKeyFile)
+// newRegistry 按配置创建注册信息的存储，persistent时还返回用来恢复注册信息的PersistentRegistry
+func newRegistry(registryConfig conf.Registry) (proxy.Registry, *proxy.PersistentRegistry, error) {
+	if registryConfig.Backend != "persistent" {
+		return proxy.NewMemoryRegistry(), nil, nil
+	}
+	logging.Infof("storing the signed up tasks in %s", registryConfig.File)
+	registry, err := proxy.NewPersistentRegistry(registryConfig.File)
 	if err != nil {
-		log.Fatalf("failed to load VIA certificate and private key. %v", err)
+		return nil, nil, err
 	}
-	//当是SSL，拨号VIA需要携带统一的ca证书库
-	caPool := loadCaPool()
+	return registry, registry, nil
+}
 
-	if tlsConfig.Tls.Mode == "one_way" {
-		log.Printf("VIA单向SSL")
-		serverSSLConfig := &tls.Config{
-			Certificates: []tls.Certificate{viaCert},
-			ClientAuth:   tls.NoClientCert,
+// restoreDialTimeout 恢复注册时等待连接上task服务的时间
+const restoreDialTimeout = 5 * time.Second
+
+// restoreRegistry 重新拨号重启前注册的task服务并注册，开启租约时恢复它们的租约，task服务可以继续续约
+func restoreRegistry(registry *proxy.PersistentRegistry, viaService *VIAServer, lessor *proxy.Lessor) {
+	restored, err := registry.Restore(func(address string) (*grpc.ClientConn, error) {
+		//阻塞到连接建立，重启期间已经停止的task服务不再恢复
+		ctx, cancel := context.WithTimeout(context.Background(), restoreDialTimeout)
+		defer cancel()
+		return viaService.dial(ctx, address, grpc.WithBlock())
+	})
+	if err != nil {
+		logging.Fatalf("failed to restore registry: %v", err)
+	}
+	for _, task := range restored {
+		if lessor != nil {
+			lessor.Restore(task)
 		}
-		tlsCredentialsAsServer = credentials.NewTLS(serverSSLConfig)
+		logging.Infof("restored task server %s, %+v", task.Address, task.Key())
+	}
+	logging.Infof("restored %d task servers", len(restored))
+}
 
-		clientSSLConfig := &tls.Config{
-			RootCAs: caPool,
-		}
-		tlsCredentialsAsClient = credentials.NewTLS(clientSSLConfig)
-	} else if tlsConfig.Tls.Mode == "two_way" {
-		log.Printf("VIA双向SSL")
-		serverSSLConfig := &tls.Config{
-			//InsecureSkipVerify: true, //不校验证书有效性
-			Certificates: []tls.Certificate{viaCert},
-			ClientAuth:   tls.RequireAndVerifyClientCert,
-			ClientCAs:    loadCaPool(),
+// newRouteTable 用路由和参与方目录创建远程VIA的路由表，VIA之间使用VIA监听地址的SSL配置拨号
+func newRouteTable(routeConfig conf.RouteConfig, dialOpts []grpc.DialOption) (*proxy.RouteTable, error) {
+	allRoutes := routeConfig.AllRoutes()
+	routes := make([]proxy.Route, 0, len(allRoutes))
+	for _, route := range allRoutes {
+		routes = append(routes, proxy.Route{PartyId: route.PartyId, PartyIdPrefix: route.PartyIdPrefix, Address: route.Address})
+	}
+	return proxy.NewRouteTable(routes, routeConfig.MaxHops, dialOpts...)
+}
+
+// newForwarder 创建记录本VIA转发记录的Forwarder，未配置名字时使用主机名
+func newForwarder(forwarding conf.Forwarding) (*proxy.Forwarder, error) {
+	name := forwarding.Name
+	if len(name) == 0 {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, err
 		}
-		tlsCredentialsAsServer = credentials.NewTLS(serverSSLConfig)
+		name = hostname
+	}
+	logging.Infof("forwarding as %s, trusted peers: %v", name, forwarding.TrustedPeers)
+	return proxy.NewForwarder(name, forwarding.Identity, forwarding.TrustedPeers)
+}
 
-		clientSSLConfig := &tls.Config{
-			Certificates: []tls.Certificate{viaCert},
-			RootCAs:      caPool,
+// newInterceptors 按配置的顺序创建转发的stream的拦截器
+func newInterceptors(configs []*conf.Interceptor) ([]proxy.FrameInterceptor, error) {
+	interceptors := make([]proxy.FrameInterceptor, 0, len(configs))
+	for i, config := range configs {
+		interceptor, err := proxy.NewFrameInterceptor(config.Name, config.Params)
+		if err != nil {
+			return nil, fmt.Errorf("interceptors[%d]: %v", i, err)
 		}
-		tlsCredentialsAsClient = credentials.NewTLS(clientSSLConfig)
-	} else {
-		log.Fatalf("Tls.Mode value error: %s", tlsConfig.Tls.Mode)
+		interceptors = append(interceptors, interceptor)
 	}
+	logging.Infof("intercepting the proxied streams with %d interceptors", len(interceptors))
+	return interceptors, nil
 }
 
-func loadCaPool() *x509.CertPool {
-	// Load certificate of the CA who signed server's certificate
-	pemServerCA, err := ioutil.ReadFile("cert/ca.crt")
-	if err != nil {
-		log.Fatalf("failed to read CA cert file. %v", err)
+// newLimiter 按配置的规则限制转发的stream
+func newLimiter(limits []*conf.Limit, forwarder *proxy.Forwarder, registerer prometheus.Registerer) (*proxy.Limiter, error) {
+	rules := make([]proxy.LimitRule, 0, len(limits))
+	for _, limit := range limits {
+		rules = append(rules, proxy.LimitRule{
+			By:                   limit.By,
+			Match:                limit.Match,
+			StreamsPerSecond:     limit.StreamsPerSecond,
+			StreamBurst:          limit.StreamBurst,
+			MaxConcurrentStreams: limit.MaxConcurrentStreams,
+			BytesPerSecond:       limit.BytesPerSecond,
+			ByteBurst:            limit.ByteBurst,
+		})
+	}
+	logging.Infof("limiting the proxied streams with %d rules", len(rules))
+	return proxy.NewLimiter(rules, forwarder, registerer)
+}
+
+// newAuthorizer 按配置的规则校验调用方证书中的身份
+func newAuthorizer(authConfig conf.AuthConfig) (*proxy.Authorizer, error) {
+	rules := make([]proxy.AccessRule, 0, len(authConfig.Rules))
+	for _, rule := range authConfig.Rules {
+		rules = append(rules, proxy.AccessRule{Identity: rule.Identity, PartyIds: rule.PartyIds, ServiceTypes: rule.ServiceTypes})
+	}
+	return proxy.NewAuthorizer(authConfig.Identity, rules)
+}
+
+// newSignupAuthenticator 按配置的证书身份规则和共享密钥认证task服务的注册
+func newSignupAuthenticator(signupConfig conf.SignupConfig) (*proxy.SignupAuthenticator, error) {
+	var authorizer *proxy.Authorizer
+	if len(signupConfig.Rules) > 0 {
+		var err error
+		authorizer, err = newAuthorizer(conf.AuthConfig{Identity: signupConfig.Identity, Rules: signupConfig.Rules})
+		if err != nil {
+			return nil, err
+		}
+	}
+	secrets := make([]proxy.SignupSecret, 0, len(signupConfig.Secrets))
+	for _, secret := range signupConfig.Secrets {
+		secrets = append(secrets, proxy.SignupSecret{KeyId: secret.KeyId, Secret: secret.Secret, PartyIds: secret.PartyIds})
 	}
+	return proxy.NewSignupAuthenticator(authorizer, secrets, signupConfig.TokenMaxAge)
+}
 
-	caPool := x509.NewCertPool()
-	if !caPool.AppendCertsFromPEM(pemServerCA) {
-		log.Fatalf("failed to add CA cert to cert pool. %v", err)
+func waitForGracefulShutdown(shutdowns ...func()) {
+	interruptChan := make(chan os.Signal, 1)
+	signal.Notify(interruptChan, os.Interrupt, syscall.SIGINT, syscall.SIGTERM)
+
+	<-interruptChan
+
+	_, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	for _, shutdown := range shutdowns {
+		shutdown()
 	}
 
-	return caPool
+	logging.Infof("Shutting down VIA server.")
+	os.Exit(0)
 }
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"errors"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"io"
+	"sort"
+	"time"
+	"via/logging"
+	"via/proxy"
+	"via/via"
+)
+
+type VIAServer struct {
+	registry proxy.Registry
+	lessor   *proxy.Lessor              //未开启租约时为nil
+	auth     *proxy.SignupAuthenticator //未开启注册认证时为nil
+	dialOpts []grpc.DialOption          //回拨task服务时使用的拨号选项
+	routes   *proxy.RouteTable          //WaitForParties向远程参与方所在的VIA询问，没有路由时为nil
+	peers    []*clusterPeer             //集群中的其他VIA实例，未配置集群时为空
+}
+
+func NewVIAServer(registry proxy.Registry, lessor *proxy.Lessor, auth *proxy.SignupAuthenticator, dialOpts []grpc.DialOption, routes *proxy.RouteTable) *VIAServer {
+	return &VIAServer{registry: registry, lessor: lessor, auth: auth, dialOpts: dialOpts, routes: routes}
+}
+
+func (t *VIAServer) Signup(ctx context.Context, req *via.SignupReq) (*via.SignupResp, error) {
+
+	signupTask := &proxy.SignupTask{TaskId: req.TaskId, PartyId: req.PartyId, ServiceType: req.ServiceType, Address: req.Address}
+	if signupTask.ServiceType == "" {
+		signupTask.ServiceType = proxy.DefaultServiceType
+	}
+
+	logging.Infof("signup request: %v", req)
+
+	key := signupTask.Key()
+	claims := proxy.SignupClaims{TaskId: req.TaskId, PartyId: req.PartyId, ServiceType: req.ServiceType, Address: req.Address}
+	owner, err := t.authenticate(ctx, claims, &key)
+	if err != nil {
+		logging.Warnf("signup authentication failed: %v", err)
+		return &via.SignupResp{Result: false}, err
+	}
+	signupTask.Owner = owner
+	//已由其他注册者注册的task不能被覆盖，回拨之前先检查，Register时还会再次检查
+	if err := t.checkOwner(key, owner, ""); err != nil {
+		logging.Warnf("signup rejected: %v", err)
+		return &via.SignupResp{Result: false}, err
+	}
+
+	//得到调用者信息，然后proxy连上它，以便后续转发数据流
+	if _, ok := peer.FromContext(ctx); ok {
+		//获得conn
+
+		logging.Debugf("dialing local task server %s", signupTask.Address)
+		conn, err := t.dial(ctx, signupTask.Address)
+
+		if err != nil {
+			logging.Errorf("failed to dial local task server %s: %v", signupTask.Address, err)
+			return &via.SignupResp{Result: false}, err
+		}
+
+		//用taskId/partyId/serviceType作为请求者的唯一标识，把conn保存到registry中。
+		signupTask.Conn = conn
+		resp := &via.SignupResp{Result: true}
+		if t.lessor != nil {
+			resp.LeaseId = t.lessor.Grant(signupTask)
+			resp.Ttl = int64(t.lessor.TTL() / time.Second)
+		}
+		replaced, err := t.registry.Register(signupTask)
+		if err != nil {
+			if t.lessor != nil {
+				t.lessor.Revoke(resp.LeaseId)
+			}
+			conn.Close()
+			logging.Warnf("failed to register local task server %s: %v", signupTask.Address, err)
+			if err == proxy.ErrTaskOwned {
+				return &via.SignupResp{Result: false}, status.Errorf(codes.PermissionDenied, "%v", err)
+			}
+			return &via.SignupResp{Result: false}, err
+		}
+
+		//同一地址重新注册时，关闭被替换的实例的连接，它正在转发的stream结束后关闭
+		if replaced != nil {
+			t.revoke(replaced)
+			replaced.Close(false)
+		}
+		logging.Infof("registered local task server %s, %+v", signupTask.Address, key)
+
+		return resp, nil
+	} else {
+		logging.Errorf("failed to retrieve the task server peer info")
+		return &via.SignupResp{Result: false}, errors.New("failed to retrieve the task server peer info")
+	}
+}
+
+func (t *VIAServer) Unregister(ctx context.Context, req *via.UnregisterReq) (*via.Boolean, error) {
+	logging.Infof("unregister request: %v", req)
+
+	key := proxy.NewTaskKey(req.TaskId, req.PartyId, req.ServiceType)
+	claims := proxy.SignupClaims{TaskId: req.TaskId, PartyId: req.PartyId, ServiceType: req.ServiceType, Address: req.Address}
+	owner, err := t.authenticate(ctx, claims, &key)
+	if err != nil {
+		logging.Warnf("unregister authentication failed: %v", err)
+		return &via.Boolean{Result: false}, err
+	}
+	if err := t.checkOwner(key, owner, req.Address); err != nil {
+		logging.Warnf("unregister rejected: %v", err)
+		return &via.Boolean{Result: false}, err
+	}
+
+	//只注销在本VIA注册的实例，在集群中其他VIA实例注册的实例由转发的请求注销
+	var tasks []*proxy.SignupTask
+	for _, instance := range t.registry.Lookup(key) {
+		if instance.Origin == "" && (req.Address == "" || instance.Address == req.Address) && t.registry.Delete(instance) {
+			tasks = append(tasks, instance)
+		}
+	}
+	for _, task := range tasks {
+		t.revoke(task)
+		task.Close(req.CancelStreams)
+	}
+	forwarded, err := t.forwardToPeers(ctx, func(ctx context.Context, client via.VIAServiceClient) (*via.Boolean, error) {
+		return client.Unregister(ctx, req)
+	})
+	if err != nil {
+		return &via.Boolean{Result: false}, err
+	}
+	if len(tasks) == 0 && !forwarded {
+		logging.Warnf("task to unregister is not registered, %+v, address: %s", key, req.Address)
+		return &via.Boolean{Result: false}, nil
+	}
+
+	logging.Infof("unregistered local task server, %+v, instances: %d", key, len(tasks))
+	return &via.Boolean{Result: true}, nil
+}
+
+func (t *VIAServer) EndTask(ctx context.Context, req *via.EndTaskReq) (*via.Boolean, error) {
+	logging.Infof("end task request: %v", req)
+
+	var tasks []*proxy.SignupTask
+	if t.auth == nil && len(t.peers) == 0 {
+		tasks = t.registry.RemoveTask(req.TaskId)
+	} else {
+		owner, err := t.authenticate(ctx, proxy.SignupClaims{TaskId: req.TaskId}, nil)
+		if err != nil {
+			logging.Warnf("end task authentication failed: %v", err)
+			return &via.Boolean{Result: false}, err
+		}
+		//开启注册认证时，只注销调用者自己注册的参与方；集群中其他VIA实例注册的参与方由转发的请求注销
+		for _, task := range t.registry.List() {
+			if task.TaskId == req.TaskId && task.Owner == owner && task.Origin == "" && t.registry.Delete(task) {
+				tasks = append(tasks, task)
+			}
+		}
+	}
+	for _, task := range tasks {
+		t.revoke(task)
+		task.Close(req.CancelStreams)
+	}
+	forwarded, err := t.forwardToPeers(ctx, func(ctx context.Context, client via.VIAServiceClient) (*via.Boolean, error) {
+		return client.EndTask(ctx, req)
+	})
+	if err != nil {
+		return &via.Boolean{Result: false}, err
+	}
+
+	logging.Infof("ended task %s, unregistered instances: %d", req.TaskId, len(tasks))
+	return &via.Boolean{Result: len(tasks) > 0 || forwarded}, nil
+}
+
+func (t *VIAServer) KeepAlive(stream via.VIAService_KeepAliveServer) error {
+	if t.lessor == nil {
+		return status.Errorf(codes.FailedPrecondition, "lease is disabled")
+	}
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		resp := &via.KeepAliveResp{LeaseId: req.LeaseId}
+		if ttl, err := t.lessor.KeepAlive(req.LeaseId); err == nil {
+			resp.Ttl = int64(ttl / time.Second)
+		} else if eviction, ok := t.lessor.Evicted(req.LeaseId); ok {
+			//告知task服务被驱逐的原因
+			resp.Reason = eviction.Reason
+		} else {
+			resp.Reason = err.Error()
+		}
+		if err := stream.Send(resp); err != nil {
+			return err
+		}
+	}
+}
+
+func (t *VIAServer) ListTasks(ctx context.Context, req *via.ListTasksReq) (*via.ListTasksResp, error) {
+	resp := &via.ListTasksResp{}
+	for _, task := range t.registry.List() {
+		if matchTask(task, req.TaskId, req.PartyId, req.ServiceType) {
+			resp.Tasks = append(resp.Tasks, taskInfo(task))
+		}
+	}
+	sortTasks(resp.Tasks)
+	return resp, nil
+}
+
+func (t *VIAServer) GetTask(ctx context.Context, req *via.GetTaskReq) (*via.GetTaskResp, error) {
+	key := proxy.NewTaskKey(req.TaskId, req.PartyId, req.ServiceType)
+	instances := t.registry.Lookup(key)
+	if len(instances) == 0 {
+		return nil, status.Errorf(codes.NotFound, "task %s of party %s is not registered, service type: %s", key.TaskId, key.PartyId, key.ServiceType)
+	}
+	resp := &via.GetTaskResp{}
+	for _, instance := range instances {
+		resp.Instances = append(resp.Instances, taskInfo(instance))
+	}
+	return resp, nil
+}
+
+func (t *VIAServer) WatchTasks(req *via.WatchTasksReq, stream via.VIAService_WatchTasksServer) error {
+	tasks, watch := t.registry.Watch()
+	defer watch.Stop()
+
+	send := func(eventType via.TaskEvent_Type, task *proxy.SignupTask) error {
+		if !matchTask(task, req.TaskId, req.PartyId, req.ServiceType) || (req.LocalOnly && task.Origin != "") {
+			return nil
+		}
+		return stream.Send(&via.TaskEvent{Type: eventType, Task: taskInfo(task)})
+	}
+	for _, task := range tasks {
+		if err := send(via.TaskEvent_ADDED, task); err != nil {
+			return err
+		}
+	}
+	if err := stream.Send(&via.TaskEvent{Type: via.TaskEvent_SYNCED}); err != nil {
+		return err
+	}
+	for {
+		select {
+		case <-stream.Context().Done():
+			return stream.Context().Err()
+		case event, ok := <-watch.Events():
+			if !ok {
+				//调用方接收太慢，事件已经丢失，需要重新watch
+				return status.Errorf(codes.Aborted, "watch fell behind the registry changes, watch again")
+			}
+			if err := send(taskEventTypes[event.Type], event.Task); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+var taskEventTypes = map[proxy.RegistryEventType]via.TaskEvent_Type{
+	proxy.TaskAdded:   via.TaskEvent_ADDED,
+	proxy.TaskUpdated: via.TaskEvent_UPDATED,
+	proxy.TaskRemoved: via.TaskEvent_REMOVED,
+}
+
+// matchTask 为空的条件不过滤
+func matchTask(task *proxy.SignupTask, taskId, partyId, serviceType string) bool {
+	return (taskId == "" || task.TaskId == taskId) &&
+		(partyId == "" || task.PartyId == partyId) &&
+		(serviceType == "" || task.ServiceType == serviceType)
+}
+
+func taskInfo(task *proxy.SignupTask) *via.TaskInfo {
+	return &via.TaskInfo{
+		TaskId:        task.TaskId,
+		PartyId:       task.PartyId,
+		ServiceType:   task.ServiceType,
+		Address:       task.Address,
+		ActiveStreams: int64(task.ActiveStreams()),
+		Owner:         task.Owner,
+		Origin:        task.Origin,
+		Health:        taskHealth[task.Health()],
+	}
+}
+
+var taskHealth = map[proxy.HealthStatus]via.TaskInfo_Health{
+	proxy.HealthUnknown:    via.TaskInfo_UNKNOWN,
+	proxy.HealthServing:    via.TaskInfo_SERVING,
+	proxy.HealthNotServing: via.TaskInfo_NOT_SERVING,
+}
+
+// sortTasks 按taskId、partyId、serviceType和地址排序，使ListTasks的结果稳定
+func sortTasks(tasks []*via.TaskInfo) {
+	sort.Slice(tasks, func(i, j int) bool {
+		a, b := tasks[i], tasks[j]
+		if a.TaskId != b.TaskId {
+			return a.TaskId < b.TaskId
+		}
+		if a.PartyId != b.PartyId {
+			return a.PartyId < b.PartyId
+		}
+		if a.ServiceType != b.ServiceType {
+			return a.ServiceType < b.ServiceType
+		}
+		return a.Address < b.Address
+	})
+}
+
+// dial 拨号本地task服务，用来转发调用到它，opts加在配置的拨号选项之后
+func (t *VIAServer) dial(ctx context.Context, address string, opts ...grpc.DialOption) (*grpc.ClientConn, error) {
+	dialOpts := append([]grpc.DialOption{grpc.WithDefaultCallOptions(grpc.ForceCodec(proxy.Codec()))}, t.dialOpts...)
+	return grpc.DialContext(ctx, address, append(dialOpts, opts...)...)
+}
+
+// authenticate 认证注册、注销和结束任务的请求，返回调用者的身份。未开启注册认证时返回空身份。
+// token要为这次调用的方法和请求中的参数签发
+func (t *VIAServer) authenticate(ctx context.Context, claims proxy.SignupClaims, key *proxy.TaskKey) (string, error) {
+	if t.auth == nil {
+		return "", nil
+	}
+	claims.Method, _ = grpc.Method(ctx)
+	return t.auth.Authenticate(ctx, claims, key)
+}
+
+// checkOwner 检查key下的实例(address不为空时只检查此地址的实例)是否都由owner注册
+func (t *VIAServer) checkOwner(key proxy.TaskKey, owner, address string) error {
+	for _, instance := range t.registry.Lookup(key) {
+		if (address == "" || instance.Address == address) && instance.Owner != owner {
+			return status.Errorf(codes.PermissionDenied, "task %s of party %s is registered by another owner", key.TaskId, key.PartyId)
+		}
+	}
+	return nil
+}
+
+// 注销task时，同时释放它的租约
+func (t *VIAServer) revoke(task *proxy.SignupTask) {
+	if t.lessor != nil && task.LeaseId != "" {
+		t.lessor.Revoke(task.LeaseId)
+	}
+}
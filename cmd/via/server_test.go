@@ -0,0 +1,176 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"via/proxy"
+	"via/via"
+)
+
+// startVIA 启动一个不在集群中的VIA实例，auth不为nil时开启注册认证
+func startVIA(t *testing.T, auth *proxy.SignupAuthenticator) *testVIA {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	registry := proxy.NewMemoryRegistry()
+	server := newProxyServer(nil, proxy.GetDirector(registry))
+	via.RegisterVIAServiceServer(server, NewVIAServer(registry, nil, auth, []grpc.DialOption{grpc.WithInsecure()}, nil))
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.Dial(listener.Addr().String(), grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &testVIA{address: listener.Addr().String(), registry: registry, server: server, client: via.NewVIAServiceClient(conn), conn: conn}
+}
+
+func TestUnregisterInstance(t *testing.T) {
+	v := startVIA(t, nil)
+	ctx := context.Background()
+	key := proxy.NewTaskKey("task", "p1", "")
+	first, second := startTaskServer(t), startTaskServer(t)
+	for _, address := range []string{first, second} {
+		if _, err := v.client.Signup(ctx, &via.SignupReq{TaskId: "task", PartyId: "p1", Address: address}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	//指定地址时只注销这个实例，同一个key的其他实例保留
+	resp, err := v.client.Unregister(ctx, &via.UnregisterReq{TaskId: "task", PartyId: "p1", Address: first})
+	if err != nil || !resp.Result {
+		t.Fatalf("expected the instance to be unregistered, got %v, %v", resp, err)
+	}
+	instances := v.registry.Lookup(key)
+	if len(instances) != 1 || instances[0].Address != second {
+		t.Fatalf("expected only the instance at %s to be left, got %v", second, instances)
+	}
+	checkTask(t, v, "task", "p1")
+
+	if resp, err := v.client.Unregister(ctx, &via.UnregisterReq{TaskId: "task", PartyId: "p1", Address: first}); err != nil || resp.Result {
+		t.Fatalf("expected the unregistered instance not to be found, got %v, %v", resp, err)
+	}
+	if resp, err := v.client.Unregister(ctx, &via.UnregisterReq{TaskId: "task", PartyId: "p1"}); err != nil || !resp.Result {
+		t.Fatalf("expected the other instance to be unregistered, got %v, %v", resp, err)
+	}
+	if !unregistered(v, key)() {
+		t.Fatalf("expected no instance left")
+	}
+}
+
+func TestEndTaskCancelsStreams(t *testing.T) {
+	v := startVIA(t, nil)
+	ctx := context.Background()
+	for _, req := range []*via.SignupReq{
+		{TaskId: "task", PartyId: "p1", Address: startTaskServer(t)},
+		{TaskId: "task", PartyId: "p1", ServiceType: "data", Address: startTaskServer(t)},
+		{TaskId: "task", PartyId: "p2", Address: startTaskServer(t)},
+		{TaskId: "other", PartyId: "p1", Address: startTaskServer(t)},
+	} {
+		if _, err := v.client.Signup(ctx, req); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	//health的Watch在task服务返回状态后保持打开，直到被取消
+	streamCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	streamCtx = metadata.AppendToOutgoingContext(streamCtx, proxy.MetadataTaskIdKey, "task", proxy.MetadataPartyIdKey, "p2")
+	stream, err := healthpb.NewHealthClient(v.conn).Watch(streamCtx, &healthpb.HealthCheckRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stream.Recv(); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := v.client.EndTask(ctx, &via.EndTaskReq{TaskId: "task", CancelStreams: true})
+	if err != nil || !resp.Result {
+		t.Fatalf("expected the task to be ended, got %v, %v", resp, err)
+	}
+	//stream被取消后task服务的连接随之关闭，调用方收到哪一个错误取决于谁先到达
+	if _, err := stream.Recv(); status.Code(err) != codes.Canceled && status.Code(err) != codes.Unavailable {
+		t.Fatalf("expected the open stream of the task to be canceled, got %v", err)
+	}
+	if streamCtx.Err() != nil {
+		t.Fatalf("expected the stream to be canceled by the VIA before its deadline")
+	}
+	tasks := v.registry.List()
+	if len(tasks) != 1 || tasks[0].TaskId != "other" {
+		t.Fatalf("expected only the other task to be left, got %v", tasks)
+	}
+	checkTask(t, v, "other", "p1")
+}
+
+func TestSignupOwner(t *testing.T) {
+	auth, err := proxy.NewSignupAuthenticator(nil, []proxy.SignupSecret{{KeyId: "k1", Secret: "s1"}, {KeyId: "k2", Secret: "s2"}}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := startVIA(t, auth)
+	key := proxy.NewTaskKey("task", "p1", "")
+	withToken := func(keyId, secret, method string, claims proxy.SignupClaims) context.Context {
+		claims.Method = "/via.VIAService/" + method
+		return proxy.WithSignupToken(context.Background(), keyId, secret, claims)
+	}
+
+	address := startTaskServer(t)
+	signup := &via.SignupReq{TaskId: "task", PartyId: "p1", Address: address}
+	ctx := withToken("k1", "s1", "Signup", proxy.SignupClaims{TaskId: "task", PartyId: "p1", Address: address})
+	if _, err := v.client.Signup(ctx, signup); err != nil {
+		t.Fatal(err)
+	}
+
+	//其他注册者不能注销、覆盖或结束这个任务
+	ctx = withToken("k2", "s2", "Unregister", proxy.SignupClaims{TaskId: "task", PartyId: "p1"})
+	if _, err := v.client.Unregister(ctx, &via.UnregisterReq{TaskId: "task", PartyId: "p1"}); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("expected the unregister of another owner to be denied, got %v", err)
+	}
+	ctx = withToken("k2", "s2", "Signup", proxy.SignupClaims{TaskId: "task", PartyId: "p1", Address: address})
+	if _, err := v.client.Signup(ctx, signup); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("expected the signup of another owner to be denied, got %v", err)
+	}
+	ctx = withToken("k2", "s2", "EndTask", proxy.SignupClaims{TaskId: "task"})
+	if resp, err := v.client.EndTask(ctx, &via.EndTaskReq{TaskId: "task"}); err != nil || resp.Result {
+		t.Fatalf("expected the end task of another owner to end nothing, got %v, %v", resp, err)
+	}
+	if instances := v.registry.Lookup(key); len(instances) != 1 || instances[0].Owner != "k1" {
+		t.Fatalf("expected the task to stay registered by k1, got %v", instances)
+	}
+
+	ctx = withToken("k1", "s1", "Unregister", proxy.SignupClaims{TaskId: "task", PartyId: "p1"})
+	if resp, err := v.client.Unregister(ctx, &via.UnregisterReq{TaskId: "task", PartyId: "p1"}); err != nil || !resp.Result {
+		t.Fatalf("expected the owner to unregister the task, got %v, %v", resp, err)
+	}
+}
+
+func TestForwardedRequestNotForwardedAgain(t *testing.T) {
+	vias := startCluster(t, 2, time.Minute)
+	key := proxy.NewTaskKey("task", "p1", "")
+	if _, err := vias[0].client.Signup(context.Background(), &via.SignupReq{TaskId: "task", PartyId: "p1", Address: startTaskServer(t)}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the task to be synced", registered(vias[1], key, vias[0].address))
+
+	//带有跳数的请求是其他VIA实例转发来的，不再转发给集群中的VIA实例
+	ctx := metadata.AppendToOutgoingContext(context.Background(), proxy.MetadataHopCountKey, "1")
+	if resp, err := vias[1].client.Unregister(ctx, &via.UnregisterReq{TaskId: "task", PartyId: "p1"}); err != nil || resp.Result {
+		t.Fatalf("expected the forwarded unregister to find no local task, got %v, %v", resp, err)
+	}
+	if resp, err := vias[1].client.EndTask(ctx, &via.EndTaskReq{TaskId: "task"}); err != nil || resp.Result {
+		t.Fatalf("expected the forwarded end task to find no local task, got %v, %v", resp, err)
+	}
+	if !registered(vias[0], key, "")() || !registered(vias[1], key, vias[0].address)() {
+		t.Fatalf("expected the task to stay registered on both instances")
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"golang.org/x/net/context"
+	"via/conf"
+)
+
+// newTracerProvider 按配置创建导出span的TracerProvider，exporter为空时返回nil
+func newTracerProvider(tracing conf.Tracing) (*sdktrace.TracerProvider, error) {
+	var exporter sdktrace.SpanExporter
+	switch tracing.Exporter {
+	case "":
+		return nil, nil
+	case "otlp":
+		opts := []otlptracegrpc.Option{otlptracegrpc.WithEndpoint(tracing.Endpoint)}
+		if tracing.Insecure {
+			opts = append(opts, otlptracegrpc.WithInsecure())
+		}
+		// 不等待collector连接成功，collector不可用时span被丢弃，不影响转发
+		e, err := otlptracegrpc.New(context.Background(), opts...)
+		if err != nil {
+			return nil, err
+		}
+		exporter = e
+	case "file":
+		f, err := os.OpenFile(tracing.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, err
+		}
+		e, err := stdouttrace.New(stdouttrace.WithWriter(f))
+		if err != nil {
+			return nil, err
+		}
+		exporter = e
+	default:
+		return nil, fmt.Errorf("unknown tracing exporter %s", tracing.Exporter)
+	}
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceNameKey.String(tracing.ServiceName))),
+	), nil
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"via/logging"
+	"via/proxy"
+	"via/via"
+)
+
+// 向远程VIA询问参与方失败后重试的间隔，每次失败加倍
+const (
+	waitMinBackoff = 100 * time.Millisecond
+	waitMaxBackoff = 5 * time.Second
+)
+
+// WaitForParties 等待任务的参与方都注册完成：本地注册的参与方由registry的watch得知，
+// 路由表中有路由的参与方同时向它所在的VIA询问，转发的请求在metadata中携带跳数，防止路由环路
+func (t *VIAServer) WaitForParties(ctx context.Context, req *via.WaitForPartiesReq) (*via.WaitForPartiesResp, error) {
+	if req.TaskId == "" || len(req.PartyIds) == 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "taskId and partyIds are required")
+	}
+	if req.TimeoutMillis < 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "timeoutMillis must not be negative")
+	}
+	hops, err := hopCount(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if req.TimeoutMillis > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(req.TimeoutMillis)*time.Millisecond)
+		defer cancel()
+	}
+
+	missing := make(map[string]bool, len(req.PartyIds))
+	for _, partyId := range req.PartyIds {
+		missing[partyId] = true
+	}
+	signedUp := func(task *proxy.SignupTask) bool {
+		return task.TaskId == req.TaskId && (req.ServiceType == "" || task.ServiceType == req.ServiceType)
+	}
+
+	tasks, watch := t.registry.Watch()
+	defer func() {
+		watch.Stop()
+	}()
+	for _, task := range tasks {
+		if signedUp(task) {
+			delete(missing, task.PartyId)
+		}
+	}
+
+	found := make(chan string, len(missing))
+	if t.routes != nil && hops < t.routes.MaxHops() {
+		t.askPeers(ctx, req, missing, hops, found)
+	}
+
+	for len(missing) > 0 {
+		select {
+		case <-ctx.Done():
+			return waitResult(missing), nil
+		case partyId := <-found:
+			delete(missing, partyId)
+		case event, ok := <-watch.Events():
+			if !ok {
+				//watch跟不上registry的变化时重新watch
+				tasks, watch = t.registry.Watch()
+				for _, task := range tasks {
+					if signedUp(task) {
+						delete(missing, task.PartyId)
+					}
+				}
+				continue
+			}
+			if event.Type != proxy.TaskRemoved && signedUp(event.Task) {
+				delete(missing, event.Task.PartyId)
+			}
+		}
+	}
+	return waitResult(missing), nil
+}
+
+// askPeers 按路由把未在本地注册的参与方分组，分别向它们所在的VIA询问，已注册的参与方发送到found
+func (t *VIAServer) askPeers(ctx context.Context, req *via.WaitForPartiesReq, missing map[string]bool, hops int, found chan<- string) {
+	peers := make(map[string][]string)
+	for partyId := range missing {
+		if address, ok := t.routes.Resolve(partyId); ok {
+			peers[address] = append(peers[address], partyId)
+		}
+	}
+	//等待时间随ctx的deadline传给远程VIA
+	outCtx := metadata.NewOutgoingContext(ctx, metadata.Pairs(proxy.MetadataHopCountKey, strconv.Itoa(hops+1)))
+	for address, partyIds := range peers {
+		conn, err := t.routes.Conn(address)
+		if err != nil {
+			logging.Warnf("failed to dial VIA %s to wait for parties %v: %v", address, partyIds, err)
+			continue
+		}
+		go askPeer(outCtx, via.NewVIAServiceClient(conn), address, req, partyIds, found)
+	}
+}
+
+// askPeer 向远程VIA询问参与方是否已注册，调用失败或返回时仍有参与方未注册时按退避间隔重试，直到ctx结束
+func askPeer(ctx context.Context, client via.VIAServiceClient, address string, req *via.WaitForPartiesReq, partyIds []string, found chan<- string) {
+	backoff := waitMinBackoff
+	for {
+		resp, err := client.WaitForParties(ctx, &via.WaitForPartiesReq{
+			TaskId:      req.TaskId,
+			PartyIds:    partyIds,
+			ServiceType: req.ServiceType,
+		})
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			logging.Warnf("failed to wait for parties %v at VIA %s, retrying in %v: %v", partyIds, address, backoff, err)
+		} else {
+			stillMissing := make(map[string]bool, len(resp.MissingPartyIds))
+			for _, partyId := range resp.MissingPartyIds {
+				stillMissing[partyId] = true
+			}
+			var missing []string
+			for _, partyId := range partyIds {
+				if stillMissing[partyId] {
+					missing = append(missing, partyId)
+				} else {
+					found <- partyId
+				}
+			}
+			if partyIds = missing; len(partyIds) == 0 {
+				return
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > waitMaxBackoff {
+			backoff = waitMaxBackoff
+		}
+	}
+}
+
+func waitResult(missing map[string]bool) *via.WaitForPartiesResp {
+	resp := &via.WaitForPartiesResp{Result: len(missing) == 0}
+	for partyId := range missing {
+		resp.MissingPartyIds = append(resp.MissingPartyIds, partyId)
+	}
+	sort.Strings(resp.MissingPartyIds)
+	return resp
+}
+
+// hopCount 返回远程VIA转发来的请求已经经过的跳数，本地task服务的请求为0
+func hopCount(ctx context.Context) (int, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	values := md.Get(proxy.MetadataHopCountKey)
+	if len(values) == 0 {
+		return 0, nil
+	}
+	hops, err := strconv.Atoi(values[0])
+	if err != nil || hops < 0 {
+		return 0, status.Errorf(codes.InvalidArgument, "invalid %s: %s", proxy.MetadataHopCountKey, values[0])
+	}
+	return hops, nil
+}
+
+// peerVIAServer 是开启内部监听时address上提供的VIAService，只接受远程VIA的WaitForParties，
+// 注册和查询服务只在内部监听上提供。配置了auth时，远程VIA只能询问auth的规则允许它调用的参与方，和director的校验相同
+type peerVIAServer struct {
+	via.UnimplementedVIAServiceServer
+	server     *VIAServer
+	authorizer *proxy.Authorizer
+}
+
+func (p peerVIAServer) WaitForParties(ctx context.Context, req *via.WaitForPartiesReq) (*via.WaitForPartiesResp, error) {
+	if p.authorizer != nil {
+		for _, partyId := range req.PartyIds {
+			if err := p.authorizer.Authorize(ctx, proxy.NewTaskKey(req.TaskId, partyId, req.ServiceType)); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return p.server.WaitForParties(ctx, req)
+}
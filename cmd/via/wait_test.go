@@ -0,0 +1,189 @@
+package main
+
+import (
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"via/proxy"
+	"via/via"
+)
+
+// flakyPeer 是远程VIA的客户端，前failures次WaitForParties失败，之后报告missing以外的参与方已注册
+type flakyPeer struct {
+	via.VIAServiceClient
+	failures int
+	missing  map[string]bool
+	calls    int
+}
+
+func (p *flakyPeer) WaitForParties(ctx context.Context, in *via.WaitForPartiesReq, opts ...grpc.CallOption) (*via.WaitForPartiesResp, error) {
+	p.calls++
+	if p.calls <= p.failures {
+		return nil, status.Errorf(codes.Unavailable, "connection refused")
+	}
+	resp := &via.WaitForPartiesResp{}
+	for _, partyId := range in.PartyIds {
+		if p.missing[partyId] {
+			resp.MissingPartyIds = append(resp.MissingPartyIds, partyId)
+		}
+	}
+	//下次询问时参与方都已注册
+	p.missing = nil
+	return resp, nil
+}
+
+func TestAskPeerRetries(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	peer := &flakyPeer{failures: 2, missing: map[string]bool{"p2": true}}
+	found := make(chan string, 2)
+	askPeer(ctx, peer, "via2", &via.WaitForPartiesReq{TaskId: "task"}, []string{"p1", "p2"}, found)
+
+	if len(found) != 2 || <-found != "p1" || <-found != "p2" {
+		t.Fatalf("expected both parties to be found after the retries")
+	}
+	if peer.calls != 4 {
+		t.Fatalf("expected 2 failed calls and 2 asks, got %d calls", peer.calls)
+	}
+}
+
+func TestAskPeerStopsWithContext(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	peer := &flakyPeer{failures: 1000}
+	done := make(chan struct{})
+	go func() {
+		askPeer(ctx, peer, "via2", &via.WaitForPartiesReq{TaskId: "task"}, []string{"p1"}, make(chan string, 1))
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected askPeer to stop when ctx is done")
+	}
+	if peer.calls < 2 {
+		t.Fatalf("expected the failed call to be retried, got %d calls", peer.calls)
+	}
+}
+
+func TestWaitForPartiesWatch(t *testing.T) {
+	registry := proxy.NewMemoryRegistry()
+	registry.Register(&proxy.SignupTask{TaskId: "task", PartyId: "p1", ServiceType: "default", Address: "p1:9000"})
+	server := NewVIAServer(registry, nil, nil, nil, nil)
+
+	result := make(chan *via.WaitForPartiesResp, 1)
+	go func() {
+		resp, err := server.WaitForParties(context.Background(), &via.WaitForPartiesReq{TaskId: "task", PartyIds: []string{"p1", "p2"}, TimeoutMillis: 5000})
+		if err != nil {
+			t.Error(err)
+		}
+		result <- resp
+	}()
+	time.Sleep(50 * time.Millisecond)
+	//其它任务和已删除的实例不算注册
+	registry.Register(&proxy.SignupTask{TaskId: "other", PartyId: "p2", ServiceType: "default", Address: "p2:9000"})
+	registry.Register(&proxy.SignupTask{TaskId: "task", PartyId: "p2", ServiceType: "default", Address: "p2:9000"})
+
+	select {
+	case resp := <-result:
+		if resp == nil || !resp.Result || len(resp.MissingPartyIds) != 0 {
+			t.Fatalf("expected all parties to be registered, got %v", resp)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected the party registered during the wait to end the wait")
+	}
+}
+
+func TestWaitForPartiesTimeout(t *testing.T) {
+	registry := proxy.NewMemoryRegistry()
+	registry.Register(&proxy.SignupTask{TaskId: "task", PartyId: "p2", ServiceType: "default", Address: "p2:9000"})
+	server := NewVIAServer(registry, nil, nil, nil, nil)
+
+	start := time.Now()
+	resp, err := server.WaitForParties(context.Background(), &via.WaitForPartiesReq{TaskId: "task", PartyIds: []string{"p3", "p1", "p2"}, TimeoutMillis: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond || elapsed > 2*time.Second {
+		t.Fatalf("expected the wait to end at its timeout, took %v", elapsed)
+	}
+	if resp.Result || !reflect.DeepEqual(resp.MissingPartyIds, []string{"p1", "p3"}) {
+		t.Fatalf("expected the sorted missing parties [p1 p3], got %v", resp)
+	}
+
+	_, err = server.WaitForParties(context.Background(), &via.WaitForPartiesReq{TaskId: "task", PartyIds: []string{"p1"}, TimeoutMillis: -1})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expected a negative timeout to be refused, got %v", err)
+	}
+}
+
+// countingPeer 是远程VIA，记录收到的WaitForParties的跳数，报告参与方都已注册
+type countingPeer struct {
+	via.UnimplementedVIAServiceServer
+	mu   sync.Mutex
+	hops []string
+}
+
+func (p *countingPeer) WaitForParties(ctx context.Context, req *via.WaitForPartiesReq) (*via.WaitForPartiesResp, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	p.mu.Lock()
+	p.hops = append(p.hops, md.Get(proxy.MetadataHopCountKey)...)
+	p.mu.Unlock()
+	return &via.WaitForPartiesResp{Result: true}, nil
+}
+
+func (p *countingPeer) calls() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]string(nil), p.hops...)
+}
+
+func TestWaitForPartiesMaxHops(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer := &countingPeer{}
+	peerServer := grpc.NewServer()
+	via.RegisterVIAServiceServer(peerServer, peer)
+	go peerServer.Serve(listener)
+	t.Cleanup(peerServer.Stop)
+
+	routes, err := proxy.NewRouteTable([]proxy.Route{{PartyIdPrefix: "remote_", Address: listener.Addr().String()}}, 2, grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(routes.Close)
+	server := NewVIAServer(proxy.NewMemoryRegistry(), nil, nil, nil, routes)
+	wait := func(hops string) *via.WaitForPartiesResp {
+		ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(proxy.MetadataHopCountKey, hops))
+		resp, err := server.WaitForParties(ctx, &via.WaitForPartiesReq{TaskId: "task", PartyIds: []string{"remote_1"}, TimeoutMillis: 200})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	//已经经过MaxHops跳的请求不再询问远程VIA
+	if resp := wait("2"); resp.Result || !reflect.DeepEqual(resp.MissingPartyIds, []string{"remote_1"}) {
+		t.Fatalf("expected the party to be missing without asking the remote VIA, got %v", resp)
+	}
+	if calls := peer.calls(); len(calls) != 0 {
+		t.Fatalf("expected the remote VIA not to be asked at the hop limit, got %v", calls)
+	}
+
+	if resp := wait("1"); !resp.Result {
+		t.Fatalf("expected the remote VIA to report the party, got %v", resp)
+	}
+	if calls := peer.calls(); !reflect.DeepEqual(calls, []string{"2"}) {
+		t.Fatalf("expected the remote VIA to be asked once with the hop count incremented, got %v", calls)
+	}
+}
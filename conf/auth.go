@@ -0,0 +1,48 @@
+package conf
+
+import "time"
+
+// AuthConfig 配置调用方证书身份的校验：rules为空时不校验，任何调用方都可以调用任意参与方
+type AuthConfig struct {
+	Identity string        `yaml:"identity"` //从证书中取调用方身份的方式：cn, san_uri，或subject属性的OID如2.5.4.11
+	Rules    []*AccessRule `yaml:"rules"`
+}
+
+// AccessRule 允许身份为identity的调用方调用本地的partyIds和serviceTypes，列表为空或为*时不限制
+type AccessRule struct {
+	Identity     string   `yaml:"identity"` //*匹配任意身份
+	PartyIds     []string `yaml:"partyIds"`
+	ServiceTypes []string `yaml:"serviceTypes"`
+}
+
+// Enabled reports whether the callers are authorized against the rules.
+func (a *AuthConfig) Enabled() bool {
+	return len(a.Rules) > 0
+}
+
+// SignupConfig 配置task服务注册(Signup, Unregister, EndTask)的认证
+type SignupConfig struct {
+	Identity    string          `yaml:"identity"`    //从task服务证书中取身份的方式，同auth.identity
+	Rules       []*AccessRule   `yaml:"rules"`       //允许注册的证书身份，及其可以注册的partyIds和serviceTypes
+	Secrets     []*SignupSecret `yaml:"secrets"`     //task服务签名HMAC token的共享密钥
+	TokenMaxAge time.Duration   `yaml:"tokenMaxAge"` //token时间戳和VIA时钟的最大偏差，0表示使用缺省值(5m)
+}
+
+// SignupSecret 是keyId对应的共享密钥，只能注册partyIds中的参与方，为空时不限制
+type SignupSecret struct {
+	KeyId    string   `yaml:"keyId"`
+	Secret   string   `yaml:"secret"`
+	PartyIds []string `yaml:"partyIds"`
+}
+
+// AuthEnabled reports whether the registration calls are authenticated.
+func (s *SignupConfig) AuthEnabled() bool {
+	return len(s.Rules) > 0 || len(s.Secrets) > 0
+}
+
+// Forwarding 配置VIA在转发记录(via-forwarded-*)中的名字，以及保留哪些调用方带来的转发记录
+type Forwarding struct {
+	Name         string   `yaml:"name"`         //本VIA的名字，为空时使用主机名
+	Identity     string   `yaml:"identity"`     //从调用方证书中取身份的方式，同auth.identity
+	TrustedPeers []string `yaml:"trustedPeers"` //可信的远程VIA的证书身份，其他调用方带来的转发记录被丢弃
+}
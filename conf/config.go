@@ -0,0 +1,404 @@
+package conf
+
+import (
+	"bytes"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config is the configuration of the via command, loaded from one YAML file.
+type Config struct {
+	Address    string       `yaml:"address"`    //VIA服务的监听地址
+	Tls        Tls          `yaml:"tls"`        //mode为空时不使用SSL
+	Registry   Registry     `yaml:"registry"`   //注册服务
+	KeepAlive  KeepAlive    `yaml:"keepAlive"`  //gRPC连接的keepalive
+	Message    Message      `yaml:"message"`    //转发消息的大小限制
+	Log        Log          `yaml:"log"`        //日志
+	Admin      Admin        `yaml:"admin"`      //管理接口
+	Tracing    Tracing      `yaml:"tracing"`    //转发的stream的span
+	Routing    RouteConfig  `yaml:"routing"`    //远程VIA的路由表
+	Auth       AuthConfig   `yaml:"auth"`       //调用方证书身份的校验
+	Signup     SignupConfig `yaml:"signup"`     //task服务注册的认证
+	Internal   Internal     `yaml:"internal"`   //本地task服务使用的内部监听
+	Forwarding Forwarding   `yaml:"forwarding"` //转发记录
+	Cluster    Cluster      `yaml:"cluster"`    //同一组织的多个VIA实例
+	//转发的stream的拦截器链，按顺序调用
+	Interceptors []*Interceptor `yaml:"interceptors"`
+	//每个调用方参与方、task和方法的stream数、并发数和字节数限制
+	Limits []*Limit `yaml:"limits"`
+}
+
+// Internal 配置本地task服务使用的内部监听。配置了address时，注册服务只在内部监听上提供，
+// address只接受远程VIA转发来的调用；未配置时注册服务和代理服务共用address
+type Internal struct {
+	Address string `yaml:"address"` //内部监听地址，如内网或本机地址
+	Tls     Tls    `yaml:"tls"`     //内部监听和回拨task服务使用的SSL，mode为空时不使用SSL
+}
+
+// Cluster 配置同一组织的多个VIA实例组成的集群。每个实例从其他实例同步在它们上面注册的task服务，
+// 所以任意实例都可以转发到所有注册的task服务
+type Cluster struct {
+	Peers       []string      `yaml:"peers"`       //集群中其他VIA实例提供注册服务的地址，开启内部监听时为它们的internal.address
+	ExpireAfter time.Duration `yaml:"expireAfter"` //与其他实例断开多久后删除从它同步来的task服务
+}
+
+type Registry struct {
+	LeaseTTL time.Duration `yaml:"leaseTTL"` //注册的租约有效期，0(缺省)表示不开启租约，开启时至少1秒
+	Balancer string        `yaml:"balancer"` //多实例的负载均衡策略：round_robin, least_active, consistent_hash
+	HashKey  string        `yaml:"hashKey"`  //consistent_hash时用来hash的metadata key
+	Backend  string        `yaml:"backend"`  //memory, persistent：persistent时注册信息保存在file中，重启后恢复
+	File     string        `yaml:"file"`     //persistent时的数据库文件
+	//task服务实例的健康检查
+	HealthCheck HealthCheck `yaml:"healthCheck"`
+}
+
+// HealthCheck 配置VIA定期用grpc.health.v1检查注册的task服务实例，检查失败的实例不再转发，直到再次检查通过
+type HealthCheck struct {
+	Interval time.Duration `yaml:"interval"` //检查间隔，0表示不检查
+	Timeout  time.Duration `yaml:"timeout"`  //单次检查的超时时间
+	Service  string        `yaml:"service"`  //检查请求中的服务名，为空时检查整个task服务
+}
+
+type KeepAlive struct {
+	Time                time.Duration `yaml:"time"`                //连接空闲多久后发送ping，0表示使用gRPC的缺省值
+	Timeout             time.Duration `yaml:"timeout"`             //等待ping响应的超时时间，0表示使用gRPC的缺省值
+	MinTime             time.Duration `yaml:"minTime"`             //允许对端发送ping的最小间隔，0表示使用gRPC的缺省值
+	PermitWithoutStream bool          `yaml:"permitWithoutStream"` //是否允许对端在没有stream时发送ping
+}
+
+type Message struct {
+	MaxRecvSize int `yaml:"maxRecvSize"` //单个消息的最大接收字节数，0表示使用gRPC的缺省值(4MB)
+	MaxSendSize int `yaml:"maxSendSize"` //单个消息的最大发送字节数，0表示使用gRPC的缺省值
+}
+
+type Log struct {
+	Level      string `yaml:"level"`      //debug, info, warn, error
+	File       string `yaml:"file"`       //为空时输出到标准错误
+	AccessFile string `yaml:"accessFile"` //每个转发的stream结束时写入一行JSON的access log，为空时不记录
+	Rotate     Rotate `yaml:"rotate"`     //file和accessFile的轮转
+}
+
+type Rotate struct {
+	MaxSize    int  `yaml:"maxSize"`    //单个文件的最大MB数，0表示100MB
+	MaxBackups int  `yaml:"maxBackups"` //保留的轮转文件数，0表示全部保留
+	MaxAge     int  `yaml:"maxAge"`     //轮转文件的保留天数，0表示不按时间删除
+	Compress   bool `yaml:"compress"`   //是否gzip压缩轮转文件
+}
+
+type Admin struct {
+	Address string `yaml:"address"` //管理接口的HTTP监听地址，为空时不开启
+}
+
+type Tracing struct {
+	Exporter    string `yaml:"exporter"`    //otlp, file；为空时不记录span，只透传traceparent
+	Endpoint    string `yaml:"endpoint"`    //otlp时collector的gRPC地址,ip:port
+	Insecure    bool   `yaml:"insecure"`    //otlp时不使用SSL连接collector
+	File        string `yaml:"file"`        //file时每个span以一行JSON追加到这个文件
+	ServiceName string `yaml:"serviceName"` //span的service.name
+}
+
+// Interceptor is a proxy.FrameInterceptor of the chain, created by the factory registered under Name.
+type Interceptor struct {
+	Name   string            `yaml:"name"`   //proxy.RegisterFrameInterceptor注册的名字
+	Params map[string]string `yaml:"params"` //传给拦截器factory的参数
+}
+
+// Limit is a proxy.LimitRule. The limits left zero are not enforced.
+type Limit struct {
+	By                   string  `yaml:"by"`                   //party(认证的调用方), task, method
+	Match                string  `yaml:"match"`                //只限制这个参与方、task或方法，为空时分别限制每一个
+	StreamsPerSecond     float64 `yaml:"streamsPerSecond"`     //新建stream的速率
+	StreamBurst          int     `yaml:"streamBurst"`          //新建stream的突发数，0表示streamsPerSecond向上取整
+	MaxConcurrentStreams int     `yaml:"maxConcurrentStreams"` //同时转发的stream数
+	BytesPerSecond       int64   `yaml:"bytesPerSecond"`       //两个方向转发的字节数的速率
+	ByteBurst            int64   `yaml:"byteBurst"`            //字节数的突发数，0表示bytesPerSecond
+}
+
+// MinLeaseTTL is the shortest registry.leaseTTL enabling leases.
+const MinLeaseTTL = time.Second
+
+// EnvPrefix prefixes the environment variables overriding the config file. The variable of a key is its YAML
+// path in upper snake case, e.g. VIA_TLS_MODE overrides tls.mode and VIA_REGISTRY_LEASE_TTL overrides
+// registry.leaseTTL. Lists can't be overridden, except lists of strings, which are comma separated.
+const EnvPrefix = "VIA"
+
+// DefaultConfig returns the config used for the keys missing from the config file.
+func DefaultConfig() *Config {
+	return &Config{
+		Address: ":10031",
+		Tls: Tls{
+			ReloadInterval: 10 * time.Second,
+		},
+		Internal: Internal{
+			Tls: Tls{
+				ReloadInterval: 10 * time.Second,
+			},
+		},
+		Registry: Registry{
+			Balancer: "round_robin",
+			Backend:  "memory",
+			File:     "via.db",
+			HealthCheck: HealthCheck{
+				Interval: 10 * time.Second,
+				Timeout:  3 * time.Second,
+			},
+		},
+		Log: Log{
+			Level: "info",
+			Rotate: Rotate{
+				MaxSize:    100,
+				MaxBackups: 10,
+				MaxAge:     30,
+			},
+		},
+		Tracing: Tracing{
+			ServiceName: "via",
+		},
+		Auth: AuthConfig{
+			Identity: "cn",
+		},
+		Signup: SignupConfig{
+			Identity: "cn",
+		},
+		Forwarding: Forwarding{
+			Identity: "cn",
+		},
+		Cluster: Cluster{
+			ExpireAfter: 30 * time.Second,
+		},
+	}
+}
+
+// LoadConfig loads the config file over DefaultConfig, applies the environment overrides and validates the
+// result. An empty configFile loads the defaults and the environment only. Unknown keys in the file are errors.
+func LoadConfig(configFile string) (*Config, error) {
+	c := DefaultConfig()
+	if len(configFile) > 0 {
+		buf, err := ioutil.ReadFile(configFile)
+		if err != nil {
+			return nil, fmt.Errorf("load config file error. %v", err)
+		}
+		decoder := yaml.NewDecoder(bytes.NewReader(buf))
+		decoder.KnownFields(true)
+		if err := decoder.Decode(c); err != nil && err != io.EOF {
+			return nil, fmt.Errorf("load config file error. %v", err)
+		}
+		//配置文件中的相对路径相对于配置文件所在的目录，环境变量中的相对于工作目录
+		c.Tls.ResolvePaths(filepath.Dir(configFile))
+		c.Internal.Tls.ResolvePaths(filepath.Dir(configFile))
+		c.Routing.DirectoryFile = resolvePath(filepath.Dir(configFile), c.Routing.DirectoryFile)
+	}
+	if err := applyEnv(c, EnvPrefix, os.LookupEnv); err != nil {
+		return nil, err
+	}
+	if len(c.Routing.DirectoryFile) > 0 {
+		directory, err := LoadDirectory(c.Routing.DirectoryFile)
+		if err != nil {
+			return nil, err
+		}
+		c.Routing.Directory = directory
+	}
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// TlsEnabled reports whether VIA serves and dials with SSL.
+func (c *Config) TlsEnabled() bool {
+	return len(c.Tls.Mode) > 0
+}
+
+// InternalEnabled reports whether the local task services use a separate internal listener.
+func (c *Config) InternalEnabled() bool {
+	return len(c.Internal.Address) > 0
+}
+
+// TaskTls returns the SSL config of the listener the local task services sign up to, which is also used to dial
+// them.
+func (c *Config) TaskTls() *Tls {
+	if c.InternalEnabled() {
+		return &c.Internal.Tls
+	}
+	return &c.Tls
+}
+
+// Validate returns an error listing every invalid value of the config.
+func (c *Config) Validate() error {
+	var errs []string
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Sprintf(format, args...))
+		}
+	}
+
+	check(len(c.Address) > 0, "address is required")
+
+	validateTls("tls", &c.Tls, check)
+	if c.InternalEnabled() {
+		validateTls("internal.tls", &c.Internal.Tls, check)
+		//对远程VIA开放的监听必须校验对端证书
+		check(c.Tls.Mode == "two_way" || c.Tls.Mode == "gm_two_way",
+			"tls.mode must be two_way or gm_two_way when internal.address is set, got %q", c.Tls.Mode)
+	}
+
+	check(c.Registry.LeaseTTL == 0 || c.Registry.LeaseTTL >= MinLeaseTTL, "registry.leaseTTL must be 0 or at least %v, got %v", MinLeaseTTL, c.Registry.LeaseTTL)
+	switch c.Registry.Balancer {
+	case "round_robin", "least_active":
+	case "consistent_hash":
+		check(len(c.Registry.HashKey) > 0, "registry.hashKey is required by the consistent_hash balancer")
+	default:
+		check(false, "registry.balancer must be one of round_robin, least_active, consistent_hash, got %q", c.Registry.Balancer)
+	}
+	switch c.Registry.Backend {
+	case "memory":
+	case "persistent":
+		check(len(c.Registry.File) > 0, "registry.file is required by the persistent backend")
+	default:
+		check(false, "registry.backend must be memory or persistent, got %q", c.Registry.Backend)
+	}
+	check(c.Registry.HealthCheck.Interval >= 0, "registry.healthCheck.interval must not be negative")
+	if c.Registry.HealthCheck.Interval > 0 {
+		check(c.Registry.HealthCheck.Timeout > 0, "registry.healthCheck.timeout must be positive")
+	}
+
+	check(c.KeepAlive.Time >= 0, "keepAlive.time must not be negative")
+	check(c.KeepAlive.Timeout >= 0, "keepAlive.timeout must not be negative")
+	check(c.KeepAlive.MinTime >= 0, "keepAlive.minTime must not be negative")
+
+	check(c.Message.MaxRecvSize >= 0, "message.maxRecvSize must not be negative")
+	check(c.Message.MaxSendSize >= 0, "message.maxSendSize must not be negative")
+
+	switch c.Log.Level {
+	case "debug", "info", "warn", "error":
+	default:
+		check(false, "log.level must be one of debug, info, warn, error, got %q", c.Log.Level)
+	}
+	check(c.Log.Rotate.MaxSize >= 0, "log.rotate.maxSize must not be negative")
+	check(c.Log.Rotate.MaxBackups >= 0, "log.rotate.maxBackups must not be negative")
+	check(c.Log.Rotate.MaxAge >= 0, "log.rotate.maxAge must not be negative")
+
+	switch c.Tracing.Exporter {
+	case "":
+	case "otlp":
+		check(len(c.Tracing.Endpoint) > 0, "tracing.endpoint is required by the otlp exporter")
+	case "file":
+		check(len(c.Tracing.File) > 0, "tracing.file is required by the file exporter")
+	default:
+		check(false, "tracing.exporter must be otlp, file or empty, got %q", c.Tracing.Exporter)
+	}
+
+	check(c.Routing.MaxHops >= 0, "routing.maxHops must not be negative")
+	for i, route := range c.Routing.Routes {
+		check(len(route.Address) > 0, "routing.routes[%d].address is required", i)
+		check(len(route.PartyId) > 0 != (len(route.PartyIdPrefix) > 0),
+			"routing.routes[%d] requires exactly one of partyId and partyIdPrefix", i)
+	}
+	for i, entry := range c.Routing.Directory {
+		check(len(entry.Address) > 0, "%s: parties[%d].address is required", c.Routing.DirectoryFile, i)
+		check(len(entry.PartyId) > 0 != (len(entry.PartyIdPrefix) > 0),
+			"%s: parties[%d] requires exactly one of partyId and partyIdPrefix", c.Routing.DirectoryFile, i)
+	}
+
+	for i, interceptor := range c.Interceptors {
+		check(len(interceptor.Name) > 0, "interceptors[%d].name is required", i)
+	}
+
+	for i, limit := range c.Limits {
+		check(limit.By == "party" || limit.By == "task" || limit.By == "method",
+			"limits[%d].by must be one of party, task, method, got %q", i, limit.By)
+		check(limit.StreamsPerSecond >= 0 && limit.StreamBurst >= 0 && limit.MaxConcurrentStreams >= 0 &&
+			limit.BytesPerSecond >= 0 && limit.ByteBurst >= 0, "limits[%d] must not be negative", i)
+		check(limit.StreamsPerSecond > 0 || limit.MaxConcurrentStreams > 0 || limit.BytesPerSecond > 0,
+			"limits[%d] requires streamsPerSecond, maxConcurrentStreams or bytesPerSecond", i)
+	}
+
+	check(validIdentitySource(c.Forwarding.Identity), "forwarding.identity must be cn, san_uri or an OID, got %q", c.Forwarding.Identity)
+	if len(c.Forwarding.TrustedPeers) > 0 {
+		check(c.Tls.Mode == "two_way" || c.Tls.Mode == "gm_two_way",
+			"forwarding.trustedPeers require tls.mode two_way or gm_two_way, got %q", c.Tls.Mode)
+	}
+
+	if c.Auth.Enabled() {
+		check(c.Tls.Mode == "two_way" || c.Tls.Mode == "gm_two_way",
+			"auth.rules require tls.mode two_way or gm_two_way, got %q", c.Tls.Mode)
+		check(validIdentitySource(c.Auth.Identity), "auth.identity must be cn, san_uri or an OID, got %q", c.Auth.Identity)
+		for i, rule := range c.Auth.Rules {
+			check(len(rule.Identity) > 0, "auth.rules[%d].identity is required", i)
+		}
+	}
+
+	if len(c.Signup.Rules) > 0 {
+		mode := c.TaskTls().Mode
+		check(mode == "two_way" || mode == "gm_two_way",
+			"signup.rules require the tls.mode of the task listener to be two_way or gm_two_way, got %q", mode)
+		check(validIdentitySource(c.Signup.Identity), "signup.identity must be cn, san_uri or an OID, got %q", c.Signup.Identity)
+		for i, rule := range c.Signup.Rules {
+			check(len(rule.Identity) > 0, "signup.rules[%d].identity is required", i)
+		}
+	}
+	keyIds := make(map[string]bool)
+	for i, secret := range c.Signup.Secrets {
+		check(len(secret.KeyId) > 0, "signup.secrets[%d].keyId is required", i)
+		check(len(secret.Secret) > 0, "signup.secrets[%d].secret is required", i)
+		check(!keyIds[secret.KeyId], "signup.secrets[%d].keyId %s is duplicated", i, secret.KeyId)
+		keyIds[secret.KeyId] = true
+	}
+	check(c.Signup.TokenMaxAge >= 0, "signup.tokenMaxAge must not be negative")
+
+	for i, peer := range c.Cluster.Peers {
+		check(len(peer) > 0, "cluster.peers[%d] must not be empty", i)
+	}
+	check(c.Cluster.ExpireAfter >= 0, "cluster.expireAfter must not be negative")
+	//转发给其他实例的Unregister和EndTask只带有token，不带task服务的证书，按证书认证的注册者在其他实例上无法认证
+	check(len(c.Cluster.Peers) == 0 || len(c.Signup.Rules) == 0,
+		"cluster.peers can't be used with signup.rules, the requests forwarded to the peers can't carry the certificate of the task server; authenticate with signup.secrets")
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid config: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// validateTls 检查name下的SSL配置
+func validateTls(name string, t *Tls, check func(ok bool, format string, args ...interface{})) {
+	switch t.Mode {
+	case "":
+	case "one_way", "two_way":
+		check(len(t.ViaCertFile) > 0, "%s.viaCertFile is required in %s mode", name, t.Mode)
+		check(len(t.ViaKeyFile) > 0, "%s.viaKeyFile is required in %s mode", name, t.Mode)
+		check(len(t.CaPaths()) > 0, "%s.caCertFile or %s.caCertFiles is required in %s mode", name, name, t.Mode)
+	case "gm_one_way", "gm_two_way":
+		check(len(t.ViaSignCertFile) > 0, "%s.viaSignCertFile is required in %s mode", name, t.Mode)
+		check(len(t.ViaSignKeyFile) > 0, "%s.viaSignKeyFile is required in %s mode", name, t.Mode)
+		check(len(t.ViaEncryptCertFile) > 0, "%s.viaEncryptCertFile is required in %s mode", name, t.Mode)
+		check(len(t.ViaEncryptKeyFile) > 0, "%s.viaEncryptKeyFile is required in %s mode", name, t.Mode)
+		check(len(t.CaPaths()) > 0, "%s.caCertFile or %s.caCertFiles is required in %s mode", name, name, t.Mode)
+	default:
+		check(false, "%s.mode must be one of one_way, two_way, gm_one_way, gm_two_way or empty, got %q", name, t.Mode)
+	}
+	check(t.ReloadInterval >= 0, "%s.reloadInterval must not be negative", name)
+}
+
+func validIdentitySource(source string) bool {
+	if source == "cn" || source == "san_uri" {
+		return true
+	}
+	parts := strings.Split(source, ".")
+	if len(parts) < 2 {
+		return false
+	}
+	for _, part := range parts {
+		if n, err := strconv.Atoi(part); err != nil || n < 0 {
+			return false
+		}
+	}
+	return true
+}
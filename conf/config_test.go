@@ -0,0 +1,247 @@
+package conf
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadConfig(t *testing.T) {
+	c, err := LoadConfig("./via.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Address != "0.0.0.0:10031" || c.Tls.Mode != "two_way" || c.Registry.LeaseTTL != 30*time.Second {
+		t.Fatalf("unexpected config: %+v", c)
+	}
+	if len(c.Routing.Routes) != 1 || c.Routing.Routes[0].PartyId != "partner_2" {
+		t.Fatalf("unexpected routes: %v", c.Routing.Routes)
+	}
+}
+
+func TestLoadConfigResolvesPaths(t *testing.T) {
+	file := writeConfig(t, "tls:\n  mode: one_way\n  viaCertFile: cert/server.crt\n  viaKeyFile: /etc/via/server.key\n  caCertFiles: [../ca]\n")
+	os.Setenv("VIA_TLS_CA_CERT_FILE", "cert/ca.crt")
+	defer os.Unsetenv("VIA_TLS_CA_CERT_FILE")
+	c, err := LoadConfig(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := filepath.Dir(file)
+	if c.Tls.ViaCertFile != filepath.Join(dir, "cert/server.crt") || c.Tls.ViaKeyFile != "/etc/via/server.key" ||
+		c.Tls.CaCertFiles[0] != filepath.Join(dir, "../ca") {
+		t.Fatalf("expected the paths to be relative to the config file, got %+v", c.Tls)
+	}
+	//环境变量中的路径相对于工作目录
+	if c.Tls.CaCertFile != "cert/ca.crt" {
+		t.Fatalf("expected the path from the environment to be kept, got %s", c.Tls.CaCertFile)
+	}
+}
+
+func TestLoadConfigDefaults(t *testing.T) {
+	c, err := LoadConfig("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Address != DefaultConfig().Address || c.TlsEnabled() {
+		t.Fatalf("expected the insecure default config, got %+v", c)
+	}
+	if c.Registry.LeaseTTL != 0 {
+		t.Fatalf("expected leases to be disabled by default, got %v", c.Registry.LeaseTTL)
+	}
+}
+
+func TestLoadConfigUnknownKey(t *testing.T) {
+	file := writeConfig(t, "address: :10031\nregistry:\n  leaseTtl: 30s\n")
+	if _, err := LoadConfig(file); err == nil || !strings.Contains(err.Error(), "leaseTtl") {
+		t.Fatalf("expected the misspelled key to be rejected, got %v", err)
+	}
+}
+
+func TestLoadConfigInvalid(t *testing.T) {
+	file := writeConfig(t, "tls:\n  mode: three_way\nregistry:\n  leaseTTL: 1ms\n  balancer: consistent_hash\nlog:\n  level: verbose\ntracing:\n  exporter: otlp\nlimits:\n  - by: peer\n")
+	_, err := LoadConfig(file)
+	if err == nil {
+		t.Fatal("expected the config to be invalid")
+	}
+	for _, expected := range []string{"tls.mode", "registry.leaseTTL", "registry.hashKey", "log.level", "tracing.endpoint", "limits[0].by", "limits[0] requires"} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("expected %s in the error: %v", expected, err)
+		}
+	}
+}
+
+func TestValidateCluster(t *testing.T) {
+	c := DefaultConfig()
+	c.Tls = Tls{Mode: "two_way", ViaCertFile: "cert/server.crt", ViaKeyFile: "cert/server.key", CaCertFile: "cert/ca.crt"}
+	c.Cluster.Peers = []string{"10.0.0.2:10041"}
+	c.Signup.Rules = []*AccessRule{{Identity: "task"}}
+	if err := c.Validate(); err == nil || !strings.Contains(err.Error(), "cluster.peers can't be used with signup.rules") {
+		t.Fatalf("expected the cluster with the certificate signup authentication to be invalid, got %v", err)
+	}
+
+	c.Signup.Rules = nil
+	c.Signup.Secrets = []*SignupSecret{{KeyId: "k1", Secret: "s1"}}
+	if err := c.Validate(); err != nil {
+		t.Fatalf("expected the cluster with the token signup authentication to be valid, got %v", err)
+	}
+}
+
+func TestValidateGM(t *testing.T) {
+	c := DefaultConfig()
+	c.Tls = Tls{Mode: "gm_two_way", ViaSignCertFile: "cert/gm_cert/server_sign.crt", CaCertFile: "cert/gm_cert/ca.crt"}
+	err := c.Validate()
+	if err == nil {
+		t.Fatal("expected the gm config without its key pairs to be invalid")
+	}
+	for _, expected := range []string{"tls.viaSignKeyFile", "tls.viaEncryptCertFile", "tls.viaEncryptKeyFile"} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("expected %s in the error: %v", expected, err)
+		}
+	}
+
+	c.Tls.ViaSignKeyFile = "cert/gm_cert/server_sign.key"
+	c.Tls.ViaEncryptCertFile = "cert/gm_cert/server_encrypt.crt"
+	c.Tls.ViaEncryptKeyFile = "cert/gm_cert/server_encrypt.key"
+	if err := c.Validate(); err != nil {
+		t.Fatalf("expected the gm config to be valid, got %v", err)
+	}
+}
+
+func TestValidateAuth(t *testing.T) {
+	c := DefaultConfig()
+	c.Auth = AuthConfig{Identity: "2.5.x", Rules: []*AccessRule{{PartyIds: []string{"partner_1"}}}}
+	err := c.Validate()
+	if err == nil {
+		t.Fatal("expected the auth config to be invalid")
+	}
+	for _, expected := range []string{"auth.rules require tls.mode", "auth.identity", "auth.rules[0].identity"} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("expected %s in the error: %v", expected, err)
+		}
+	}
+
+	c.Tls = Tls{Mode: "two_way", ViaCertFile: "cert/server.crt", ViaKeyFile: "cert/server.key", CaCertFile: "cert/ca.crt"}
+	c.Auth = AuthConfig{Identity: "2.5.4.11", Rules: []*AccessRule{{Identity: "partner_2"}}}
+	if err := c.Validate(); err != nil {
+		t.Fatalf("expected the auth config to be valid, got %v", err)
+	}
+}
+
+func TestValidateInternal(t *testing.T) {
+	c := DefaultConfig()
+	c.Internal.Address = "127.0.0.1:10032"
+	c.Internal.Tls.Mode = "one_way"
+	c.Signup.Rules = []*AccessRule{{Identity: "io"}}
+	err := c.Validate()
+	if err == nil {
+		t.Fatal("expected the internal config to be invalid")
+	}
+	for _, expected := range []string{"tls.mode must be two_way", "internal.tls.viaCertFile", "signup.rules"} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("expected %s in the error: %v", expected, err)
+		}
+	}
+
+	c.Tls = Tls{Mode: "two_way", ViaCertFile: "cert/server.crt", ViaKeyFile: "cert/server.key", CaCertFile: "cert/ca.crt"}
+	c.Internal.Tls = c.Tls
+	if err := c.Validate(); err != nil {
+		t.Fatalf("expected the internal config to be valid, got %v", err)
+	}
+	if c.TaskTls() != &c.Internal.Tls {
+		t.Fatal("expected the task services to use the internal tls")
+	}
+}
+
+func TestApplyEnv(t *testing.T) {
+	env := map[string]string{
+		"VIA_ADDRESS":                          ":20031",
+		"VIA_TLS_VIA_CERT_FILE":                "/etc/via/server.crt",
+		"VIA_REGISTRY_LEASE_TTL":               "1m",
+		"VIA_MESSAGE_MAX_RECV_SIZE":            "1024",
+		"VIA_KEEP_ALIVE_PERMIT_WITHOUT_STREAM": "true",
+	}
+	c := DefaultConfig()
+	err := applyEnv(c, EnvPrefix, func(name string) (string, bool) {
+		value, ok := env[name]
+		return value, ok
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Address != ":20031" || c.Tls.ViaCertFile != "/etc/via/server.crt" || c.Registry.LeaseTTL != time.Minute ||
+		c.Message.MaxRecvSize != 1024 || !c.KeepAlive.PermitWithoutStream {
+		t.Fatalf("expected the environment to override the config, got %+v", c)
+	}
+
+	err = applyEnv(c, EnvPrefix, func(name string) (string, bool) {
+		return "forever", name == "VIA_REGISTRY_LEASE_TTL"
+	})
+	if err == nil || !strings.Contains(err.Error(), "VIA_REGISTRY_LEASE_TTL") {
+		t.Fatalf("expected an invalid duration to be rejected, got %v", err)
+	}
+}
+
+func TestLoadDirectory(t *testing.T) {
+	directory, err := filepath.Abs("directory.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := writeConfig(t, "routing:\n  directoryFile: ./directory.yml\n  routes:\n    - partyId: partner_2\n      address: 127.0.0.1:40031\n")
+	buf, err := ioutil.ReadFile(directory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(filepath.Dir(file), "directory.yml"), buf, 0644); err != nil {
+		t.Fatal(err)
+	}
+	// 目录文件相对于配置文件所在的目录，而不是工作目录
+	chdir(t, t.TempDir())
+	c, err := LoadConfig(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	routes := c.Routing.AllRoutes()
+	// partner_2的路由覆盖目录中的条目
+	if len(routes) != 2 || routes[0].Address != "127.0.0.1:40031" || routes[1].PartyIdPrefix != "partner_3_" {
+		t.Fatalf("unexpected routes: %v", routes)
+	}
+
+	directory = writeConfig(t, "parties:\n  - partyId: partner_3\n")
+	file = writeConfig(t, "routing:\n  directoryFile: "+directory+"\n")
+	if _, err := LoadConfig(file); err == nil || !strings.Contains(err.Error(), "parties[0].address") {
+		t.Fatalf("expected the directory entry without address to be rejected, got %v", err)
+	}
+	file = writeConfig(t, "routing:\n  directoryFile: ./missing.yml\n")
+	if _, err := LoadConfig(file); err == nil {
+		t.Fatal("expected the missing directory file to be an error")
+	}
+}
+
+// chdir 切换工作目录，测试结束时恢复
+func chdir(t *testing.T, dir string) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+}
+
+func writeConfig(t *testing.T, content string) string {
+	dir, err := ioutil.TempDir("", "via-conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	file := filepath.Join(dir, "via.yml")
+	if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
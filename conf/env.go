@@ -0,0 +1,95 @@
+package conf
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// applyEnv overrides the fields of the struct pointed to by v with the environment variables named after their
+// YAML keys, see EnvPrefix.
+func applyEnv(v interface{}, prefix string, lookupEnv func(string) (string, bool)) error {
+	return applyEnvValue(reflect.ValueOf(v).Elem(), prefix, lookupEnv)
+}
+
+func applyEnvValue(v reflect.Value, prefix string, lookupEnv func(string) (string, bool)) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		key := strings.Split(t.Field(i).Tag.Get("yaml"), ",")[0]
+		if key == "" || key == "-" {
+			continue
+		}
+		name := prefix + "_" + envName(key)
+		field := v.Field(i)
+
+		if field.Kind() == reflect.Struct {
+			if err := applyEnvValue(field, name, lookupEnv); err != nil {
+				return err
+			}
+			continue
+		}
+		value, ok := lookupEnv(name)
+		if !ok {
+			continue
+		}
+		if err := setEnvValue(field, value); err != nil {
+			return fmt.Errorf("invalid environment variable %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+func setEnvValue(field reflect.Value, value string) error {
+	switch {
+	case field.Type() == durationType:
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(d))
+	case field.Kind() == reflect.String:
+		field.SetString(value)
+	case field.Kind() == reflect.Int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(n))
+	case field.Kind() == reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+	case field.Kind() == reflect.Slice && field.Type().Elem().Kind() == reflect.String:
+		var values []string
+		for _, s := range strings.Split(value, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				values = append(values, s)
+			}
+		}
+		field.Set(reflect.ValueOf(values))
+	default:
+		return fmt.Errorf("%s can't be set from the environment", field.Type())
+	}
+	return nil
+}
+
+// envName converts a camelCase YAML key to UPPER_SNAKE_CASE, e.g. viaCertFile to VIA_CERT_FILE and leaseTTL to
+// LEASE_TTL.
+func envName(key string) string {
+	var b strings.Builder
+	runes := []rune(key)
+	for i, r := range runes {
+		if i > 0 && unicode.IsUpper(r) && (unicode.IsLower(runes[i-1]) || unicode.IsDigit(runes[i-1])) {
+			b.WriteByte('_')
+		}
+		b.WriteRune(unicode.ToUpper(r))
+	}
+	return b.String()
+}
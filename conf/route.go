@@ -0,0 +1,66 @@
+package conf
+
+import (
+	"bytes"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"io"
+	"io/ioutil"
+)
+
+// RouteConfig 配置不在本地注册的参与方，应转发到哪个远程VIA
+type RouteConfig struct {
+	MaxHops       int      `yaml:"maxHops"` //最大跳数，0表示使用缺省值(8)
+	Routes        []*Route `yaml:"routes"`
+	DirectoryFile string   `yaml:"directoryFile"` //参与方目录文件，列出各参与方所在的VIA，为空时只使用routes
+	Directory     []*Route `yaml:"-"`             //从DirectoryFile加载的参与方目录
+}
+
+// Route 的partyId精确匹配参与方id，partyIdPrefix匹配所有以此为前缀的参与方id，最长的前缀优先
+type Route struct {
+	PartyId       string `yaml:"partyId"`
+	PartyIdPrefix string `yaml:"partyIdPrefix"`
+	Address       string `yaml:"address"`
+}
+
+// directory 参与方目录文件的格式
+type directory struct {
+	Parties []*Route `yaml:"parties"`
+}
+
+// LoadDirectory loads the party directory file, which lists under parties the VIA owning each party, with the
+// same keys as the routes.
+func LoadDirectory(directoryFile string) ([]*Route, error) {
+	buf, err := ioutil.ReadFile(directoryFile)
+	if err != nil {
+		return nil, fmt.Errorf("load party directory error. %v", err)
+	}
+	var d directory
+	decoder := yaml.NewDecoder(bytes.NewReader(buf))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&d); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("load party directory error. %v", err)
+	}
+	return d.Parties, nil
+}
+
+// AllRoutes returns the routes followed by the entries of the party directory. A route of a party overrides its
+// directory entry, so a VIA can reach a party through another hop than the one the directory lists.
+func (c *RouteConfig) AllRoutes() []*Route {
+	routes := append([]*Route(nil), c.Routes...)
+	for _, entry := range c.Directory {
+		if !c.overridden(entry) {
+			routes = append(routes, entry)
+		}
+	}
+	return routes
+}
+
+func (c *RouteConfig) overridden(entry *Route) bool {
+	for _, route := range c.Routes {
+		if route.PartyId == entry.PartyId && route.PartyIdPrefix == entry.PartyIdPrefix {
+			return true
+		}
+	}
+	return false
+}
@@ -4,6 +4,9 @@ import (
 	"fmt"
 	"gopkg.in/yaml.v3"
 	"io/ioutil"
+	"path/filepath"
+	"time"
+	"via/tlsutil"
 )
 
 type TlsConfig struct {
@@ -11,12 +14,83 @@ type TlsConfig struct {
 }
 
 type Tls struct {
-	Mode        string `yaml:"mode"`
-	ViaCertFile string `yaml:"viaCertFile"`
-	ViaKeyFile  string `yaml:"viaKeyFile"`
-	IoCertFile  string `yaml:"ioCertFile"`
-	IoKeyFile   string `yaml:"ioKeyFile"`
-	CaCertFile  string `yaml:"caCertFile"`
+	Mode        string   `yaml:"mode"`
+	ViaCertFile string   `yaml:"viaCertFile"`
+	ViaKeyFile  string   `yaml:"viaKeyFile"`
+	IoCertFile  string   `yaml:"ioCertFile"`
+	IoKeyFile   string   `yaml:"ioKeyFile"`
+	CaCertFile  string   `yaml:"caCertFile"`
+	CaCertFiles []string `yaml:"caCertFiles"` //和CaCertFile一起信任的多个CA证书文件或目录，如联盟中每个机构的CA
+
+	ReloadInterval time.Duration `yaml:"reloadInterval"` //检查证书文件变化的间隔，0表示只在收到SIGHUP时重新加载
+
+	//国密模式(gm_one_way, gm_two_way)下使用的SM2签名证书和加密证书
+	ViaSignCertFile    string `yaml:"viaSignCertFile"`
+	ViaSignKeyFile     string `yaml:"viaSignKeyFile"`
+	ViaEncryptCertFile string `yaml:"viaEncryptCertFile"`
+	ViaEncryptKeyFile  string `yaml:"viaEncryptKeyFile"`
+	IoSignCertFile     string `yaml:"ioSignCertFile"`
+	IoSignKeyFile      string `yaml:"ioSignKeyFile"`
+	IoEncryptCertFile  string `yaml:"ioEncryptCertFile"`
+	IoEncryptKeyFile   string `yaml:"ioEncryptKeyFile"`
+}
+
+// CaPaths returns caCertFile followed by caCertFiles.
+func (t *Tls) CaPaths() []string {
+	var paths []string
+	if len(t.CaCertFile) > 0 {
+		paths = append(paths, t.CaCertFile)
+	}
+	return append(paths, t.CaCertFiles...)
+}
+
+// ResolvePaths makes the relative certificate and key paths relative to dir, the directory of the config file
+// they were loaded from, instead of the working directory.
+func (t *Tls) ResolvePaths(dir string) {
+	for _, path := range []*string{&t.ViaCertFile, &t.ViaKeyFile, &t.IoCertFile, &t.IoKeyFile, &t.CaCertFile,
+		&t.ViaSignCertFile, &t.ViaSignKeyFile, &t.ViaEncryptCertFile, &t.ViaEncryptKeyFile,
+		&t.IoSignCertFile, &t.IoSignKeyFile, &t.IoEncryptCertFile, &t.IoEncryptKeyFile} {
+		*path = resolvePath(dir, *path)
+	}
+	for i, path := range t.CaCertFiles {
+		t.CaCertFiles[i] = resolvePath(dir, path)
+	}
+}
+
+// resolvePath 把相对路径转换为相对dir的路径，空路径和绝对路径不变
+func resolvePath(dir, path string) string {
+	if len(path) == 0 || filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(dir, path)
+}
+
+// ViaOptions returns the TLS options of VIA, which uses the via certificate.
+func (t *Tls) ViaOptions() tlsutil.Options {
+	return tlsutil.Options{
+		Mode:            t.Mode,
+		CertFile:        t.ViaCertFile,
+		KeyFile:         t.ViaKeyFile,
+		SignCertFile:    t.ViaSignCertFile,
+		SignKeyFile:     t.ViaSignKeyFile,
+		EncryptCertFile: t.ViaEncryptCertFile,
+		EncryptKeyFile:  t.ViaEncryptKeyFile,
+		CaFiles:         t.CaPaths(),
+	}
+}
+
+// IoOptions returns the TLS options of a task service, which uses the io certificate.
+func (t *Tls) IoOptions() tlsutil.Options {
+	return tlsutil.Options{
+		Mode:            t.Mode,
+		CertFile:        t.IoCertFile,
+		KeyFile:         t.IoKeyFile,
+		SignCertFile:    t.IoSignCertFile,
+		SignKeyFile:     t.IoSignKeyFile,
+		EncryptCertFile: t.IoEncryptCertFile,
+		EncryptKeyFile:  t.IoEncryptKeyFile,
+		CaFiles:         t.CaPaths(),
+	}
 }
 
 func LoadTlsConfig(configFile string) *TlsConfig {
@@ -30,5 +104,8 @@ func LoadTlsConfig(configFile string) *TlsConfig {
 	if err != nil {
 		panic(fmt.Errorf("load TLS config file error. %v", err))
 	}
+	if c.Tls != nil {
+		c.Tls.ResolvePaths(filepath.Dir(configFile))
+	}
 	return c
 }
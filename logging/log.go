@@ -0,0 +1,114 @@
+// Package logging is the leveled logger of VIA, writing to a file rotated by size and age.
+package logging
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync/atomic"
+
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// Level is the severity of a log line. Lines below the level set by SetLevel are dropped.
+type Level int32
+
+const (
+	DebugLevel Level = iota
+	InfoLevel
+	WarnLevel
+	ErrorLevel
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+	if l < DebugLevel || l > ErrorLevel {
+		return fmt.Sprintf("level(%d)", int32(l))
+	}
+	return levelNames[l]
+}
+
+// ParseLevel returns the level named debug, info, warn or error.
+func ParseLevel(name string) (Level, error) {
+	for i, levelName := range levelNames {
+		if name == levelName {
+			return Level(i), nil
+		}
+	}
+	return InfoLevel, fmt.Errorf("unknown log level %q", name)
+}
+
+var (
+	level  = int32(InfoLevel)
+	logger = log.New(os.Stderr, "", log.LstdFlags)
+)
+
+// SetLevel sets the minimum level of the lines logged. Defaults to InfoLevel.
+func SetLevel(l Level) {
+	atomic.StoreInt32(&level, int32(l))
+}
+
+// Enabled reports whether the lines of level l are logged.
+func Enabled(l Level) bool {
+	return int32(l) >= atomic.LoadInt32(&level)
+}
+
+// SetOutput sets the writer of the log. Defaults to the standard error.
+func SetOutput(w io.Writer) {
+	logger.SetOutput(w)
+}
+
+// Rotation configures when a log file is rotated and how many rotated files are kept.
+type Rotation struct {
+	MaxSize    int  //单个文件的最大MB数，0表示100MB
+	MaxBackups int  //保留的轮转文件数，0表示全部保留
+	MaxAge     int  //轮转文件的保留天数，0表示不按时间删除
+	Compress   bool //是否gzip压缩轮转文件
+}
+
+// NewFile returns a writer appending to file, which is rotated as configured by rotation.
+func NewFile(file string, rotation Rotation) io.WriteCloser {
+	return &lumberjack.Logger{
+		Filename:   file,
+		MaxSize:    rotation.MaxSize,
+		MaxBackups: rotation.MaxBackups,
+		MaxAge:     rotation.MaxAge,
+		Compress:   rotation.Compress,
+		LocalTime:  true,
+	}
+}
+
+func output(l Level, format string, args ...interface{}) {
+	if !Enabled(l) {
+		return
+	}
+	logger.Output(3, "["+l.String()+"] "+fmt.Sprintf(format, args...))
+}
+
+// Debugf logs at DebugLevel.
+func Debugf(format string, args ...interface{}) {
+	output(DebugLevel, format, args...)
+}
+
+// Infof logs at InfoLevel.
+func Infof(format string, args ...interface{}) {
+	output(InfoLevel, format, args...)
+}
+
+// Warnf logs at WarnLevel.
+func Warnf(format string, args ...interface{}) {
+	output(WarnLevel, format, args...)
+}
+
+// Errorf logs at ErrorLevel.
+func Errorf(format string, args ...interface{}) {
+	output(ErrorLevel, format, args...)
+}
+
+// Fatalf logs whatever the level and exits.
+func Fatalf(format string, args ...interface{}) {
+	logger.Output(2, "[fatal] "+fmt.Sprintf(format, args...))
+	os.Exit(1)
+}
@@ -0,0 +1,37 @@
+package logging
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestLevel(t *testing.T) {
+	var buf bytes.Buffer
+	SetOutput(&buf)
+	defer SetLevel(InfoLevel)
+
+	SetLevel(WarnLevel)
+	Infof("dropped %d", 1)
+	Warnf("kept %d", 2)
+	Errorf("kept %d", 3)
+	out := buf.String()
+	if strings.Contains(out, "dropped") || !strings.Contains(out, "[warn] kept 2") || !strings.Contains(out, "[error] kept 3") {
+		t.Fatalf("unexpected log: %s", out)
+	}
+	if Enabled(DebugLevel) || !Enabled(ErrorLevel) {
+		t.Fatal("expected only warn and error to be enabled")
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	for _, name := range []string{"debug", "info", "warn", "error"} {
+		level, err := ParseLevel(name)
+		if err != nil || level.String() != name {
+			t.Errorf("expected level %s, got %v, %v", name, level, err)
+		}
+	}
+	if _, err := ParseLevel("verbose"); err == nil {
+		t.Error("expected an unknown level to be rejected")
+	}
+}
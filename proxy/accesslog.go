@@ -0,0 +1,102 @@
+package proxy
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// AccessLogEntry is the access log line of a proxied stream, written as one JSON object per line.
+type AccessLogEntry struct {
+	Time             time.Time `json:"time"` //stream开始的时间
+	Method           string    `json:"method"`
+	TaskId           string    `json:"task_id"`
+	PartyId          string    `json:"party_id"`
+	ServiceType      string    `json:"service_type,omitempty"`
+	SourcePartyId    string    `json:"source_party_id,omitempty"`
+	Peer             string    `json:"peer"`                   //调用方的地址
+	PeerSubject      string    `json:"peer_subject,omitempty"` //调用方已校验的证书的subject
+	Backend          string    `json:"backend,omitempty"`      //转发到的task服务或VIA，director拒绝时为空
+	DurationMs       float64   `json:"duration_ms"`
+	RequestMessages  int64     `json:"request_messages"`
+	RequestBytes     int64     `json:"request_bytes"`
+	ResponseMessages int64     `json:"response_messages"`
+	ResponseBytes    int64     `json:"response_bytes"`
+	Code             string    `json:"code"`
+	Error            string    `json:"error,omitempty"`
+}
+
+// WithAccessLog sets the writer the handler writes an AccessLogEntry to when a stream completes, including the
+// calls its director rejects.
+func WithAccessLog(w io.Writer) HandlerOption {
+	return func(h *handler) {
+		h.accessLog = &accessLogger{w: w}
+	}
+}
+
+// accessLogger 串行写入access log，保证每个entry是完整的一行
+type accessLogger struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// log 写入stream的access log，l为nil时不记录
+func (l *accessLogger) log(ctx context.Context, method string, start time.Time, backend string, stats *streamStats, err error) {
+	if l == nil {
+		return
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	entry := AccessLogEntry{
+		Time:             start,
+		Method:           method,
+		TaskId:           first(md, MetadataTaskIdKey),
+		PartyId:          first(md, MetadataPartyIdKey),
+		ServiceType:      first(md, MetadataServiceTypeKey),
+		SourcePartyId:    first(md, MetadataSourcePartyIdKey),
+		Backend:          backend,
+		DurationMs:       float64(time.Since(start).Microseconds()) / 1000,
+		RequestMessages:  atomic.LoadInt64(&stats.requestMessages),
+		RequestBytes:     atomic.LoadInt64(&stats.requestBytes),
+		ResponseMessages: atomic.LoadInt64(&stats.responseMessages),
+		ResponseBytes:    atomic.LoadInt64(&stats.responseBytes),
+		Code:             status.Code(err).String(),
+	}
+	if err != nil {
+		entry.Error = status.Convert(err).Message()
+	}
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		entry.Peer = p.Addr.String()
+	}
+	if subject, _, ok := peerCertificate(ctx); ok {
+		entry.PeerSubject = subject.String()
+	}
+	line, _ := json.Marshal(entry)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.w.Write(append(line, '\n'))
+}
+
+// streamStats 统计一个stream各方向转发的消息数和字节数
+type streamStats struct {
+	requestMessages  int64
+	requestBytes     int64
+	responseMessages int64
+	responseBytes    int64
+}
+
+func (s *streamStats) forwarded(direction string, size int) {
+	if direction == directionRequest {
+		atomic.AddInt64(&s.requestMessages, 1)
+		atomic.AddInt64(&s.requestBytes, int64(size))
+	} else {
+		atomic.AddInt64(&s.responseMessages, 1)
+		atomic.AddInt64(&s.responseBytes, int64(size))
+	}
+}
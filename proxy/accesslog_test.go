@@ -0,0 +1,48 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+)
+
+func TestAccessLog(t *testing.T) {
+	registry := NewMemoryRegistry()
+	registry.Register(&SignupTask{TaskId: "task", PartyId: "partner_1", Address: "echo", Conn: startEcho(t)})
+	var buf bytes.Buffer
+	proxyConn := startServer(t, grpc.NewServer(
+		grpc.ForceServerCodec(Codec()),
+		grpc.UnknownServiceHandler(TransparentHandler(GetDirector(registry), WithAccessLog(&buf))),
+	))
+
+	if _, err := echo(context.Background(), proxyConn, "task", "partner_1", []byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := echo(context.Background(), proxyConn, "task", "partner_2", []byte("ping")); err == nil {
+		t.Fatal("expected the call to the unregistered party to fail")
+	}
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected one access log line per stream, got %q", buf.String())
+	}
+	var ok, rejected AccessLogEntry
+	if err := json.Unmarshal([]byte(lines[0]), &ok); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal([]byte(lines[1]), &rejected); err != nil {
+		t.Fatal(err)
+	}
+	if ok.Method != testMethod || ok.TaskId != "task" || ok.PartyId != "partner_1" || ok.Code != "OK" ||
+		ok.RequestMessages != 1 || ok.RequestBytes != 4 || ok.ResponseMessages != 1 || ok.ResponseBytes != 4 ||
+		len(ok.Peer) == 0 || len(ok.Backend) == 0 || ok.Time.IsZero() {
+		t.Fatalf("unexpected access log entry: %s", lines[0])
+	}
+	if rejected.PartyId != "partner_2" || rejected.Code != "Unknown" || len(rejected.Error) == 0 || len(rejected.Backend) != 0 {
+		t.Fatalf("unexpected access log entry of the rejected call: %s", lines[1])
+	}
+}
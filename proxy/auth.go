@@ -0,0 +1,208 @@
+package proxy
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/tjfoc/gmsm/gmtls/gmcredentials"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// Sources of the identity of a caller. Any other source is the dotted OID of a subject attribute, e.g. 2.5.4.11
+// for the organizational unit.
+const (
+	IdentityCommonName = "cn"      //证书subject的CN
+	IdentitySANURI     = "san_uri" //证书SAN中的URI，可以有多个
+)
+
+// AnyValue matches any identity, party or service type in an AccessRule.
+const AnyValue = "*"
+
+// AccessRule allows the callers with Identity to call the local PartyIds and ServiceTypes. An empty list of
+// PartyIds or ServiceTypes allows any of them.
+type AccessRule struct {
+	Identity     string
+	PartyIds     []string
+	ServiceTypes []string
+}
+
+// Authorizer checks the identity in the verified client certificate of a caller against an allow-list of the
+// parties and service types it may call. The identity is the one of the direct peer: for a call forwarded by a
+// remote VIA, the identity of that VIA.
+type Authorizer struct {
+	source string
+	oid    asn1.ObjectIdentifier
+	rules  []AccessRule
+}
+
+// NewAuthorizer returns an Authorizer reading the identity of callers from source, which is IdentityCommonName,
+// IdentitySANURI or a dotted OID, and allowing the calls matching any of rules.
+func NewAuthorizer(source string, rules []AccessRule) (*Authorizer, error) {
+	a := &Authorizer{source: source, rules: rules}
+	if source != IdentityCommonName && source != IdentitySANURI {
+		oid, err := parseOID(source)
+		if err != nil {
+			return nil, err
+		}
+		a.oid = oid
+	}
+	for _, rule := range rules {
+		if len(rule.Identity) == 0 {
+			return nil, fmt.Errorf("access rule requires an identity")
+		}
+	}
+	return a, nil
+}
+
+func parseOID(s string) (asn1.ObjectIdentifier, error) {
+	parts := strings.Split(s, ".")
+	if len(parts) < 2 {
+		return nil, fmt.Errorf("identity source must be %s, %s or an OID, got %q", IdentityCommonName, IdentitySANURI, s)
+	}
+	oid := make(asn1.ObjectIdentifier, 0, len(parts))
+	for _, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("identity source must be %s, %s or an OID, got %q", IdentityCommonName, IdentitySANURI, s)
+		}
+		oid = append(oid, n)
+	}
+	return oid, nil
+}
+
+// Authorize returns a PermissionDenied error unless the caller of ctx may call the task service of key.
+func (a *Authorizer) Authorize(ctx context.Context, key TaskKey) error {
+	_, err := a.Identity(ctx, &key)
+	return err
+}
+
+// Identity returns the identity of the caller of ctx if a rule allows it to call the task service of key, and a
+// PermissionDenied error otherwise. A nil key matches the rules of any party and service type.
+func (a *Authorizer) Identity(ctx context.Context, key *TaskKey) (string, error) {
+	identities := a.Identities(ctx)
+	if len(identities) == 0 {
+		return "", status.Errorf(codes.PermissionDenied, "cannot get the caller identity from its certificate")
+	}
+	for _, rule := range a.rules {
+		if key != nil && (!matches(rule.PartyIds, key.PartyId) || !matches(rule.ServiceTypes, key.ServiceType)) {
+			continue
+		}
+		if rule.Identity == AnyValue {
+			return identities[0], nil
+		}
+		if contains(identities, rule.Identity) {
+			return rule.Identity, nil
+		}
+	}
+	if key == nil {
+		return "", status.Errorf(codes.PermissionDenied, "%v is not allowed", identities)
+	}
+	return "", status.Errorf(codes.PermissionDenied, "%v is not allowed to call party %s service %s", identities, key.PartyId, key.ServiceType)
+}
+
+// Identities returns the identities of the caller of ctx, read from its verified certificate. It returns nil if
+// the caller didn't present a certificate.
+func (a *Authorizer) Identities(ctx context.Context) []string {
+	subject, uris, ok := peerCertificate(ctx)
+	if !ok {
+		return nil
+	}
+	switch a.source {
+	case IdentityCommonName:
+		if len(subject.CommonName) == 0 {
+			return nil
+		}
+		return []string{subject.CommonName}
+	case IdentitySANURI:
+		return uris
+	default:
+		var identities []string
+		for _, name := range subject.Names {
+			if value, ok := name.Value.(string); ok && name.Type.Equal(a.oid) {
+				identities = append(identities, value)
+			}
+		}
+		return identities
+	}
+}
+
+// peerCertificate 返回对端已校验的证书的subject和SAN URI，支持标准TLS和国密TLS
+func peerCertificate(ctx context.Context) (pkix.Name, []string, bool) {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return pkix.Name{}, nil, false
+	}
+	switch info := p.AuthInfo.(type) {
+	case credentials.TLSInfo:
+		if len(info.State.VerifiedChains) == 0 || len(info.State.PeerCertificates) == 0 {
+			return pkix.Name{}, nil, false
+		}
+		cert := info.State.PeerCertificates[0]
+		return cert.Subject, uriStrings(cert), true
+	case gmcredentials.TLSInfo:
+		if len(info.State.VerifiedChains) == 0 || len(info.State.PeerCertificates) == 0 {
+			return pkix.Name{}, nil, false
+		}
+		cert := info.State.PeerCertificates[0]
+		return cert.Subject, sanURIs(cert.Extensions), true
+	}
+	return pkix.Name{}, nil, false
+}
+
+func uriStrings(cert *x509.Certificate) []string {
+	uris := make([]string, 0, len(cert.URIs))
+	for _, uri := range cert.URIs {
+		uris = append(uris, uri.String())
+	}
+	return uris
+}
+
+var oidSubjectAltName = asn1.ObjectIdentifier{2, 5, 29, 17}
+
+// sanURIs 从SAN扩展中解析URI。gmsm的x509不解析SAN中的URI，标准库又不能解析SM2证书
+func sanURIs(extensions []pkix.Extension) []string {
+	var uris []string
+	for _, ext := range extensions {
+		if !ext.Id.Equal(oidSubjectAltName) {
+			continue
+		}
+		var seq asn1.RawValue
+		if _, err := asn1.Unmarshal(ext.Value, &seq); err != nil {
+			return nil
+		}
+		for rest := seq.Bytes; len(rest) > 0; {
+			var name asn1.RawValue
+			var err error
+			if rest, err = asn1.Unmarshal(rest, &name); err != nil {
+				return uris
+			}
+			// GeneralName中的uniformResourceIdentifier [6] IA5String
+			if name.Class == asn1.ClassContextSpecific && name.Tag == 6 {
+				uris = append(uris, string(name.Bytes))
+			}
+		}
+	}
+	return uris
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// matches 规则中的列表为空或包含AnyValue时匹配任意值
+func matches(allowed []string, value string) bool {
+	return len(allowed) == 0 || contains(allowed, AnyValue) || contains(allowed, value)
+}
@@ -0,0 +1,225 @@
+package proxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"math/big"
+	"net"
+	"net/url"
+	"testing"
+	"via/tlsutil"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+var oidOrganizationalUnit = asn1.ObjectIdentifier{2, 5, 4, 11}
+
+// peerContext returns a context whose peer presented a verified certificate with commonName, uris and the
+// organizational unit ou.
+func peerContext(commonName, ou string, uris ...string) context.Context {
+	cert := &x509.Certificate{Subject: pkix.Name{
+		CommonName: commonName,
+		Names:      []pkix.AttributeTypeAndValue{{Type: oidOrganizationalUnit, Value: ou}},
+	}}
+	for _, uri := range uris {
+		u, _ := url.Parse(uri)
+		cert.URIs = append(cert.URIs, u)
+	}
+	state := tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}, VerifiedChains: [][]*x509.Certificate{{cert}}}
+	return peer.NewContext(context.Background(), &peer.Peer{AuthInfo: credentials.TLSInfo{State: state}})
+}
+
+func TestAuthorizer(t *testing.T) {
+	rules := []AccessRule{
+		{Identity: "partner_2", PartyIds: []string{"partner_1"}, ServiceTypes: []string{"compute"}},
+		{Identity: "partner_3", PartyIds: []string{"*"}},
+	}
+	a, err := NewAuthorizer(IdentityCommonName, rules)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		ctx     context.Context
+		key     TaskKey
+		allowed bool
+	}{
+		{peerContext("partner_2", ""), NewTaskKey("task", "partner_1", "compute"), true},
+		{peerContext("partner_2", ""), NewTaskKey("task", "partner_1", ""), false},
+		{peerContext("partner_2", ""), NewTaskKey("task", "partner_4", "compute"), false},
+		{peerContext("partner_3", ""), NewTaskKey("task", "partner_4", "data"), true},
+		{peerContext("partner_4", ""), NewTaskKey("task", "partner_1", "compute"), false},
+		{context.Background(), NewTaskKey("task", "partner_1", "compute"), false},
+	}
+	for i, c := range cases {
+		err := a.Authorize(c.ctx, c.key)
+		if c.allowed && err != nil {
+			t.Errorf("case %d: expected %v to be allowed, got %v", i, c.key, err)
+		}
+		if !c.allowed && status.Code(err) != codes.PermissionDenied {
+			t.Errorf("case %d: expected %v to be denied, got %v", i, c.key, err)
+		}
+	}
+}
+
+func TestAuthorizerIdentitySources(t *testing.T) {
+	ctx := peerContext("via-2", "partner_2", "spiffe://consortium/partner_2", "spiffe://consortium/via")
+	cases := map[string][]string{
+		IdentityCommonName: {"via-2"},
+		IdentitySANURI:     {"spiffe://consortium/partner_2", "spiffe://consortium/via"},
+		"2.5.4.11":         {"partner_2"},
+	}
+	for source, expected := range cases {
+		a, err := NewAuthorizer(source, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		identities := a.Identities(ctx)
+		if len(identities) != len(expected) {
+			t.Fatalf("%s: expected %v, got %v", source, expected, identities)
+		}
+		for i := range expected {
+			if identities[i] != expected[i] {
+				t.Fatalf("%s: expected %v, got %v", source, expected, identities)
+			}
+		}
+	}
+
+	for _, source := range []string{"common_name", "2.5.x"} {
+		if _, err := NewAuthorizer(source, nil); err == nil {
+			t.Errorf("expected identity source %q to be rejected", source)
+		}
+	}
+}
+
+func TestSANURIs(t *testing.T) {
+	// 用标准库生成SAN扩展，校验sanURIs和标准库的解析结果一致
+	u1, _ := url.Parse("spiffe://consortium/partner_2")
+	u2, _ := url.Parse("https://via.partner_2.example")
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		DNSNames:     []string{"localhost"},
+		URIs:         []*url.URL{u1, u2},
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uris := sanURIs(cert.Extensions)
+	if len(uris) != 2 || uris[0] != u1.String() || uris[1] != u2.String() {
+		t.Fatalf("expected %v, got %v", uriStrings(cert), uris)
+	}
+}
+
+func TestAuthorizerGM(t *testing.T) {
+	options := func(name string) tlsutil.Options {
+		return tlsutil.Options{
+			Mode:            tlsutil.ModeGMTwoWay,
+			SignCertFile:    "../cert/gm_cert/" + name + "_sign.crt",
+			SignKeyFile:     "../cert/gm_cert/" + name + "_sign.key",
+			EncryptCertFile: "../cert/gm_cert/" + name + "_encrypt.crt",
+			EncryptKeyFile:  "../cert/gm_cert/" + name + "_encrypt.key",
+			CaFiles:         []string{"../cert/gm_cert/ca.crt"},
+		}
+	}
+	serverCreds, _, err := tlsutil.NewCredentials(options("server"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, clientCreds, err := tlsutil.NewCredentials(options("client"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serverConn, clientConn := net.Pipe()
+	defer serverConn.Close()
+	defer clientConn.Close()
+	go clientCreds.ClientHandshake(context.Background(), "127.0.0.1:10031", clientConn)
+	_, authInfo, err := serverCreds.ServerHandshake(serverConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := NewAuthorizer(IdentityCommonName, []AccessRule{{Identity: "client"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := peer.NewContext(context.Background(), &peer.Peer{AuthInfo: authInfo})
+	if err := a.Authorize(ctx, NewTaskKey("task", "partner_1", "")); err != nil {
+		t.Fatalf("expected the gm client certificate to be allowed, got %v", err)
+	}
+}
+
+func TestDirectorPermissionDenied(t *testing.T) {
+	registry := NewMemoryRegistry()
+	task := &SignupTask{TaskId: "task", PartyId: "partner_1", Address: "backend"}
+	if _, err := registry.Register(task); err != nil {
+		t.Fatal(err)
+	}
+	a, err := NewAuthorizer(IdentityCommonName, []AccessRule{{Identity: "partner_2", PartyIds: []string{"partner_1"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	director := GetDirector(registry, WithAuthorizer(a))
+	md := metadata.Pairs(MetadataTaskIdKey, "task", MetadataPartyIdKey, "partner_1")
+
+	ctx := metadata.NewIncomingContext(peerContext("partner_3", ""), md)
+	if _, _, err := director(ctx, testMethod); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("expected PermissionDenied, got %v", err)
+	}
+	if task.ActiveStreams() != 0 {
+		t.Fatal("expected the denied call not to reach the task")
+	}
+
+	ctx, cancel := context.WithCancel(metadata.NewIncomingContext(peerContext("partner_2", ""), md))
+	defer cancel()
+	if _, _, err := director(ctx, testMethod); err != nil {
+		t.Fatalf("expected the call to be allowed, got %v", err)
+	}
+	if task.ActiveStreams() != 1 {
+		t.Fatal("expected the allowed call to be forwarded to the task")
+	}
+}
+
+func TestDirectorAuthorizesLocalCalls(t *testing.T) {
+	a, err := NewAuthorizer(IdentityCommonName, []AccessRule{{Identity: "partner_2", PartyIds: []string{"partner_1"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	routes := mustRouteTable(t, []Route{{PartyIdPrefix: "remote_", Address: "via2"}}, 0)
+	director := GetDirector(NewMemoryRegistry(), WithRoutes(routes), WithAuthorizer(a))
+	call := func(partyId string) error {
+		ctx, cancel := context.WithCancel(metadata.NewIncomingContext(peerContext("partner_3", ""),
+			metadata.Pairs(MetadataTaskIdKey, "task", MetadataPartyIdKey, partyId)))
+		defer cancel()
+		_, _, err := director(ctx, testMethod)
+		return err
+	}
+
+	// 转发给下一跳VIA的调用由下一跳校验，本VIA的白名单只用于本地task服务
+	if err := call("remote_1"); err != nil {
+		t.Fatalf("expected the routed call not to be checked against the rules of the local tasks, got %v", err)
+	}
+	// 没有路由的参与方是本地参与方，未注册时也先校验权限
+	if err := call("partner_9"); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("expected PermissionDenied for a local party, got %v", err)
+	}
+}
@@ -0,0 +1,118 @@
+package proxy
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sync"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/metadata"
+)
+
+// Balancer picks the instance of a registered task service that a proxied stream is forwarded to.
+//
+// Pick is called for every stream with the instances currently registered under key, never with an empty list,
+// and must be safe for concurrent use.
+type Balancer interface {
+	Pick(ctx context.Context, key TaskKey, instances []*SignupTask) *SignupTask
+}
+
+const (
+	BalancerRoundRobin     = "round_robin"
+	BalancerLeastActive    = "least_active"
+	BalancerConsistentHash = "consistent_hash"
+)
+
+// NewBalancer returns the balancer registered under name. hashKey is the metadata key hashed by the
+// consistent_hash balancer.
+func NewBalancer(name string, hashKey string) (Balancer, error) {
+	switch name {
+	case "", BalancerRoundRobin:
+		return RoundRobin(), nil
+	case BalancerLeastActive:
+		return LeastActiveStreams(), nil
+	case BalancerConsistentHash:
+		if hashKey == "" {
+			return nil, fmt.Errorf("balancer %s requires a metadata key to hash", name)
+		}
+		return ConsistentHash(hashKey), nil
+	default:
+		return nil, fmt.Errorf("unknown balancer: %s", name)
+	}
+}
+
+// 轮询计数器最多保存的key数量，超过后清空重新计数，避免任务不断结束后计数器无限增长
+const maxRoundRobinKeys = 10000
+
+type roundRobin struct {
+	mu   sync.Mutex
+	next map[TaskKey]uint64
+}
+
+// RoundRobin returns a Balancer that forwards the streams of a key to its instances in turn.
+func RoundRobin() Balancer {
+	return &roundRobin{next: make(map[TaskKey]uint64)}
+}
+
+func (b *roundRobin) Pick(ctx context.Context, key TaskKey, instances []*SignupTask) *SignupTask {
+	b.mu.Lock()
+	if len(b.next) >= maxRoundRobinKeys {
+		b.next = make(map[TaskKey]uint64)
+	}
+	n := b.next[key]
+	b.next[key] = n + 1
+	b.mu.Unlock()
+	return instances[n%uint64(len(instances))]
+}
+
+type leastActiveStreams struct{}
+
+// LeastActiveStreams returns a Balancer that forwards a stream to the instance with the fewest streams in flight,
+// preferring the earliest registered instance on a tie.
+func LeastActiveStreams() Balancer {
+	return leastActiveStreams{}
+}
+
+func (leastActiveStreams) Pick(ctx context.Context, key TaskKey, instances []*SignupTask) *SignupTask {
+	picked, least := instances[0], instances[0].ActiveStreams()
+	for _, instance := range instances[1:] {
+		if active := instance.ActiveStreams(); active < least {
+			picked, least = instance, active
+		}
+	}
+	return picked
+}
+
+type consistentHash struct {
+	metadataKey string
+	fallback    Balancer
+}
+
+// ConsistentHash returns a Balancer that forwards all streams carrying the same value of the metadataKey
+// metadata to the same instance. Adding or removing an instance only moves the values that hashed to it.
+// Streams without the metadata are balanced round-robin.
+func ConsistentHash(metadataKey string) Balancer {
+	return &consistentHash{metadataKey: metadataKey, fallback: RoundRobin()}
+}
+
+// Pick 使用rendezvous hashing：每个实例按hash(value, address)打分，选分数最高的实例
+func (b *consistentHash) Pick(ctx context.Context, key TaskKey, instances []*SignupTask) *SignupTask {
+	md, _ := metadata.FromIncomingContext(ctx)
+	values := md.Get(b.metadataKey)
+	if len(values) == 0 {
+		return b.fallback.Pick(ctx, key, instances)
+	}
+
+	var picked *SignupTask
+	var highest uint64
+	for _, instance := range instances {
+		h := fnv.New64a()
+		h.Write([]byte(values[0]))
+		h.Write([]byte{0})
+		h.Write([]byte(instance.Address))
+		if score := h.Sum64(); picked == nil || score > highest {
+			picked, highest = instance, score
+		}
+	}
+	return picked
+}
@@ -0,0 +1,99 @@
+package proxy
+
+import (
+	"fmt"
+	"testing"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/metadata"
+)
+
+func testInstances(n int) []*SignupTask {
+	instances := make([]*SignupTask, n)
+	for i := range instances {
+		instances[i] = &SignupTask{TaskId: "task", PartyId: "party", Address: fmt.Sprintf("address_%d", i)}
+	}
+	return instances
+}
+
+func TestRoundRobin(t *testing.T) {
+	b := RoundRobin()
+	key := NewTaskKey("task", "party", "")
+	other := NewTaskKey("task", "other", "")
+	instances := testInstances(3)
+
+	for i := 0; i < 6; i++ {
+		// 其他key的选择不影响本key的轮询
+		b.Pick(context.Background(), other, instances)
+		if picked := b.Pick(context.Background(), key, instances); picked != instances[i%3] {
+			t.Fatalf("pick %d: expected %s, got %s", i, instances[i%3].Address, picked.Address)
+		}
+	}
+}
+
+func TestLeastActiveStreams(t *testing.T) {
+	b := LeastActiveStreams()
+	key := NewTaskKey("task", "party", "")
+	instances := testInstances(3)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	instances[0].track(ctx)
+	instances[1].track(ctx)
+	instances[1].track(ctx)
+
+	if picked := b.Pick(context.Background(), key, instances); picked != instances[2] {
+		t.Fatalf("expected the idle instance, got %s", picked.Address)
+	}
+	instances[2].track(ctx)
+	if picked := b.Pick(context.Background(), key, instances); picked != instances[0] {
+		t.Fatalf("expected the first least active instance, got %s", picked.Address)
+	}
+}
+
+func TestConsistentHash(t *testing.T) {
+	b := ConsistentHash("session_id")
+	key := NewTaskKey("task", "party", "")
+	instances := testInstances(5)
+
+	picks := make(map[string]*SignupTask)
+	for i := 0; i < 100; i++ {
+		session := fmt.Sprintf("session_%d", i)
+		ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("session_id", session))
+		picked := b.Pick(ctx, key, instances)
+		if again := b.Pick(ctx, key, instances); again != picked {
+			t.Fatalf("expected %s to stick to %s, got %s", session, picked.Address, again.Address)
+		}
+		picks[session] = picked
+	}
+
+	// 删除一个实例，只有原来落在此实例上的session会换实例
+	removed := instances[2]
+	remaining := append(append([]*SignupTask(nil), instances[:2]...), instances[3:]...)
+	for session, picked := range picks {
+		ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("session_id", session))
+		again := b.Pick(ctx, key, remaining)
+		if picked != removed && again != picked {
+			t.Fatalf("expected %s to stay on %s, got %s", session, picked.Address, again.Address)
+		}
+	}
+
+	// 没有metadata时退化为轮询
+	if first, second := b.Pick(context.Background(), key, instances), b.Pick(context.Background(), key, instances); first == second {
+		t.Fatal("expected streams without the metadata to be balanced round-robin")
+	}
+}
+
+func TestNewBalancer(t *testing.T) {
+	for _, name := range []string{"", BalancerRoundRobin, BalancerLeastActive} {
+		if _, err := NewBalancer(name, ""); err != nil {
+			t.Errorf("balancer %q: %v", name, err)
+		}
+	}
+	if _, err := NewBalancer(BalancerConsistentHash, ""); err == nil {
+		t.Error("expected consistent_hash without a metadata key to fail")
+	}
+	if _, err := NewBalancer("random", ""); err == nil {
+		t.Error("expected an unknown balancer to fail")
+	}
+}
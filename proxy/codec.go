@@ -3,8 +3,8 @@ package proxy
 import (
 	"fmt"
 	"google.golang.org/grpc/encoding"
-	"log"
 	"reflect"
+	"via/logging"
 
 	"github.com/golang/protobuf/proto"
 )
@@ -79,12 +79,16 @@ func (c *rawCodec) Name() string {
 type protoCodec struct{}
 
 func (protoCodec) Marshal(v interface{}) ([]byte, error) {
-	log.Printf("protoCodec.Marshal: v:%v", reflect.TypeOf(v))
+	if logging.Enabled(logging.DebugLevel) {
+		logging.Debugf("protoCodec.Marshal: v:%v", reflect.TypeOf(v))
+	}
 	return proto.Marshal(v.(proto.Message))
 }
 
 func (protoCodec) Unmarshal(data []byte, v interface{}) error {
-	log.Printf("protoCodec.Unmarshal: data:%v, v:%v", data, reflect.TypeOf(v))
+	if logging.Enabled(logging.DebugLevel) {
+		logging.Debugf("protoCodec.Unmarshal: %d bytes, v:%v", len(data), reflect.TypeOf(v))
+	}
 	return proto.Unmarshal(data, v.(proto.Message))
 }
 
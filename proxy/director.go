@@ -1,6 +1,8 @@
 package proxy
 
 import (
+	"strconv"
+
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
@@ -23,48 +25,176 @@ import (
 // See the rather rich example.
 type StreamDirector func(ctx context.Context, fullMethodName string) (context.Context, *grpc.ClientConn, error)
 
-//任务的服务信息
-type SignupTask struct {
-	TaskId      string           //任务id
-	PartyId     string           //任务参与方唯一id
-	ServiceType string           //任务服务类型
-	Address     string           //任务服务地址,ip:port
-	Conn        *grpc.ClientConn //proxy到任务服务的grpc调用连接，此链接在任务服务到proxy注册后，由proxy建立
+const MetadataTaskIdKey = "task_id"
+const MetadataPartyIdKey = "party_id"
+
+// 可选，缺省时转发到DefaultServiceType的任务服务
+const MetadataServiceTypeKey = "service_type"
+
+type directorOptions struct {
+	balancer   Balancer
+	routes     *RouteTable
+	authorizer *Authorizer
+	forwarder  *Forwarder
 }
 
-// 存放注册的任务服务进程信息
-var RegisteredTaskMap = make(map[string]*SignupTask)
+// DirectorOption configures the director returned by GetDirector.
+type DirectorOption func(*directorOptions)
 
-const MetadataTaskIdKey = "task_id"
-const MetadataPartyIdKey = "party_id"
+// WithBalancer sets the Balancer picking among the instances of a registered task. Defaults to RoundRobin.
+func WithBalancer(balancer Balancer) DirectorOption {
+	return func(o *directorOptions) {
+		o.balancer = balancer
+	}
+}
+
+// WithRoutes sets the RouteTable used to forward the calls to parties that aren't registered locally to the
+// next VIA hop.
+func WithRoutes(routes *RouteTable) DirectorOption {
+	return func(o *directorOptions) {
+		o.routes = routes
+	}
+}
+
+// WithAuthorizer sets the Authorizer checking that the caller may call the party and service type of the call,
+// before the call is forwarded to a local task service. The calls routed to another VIA are not checked: the next
+// VIA checks them against the identity of this one. By default every caller may call any task.
+func WithAuthorizer(authorizer *Authorizer) DirectorOption {
+	return func(o *directorOptions) {
+		o.authorizer = authorizer
+	}
+}
+
+// GetDirector returns a StreamDirector that forwards calls to the task registered in registry under the
+// task_id/party_id/service_type carried in the incoming metadata, or, if the party isn't registered locally, to
+// the remote VIA its route points to.
+func GetDirector(registry Registry, opts ...DirectorOption) StreamDirector {
+	options := &directorOptions{balancer: RoundRobin()}
+	for _, opt := range opts {
+		opt(options)
+	}
 
-func GetDirector() StreamDirector {
 	director := func(ctx context.Context, fullName string) (context.Context, *grpc.ClientConn, error) {
 		md, ok := metadata.FromIncomingContext(ctx)
 		// log.Printf("收到的metadata: %v", md)
 		if ok {
 			if taskId, exists := md[MetadataTaskIdKey]; exists {
 				if partyId, exists := md[MetadataPartyIdKey]; exists {
-					key := taskId[0] + "_" + partyId[0]
-					if _, ok := RegisteredTaskMap[key]; ok {
-						outCtx, _ := context.WithCancel(ctx)
-
-						// Explicitly copy the metadata, otherwise the tests will fail.
-						outCtx = metadata.NewOutgoingContext(outCtx, md.Copy())
-						return outCtx, RegisteredTaskMap[key].Conn, nil
-					} else {
-						return ctx, nil, status.Errorf(codes.Unknown, "cannot find connection for registered task")
+					var serviceType string
+					if values := md.Get(MetadataServiceTypeKey); len(values) > 0 {
+						serviceType = values[0]
+					}
+					key := NewTaskKey(taskId[0], partyId[0], serviceType)
+					// Explicitly copy the metadata, otherwise the tests will fail.
+					outMd := md.Copy()
+					if options.forwarder != nil {
+						if err := options.forwarder.forward(ctx, outMd); err != nil {
+							return ctx, nil, err
+						}
+					}
+					instances := registry.Lookup(key)
+					// 参与方不在本地，转发给下一跳VIA
+					if len(instances) == 0 && options.routes != nil {
+						if address, ok := options.routes.Resolve(key.PartyId); ok {
+							// 路由指向本VIA时，参与方本应注册在本VIA，转发给自己只会循环到超过最大跳数
+							if options.routes.IsLocal(address) {
+								return ctx, nil, reject("route_to_self", codes.FailedPrecondition, "party %s routes to this VIA at %s but isn't registered", key.PartyId, address)
+							}
+							return forwardToVIA(ctx, outMd, options.routes, address)
+						}
+					}
+					// 在打开到本地task服务的stream之前校验调用方的证书身份，转发给下一跳VIA的调用由下一跳按本VIA的证书校验。
+					// 未注册的参与方也先校验，不向没有权限的调用方透露参与方是否注册
+					if options.authorizer != nil {
+						if err := options.authorizer.Authorize(ctx, key); err != nil {
+							return ctx, nil, &rejection{reason: "permission_denied", status: status.Convert(err)}
+						}
+					}
+					if len(instances) == 0 {
+						return ctx, nil, reject("task_not_found", codes.Unknown, "cannot find connection for registered task")
+					}
+					// 跳过健康检查失败的实例
+					if instances = healthyInstances(instances); len(instances) == 0 {
+						return ctx, nil, reject("task_unhealthy", codes.Unavailable, "all instances of task %s of party %s failed their health check", key.TaskId, key.PartyId)
+					}
+					task := options.balancer.Pick(ctx, key, instances)
+					// 登记到任务上，任务注销时可以取消此stream
+					outCtx, ok := task.track(ctx)
+					if !ok {
+						return ctx, nil, reject("task_closing", codes.Unavailable, "registered task is closing")
 					}
+
+					outCtx = metadata.NewOutgoingContext(outCtx, outMd)
+					return outCtx, task.Conn, nil
 				} else {
-					return ctx, nil, status.Errorf(codes.NotFound, "party id not found")
+					return ctx, nil, reject("party_id_missing", codes.NotFound, "party id not found")
 				}
 
 			} else {
-				return ctx, nil, status.Errorf(codes.NotFound, "task id not found")
+				return ctx, nil, reject("task_id_missing", codes.NotFound, "task id not found")
 			}
 		} else {
-			return ctx, nil, status.Errorf(codes.Unknown, "cannot get metadata from incoming context")
+			return ctx, nil, reject("metadata_missing", codes.Unknown, "cannot get metadata from incoming context")
 		}
 	}
 	return director
 }
+
+// healthyInstances 返回未被健康检查标记为HealthNotServing的实例，全部正常时返回instances本身
+func healthyInstances(instances []*SignupTask) []*SignupTask {
+	for i, instance := range instances {
+		if instance.Health() != HealthNotServing {
+			continue
+		}
+		healthy := append([]*SignupTask(nil), instances[:i]...)
+		for _, instance := range instances[i+1:] {
+			if instance.Health() != HealthNotServing {
+				healthy = append(healthy, instance)
+			}
+		}
+		return healthy
+	}
+	return instances
+}
+
+// forwardToVIA returns the outgoing context and connection forwarding a call with the outgoing metadata md to the
+// remote VIA at address.
+func forwardToVIA(ctx context.Context, md metadata.MD, routes *RouteTable, address string) (context.Context, *grpc.ClientConn, error) {
+	hops := 0
+	if values := md.Get(MetadataHopCountKey); len(values) > 0 {
+		var err error
+		if hops, err = strconv.Atoi(values[0]); err != nil || hops < 0 {
+			return ctx, nil, reject("invalid_hop_count", codes.InvalidArgument, "invalid %s: %s", MetadataHopCountKey, values[0])
+		}
+	}
+	if hops >= routes.MaxHops() {
+		return ctx, nil, reject("max_hops_exceeded", codes.FailedPrecondition, "call exceeded %d VIA hops, check the routes for a loop", routes.MaxHops())
+	}
+
+	conn, err := routes.Conn(address)
+	if err != nil {
+		return ctx, nil, reject("via_unavailable", codes.Unavailable, "cannot connect to VIA %s: %v", address, err)
+	}
+
+	md.Set(MetadataHopCountKey, strconv.Itoa(hops+1))
+	return metadata.NewOutgoingContext(ctx, md), conn, nil
+}
+
+// rejection 是director拒绝转发调用的错误，reason是Metrics统计的拒绝原因
+type rejection struct {
+	reason string
+	status *status.Status
+}
+
+func reject(reason string, c codes.Code, format string, a ...interface{}) error {
+	return &rejection{reason: reason, status: status.Newf(c, format, a...)}
+}
+
+func (r *rejection) Error() string {
+	return r.status.Err().Error()
+}
+
+// GRPCStatus 使status.Code等函数和gRPC服务端按status处理rejection
+func (r *rejection) GRPCStatus() *status.Status {
+	return r.status
+}
@@ -0,0 +1,160 @@
+package proxy
+
+import (
+	"net/url"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+// Metadata recording the VIAs a call was forwarded through. MetadataForwardedHopsKey lists one entry per VIA,
+// from the first to the last, with the caller the VIA received the call from ("for") and the name of the VIA
+// ("by"), e.g. "by=via-2&for=partner_2-task". MetadataForwardedForKey is the caller of the first hop, i.e. the
+// origin of the call, and MetadataForwardedByKey the VIA of the last hop.
+const (
+	MetadataForwardedForKey  = "via-forwarded-for"
+	MetadataForwardedByKey   = "via-forwarded-by"
+	MetadataForwardedHopsKey = "via-forwarded-hops"
+)
+
+// Hop is a VIA a call was forwarded through.
+type Hop struct {
+	For string //VIA收到调用时的调用方：证书身份，没有证书时为地址
+	By  string //VIA的名字
+}
+
+func (h Hop) String() string {
+	return url.Values{"for": {h.For}, "by": {h.By}}.Encode()
+}
+
+func parseHop(s string) (Hop, bool) {
+	values, err := url.ParseQuery(s)
+	if err != nil || len(values) != 2 || len(values["for"]) != 1 || len(values["by"]) != 1 {
+		return Hop{}, false
+	}
+	return Hop{For: values.Get("for"), By: values.Get("by")}, true
+}
+
+// Origin is where a call forwarded by VIA came from.
+type Origin struct {
+	For  string //最初的调用方
+	By   string //最后一跳VIA
+	Hops []Hop  //经过的VIA，从第一跳到最后一跳
+}
+
+// ForwardedOrigin returns the origin of the incoming call of ctx recorded by the VIAs that forwarded it. A task
+// service only reachable through its VIA can trust it: each VIA drops the forwarding metadata of callers it
+// doesn't trust and records the caller it verified itself.
+func ForwardedOrigin(ctx context.Context) (Origin, bool) {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return Origin{}, false
+	}
+	hops, ok := parseHops(md)
+	if !ok || len(hops) == 0 {
+		return Origin{}, false
+	}
+	return Origin{For: hops[0].For, By: hops[len(hops)-1].By, Hops: hops}, true
+}
+
+// parseHops 解析并校验metadata中的转发记录，via-forwarded-for和via-forwarded-by必须和hop列表一致
+func parseHops(md metadata.MD) ([]Hop, bool) {
+	values := md.Get(MetadataForwardedHopsKey)
+	hops := make([]Hop, 0, len(values))
+	for _, value := range values {
+		hop, ok := parseHop(value)
+		if !ok {
+			return nil, false
+		}
+		hops = append(hops, hop)
+	}
+	forwardedFor, forwardedBy := md.Get(MetadataForwardedForKey), md.Get(MetadataForwardedByKey)
+	if len(hops) == 0 {
+		return nil, len(forwardedFor) == 0 && len(forwardedBy) == 0
+	}
+	if len(forwardedFor) != 1 || forwardedFor[0] != hops[0].For || len(forwardedBy) != 1 || forwardedBy[0] != hops[len(hops)-1].By {
+		return nil, false
+	}
+	return hops, true
+}
+
+// Forwarder records the hop of a VIA in the forwarding metadata of the calls it forwards. The forwarding
+// metadata of a caller is only kept if its identity is one of the trusted peers, i.e. a remote VIA; it is
+// dropped for any other caller, so a task service can't spoof the origin of its calls.
+type Forwarder struct {
+	name       string
+	identities *Authorizer //只用来读取调用方证书中的身份
+	trusted    []string
+}
+
+// NewForwarder returns a Forwarder recording name as the VIA of its hops, which reads the identity of callers
+// from identitySource, see NewAuthorizer, and trusts the forwarding metadata of the callers with trustedPeers.
+func NewForwarder(name, identitySource string, trustedPeers []string) (*Forwarder, error) {
+	identities, err := NewAuthorizer(identitySource, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &Forwarder{name: name, identities: identities, trusted: trustedPeers}, nil
+}
+
+// WithForwarder sets the Forwarder recording the hop of this VIA in the outgoing metadata of the calls. Without
+// it the forwarding metadata is passed on unchanged.
+func WithForwarder(forwarder *Forwarder) DirectorOption {
+	return func(o *directorOptions) {
+		o.forwarder = forwarder
+	}
+}
+
+// forward 把本VIA的一跳追加到outgoing metadata中，不可信的调用方带来的转发记录被丢弃，可信的调用方的转发记录不一致时拒绝调用
+func (f *Forwarder) forward(ctx context.Context, md metadata.MD) error {
+	caller, trusted := f.caller(ctx)
+	var hops []Hop
+	if trusted {
+		var ok bool
+		if hops, ok = parseHops(md); !ok {
+			return reject("invalid_forwarded", codes.InvalidArgument, "invalid %s", MetadataForwardedHopsKey)
+		}
+	}
+	hops = append(hops, Hop{For: caller, By: f.name})
+
+	entries := make([]string, 0, len(hops))
+	for _, hop := range hops {
+		entries = append(entries, hop.String())
+	}
+	md.Set(MetadataForwardedHopsKey, entries...)
+	md.Set(MetadataForwardedForKey, hops[0].For)
+	md.Set(MetadataForwardedByKey, f.name)
+	return nil
+}
+
+// origin 返回调用的最初调用方：可信的VIA转发来的调用取转发记录中的第一个调用方，否则是直接调用方的证书身份或地址。
+// 不可信的调用方带来的转发记录不被使用
+func (f *Forwarder) origin(ctx context.Context) string {
+	caller, trusted := f.caller(ctx)
+	if trusted {
+		md, _ := metadata.FromIncomingContext(ctx)
+		if hops, ok := parseHops(md); ok && len(hops) > 0 {
+			return hops[0].For
+		}
+	}
+	return caller
+}
+
+// caller 返回调用方的证书身份，没有证书时返回其地址，以及是否信任调用方带来的转发记录
+func (f *Forwarder) caller(ctx context.Context) (string, bool) {
+	identities := f.identities.Identities(ctx)
+	for _, identity := range identities {
+		if contains(f.trusted, identity) {
+			return identity, true
+		}
+	}
+	if len(identities) > 0 {
+		return identities[0], false
+	}
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		return p.Addr.String(), false
+	}
+	return "", false
+}
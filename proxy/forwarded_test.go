@@ -0,0 +1,88 @@
+package proxy
+
+import (
+	"testing"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestForwarder(t *testing.T) {
+	f, err := NewForwarder("via-2", IdentityCommonName, []string{"via-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 不可信的调用方伪造的转发记录被丢弃
+	md := metadata.Pairs(MetadataForwardedForKey, "partner_3", MetadataForwardedByKey, "via-3",
+		MetadataForwardedHopsKey, Hop{For: "partner_3", By: "via-3"}.String())
+	if err := f.forward(peerContext("partner_2-task", ""), md); err != nil {
+		t.Fatal(err)
+	}
+	origin, ok := ForwardedOrigin(metadata.NewIncomingContext(context.Background(), md))
+	if !ok || origin.For != "partner_2-task" || origin.By != "via-2" || len(origin.Hops) != 1 {
+		t.Fatalf("expected the spoofed hops to be dropped, got %+v", origin)
+	}
+
+	// 可信的VIA的转发记录被保留，追加本VIA的一跳
+	f1, err := NewForwarder("via-1", IdentityCommonName, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	md = metadata.MD{}
+	if err := f1.forward(peerContext("partner_1-task", ""), md); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.forward(peerContext("via-1", ""), md); err != nil {
+		t.Fatal(err)
+	}
+	origin, ok = ForwardedOrigin(metadata.NewIncomingContext(context.Background(), md))
+	expected := []Hop{{For: "partner_1-task", By: "via-1"}, {For: "via-1", By: "via-2"}}
+	if !ok || origin.For != "partner_1-task" || origin.By != "via-2" || len(origin.Hops) != 2 ||
+		origin.Hops[0] != expected[0] || origin.Hops[1] != expected[1] {
+		t.Fatalf("expected the hops %v, got %+v", expected, origin)
+	}
+
+	// 可信的VIA带来不一致的转发记录时拒绝调用
+	md.Set(MetadataForwardedForKey, "partner_3")
+	if err := f.forward(peerContext("via-1", ""), md); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expected the inconsistent hops to be rejected, got %v", err)
+	}
+}
+
+func TestForwardedOriginMissing(t *testing.T) {
+	if _, ok := ForwardedOrigin(context.Background()); ok {
+		t.Fatal("expected no origin without metadata")
+	}
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(MetadataForwardedHopsKey, "by=via-1"))
+	if _, ok := ForwardedOrigin(ctx); ok {
+		t.Fatal("expected no origin from a malformed hop")
+	}
+}
+
+func TestDirectorForwarder(t *testing.T) {
+	registry := NewMemoryRegistry()
+	registry.Register(&SignupTask{TaskId: "task", PartyId: "partner_1", Address: "backend"})
+	f, err := NewForwarder("via-1", IdentityCommonName, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	director := GetDirector(registry, WithForwarder(f))
+
+	md := metadata.Pairs(MetadataTaskIdKey, "task", MetadataPartyIdKey, "partner_1")
+	ctx, cancel := context.WithCancel(metadata.NewIncomingContext(peerContext("partner_2", ""), md))
+	defer cancel()
+	outCtx, _, err := director(ctx, testMethod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	outMd, _ := metadata.FromOutgoingContext(outCtx)
+	if first(outMd, MetadataForwardedForKey) != "partner_2" || first(outMd, MetadataForwardedByKey) != "via-1" {
+		t.Fatalf("expected the forwarding metadata of via-1, got %v", outMd)
+	}
+	if len(md.Get(MetadataForwardedByKey)) != 0 {
+		t.Fatal("expected the incoming metadata to be left unchanged")
+	}
+}
@@ -1,11 +1,14 @@
 package proxy
 
 import (
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
 	"io"
+	"time"
 )
 
 var (
@@ -20,7 +23,7 @@ var (
 //
 // This can *only* be used if the `server` also uses grpcproxy.CodecForServer() ServerOption.
 func RegisterService(server *grpc.Server, director StreamDirector, serviceName string, methodNames ...string) {
-	streamer := &handler{director}
+	streamer := &handler{director: director, interceptor: BaseFrameInterceptor{}}
 	fakeDesc := &grpc.ServiceDesc{
 		ServiceName: serviceName,
 		HandlerType: (*interface{})(nil),
@@ -42,32 +45,89 @@ func RegisterService(server *grpc.Server, director StreamDirector, serviceName s
 // backends. It should be used as a `grpc.UnknownServiceHandler`.
 //
 // This can *only* be used if the `server` also uses grpcproxy.CodecForServer() ServerOption.
-func TransparentHandler(director StreamDirector) grpc.StreamHandler {
-	streamer := &handler{director}
+func TransparentHandler(director StreamDirector, opts ...HandlerOption) grpc.StreamHandler {
+	streamer := &handler{director: director, interceptor: BaseFrameInterceptor{}}
+	for _, opt := range opts {
+		opt(streamer)
+	}
+	if streamer.limiter != nil {
+		streamer.interceptor = chain{streamer.limiter, streamer.interceptor}
+	}
 	return streamer.handler
 }
 
+// HandlerOption configures the handler returned by TransparentHandler.
+type HandlerOption func(*handler)
+
+// WithMetrics sets the Metrics collecting the streams the handler proxies and the calls its director rejects.
+func WithMetrics(metrics *Metrics) HandlerOption {
+	return func(h *handler) {
+		h.metrics = metrics
+	}
+}
+
 type handler struct {
-	director StreamDirector
+	director  StreamDirector
+	metrics   *Metrics      //为nil时不统计
+	tracer    trace.Tracer  //为nil时不记录span
+	accessLog *accessLogger //为nil时不记录access log
+	//WithFrameInterceptors设置的拦截器链，默认不拦截
+	interceptor FrameInterceptor
+	limiter     *Limiter //在拦截器链之前调用，为nil时不限制
 }
 
 // handler is where the real magic of proxying happens.
 // It is invoked like any gRPC server stream and uses the gRPC server framing to get and receive bytes from the wire,
 // forwarding it to a ClientStream established against the relevant ClientConn.
-func (s *handler) handler(srv interface{}, serverStream grpc.ServerStream) error {
+func (s *handler) handler(srv interface{}, serverStream grpc.ServerStream) (err error) {
 	// little bit of gRPC internals never hurt anyone
 	fullMethodName, ok := grpc.MethodFromServerStream(serverStream)
 	if !ok {
 		return status.Errorf(codes.Internal, "lowLevelServerStream not exists in context")
 	}
+	start, stats := time.Now(), &streamStats{}
+	var backend string
+	defer func() {
+		s.accessLog.log(serverStream.Context(), fullMethodName, start, backend, stats, err)
+	}()
+	// 被director拒绝的调用也记录span，便于跨参与方排查
+	ctx, span := startSpan(s.tracer, serverStream.Context(), fullMethodName)
+	defer func() {
+		span.finish(err, stats)
+	}()
 	// We require that the director's returned context inherits from the serverStream.Context().
-	outgoingCtx, backendConn, err := s.director(serverStream.Context(), fullMethodName)
+	outgoingCtx, backendConn, err := s.director(ctx, fullMethodName)
 	if err != nil {
+		s.metrics.reject(serverStream.Context(), fullMethodName, err)
+		return err
+	}
+	backend = backendConn.Target()
+	outgoingCtx = span.inject(outgoingCtx, backend)
+	stream := s.metrics.startStream(serverStream.Context(), fullMethodName)
+	defer func() {
+		stream.finish(err)
+	}()
+	forwarded := func(direction string, size int) {
+		stream.forwarded(direction, size)
+		stats.forwarded(direction, size)
+	}
+
+	md, _ := metadata.FromIncomingContext(serverStream.Context())
+	info := &StreamInfo{
+		Context: serverStream.Context(),
+		Method:  fullMethodName,
+		Key:     NewTaskKey(first(md, MetadataTaskIdKey), first(md, MetadataPartyIdKey), first(md, MetadataServiceTypeKey)),
+		Backend: backend,
+	}
+	if err := s.interceptor.OpenStream(info); err != nil {
 		return err
 	}
+	defer func() {
+		s.interceptor.CloseStream(info, err)
+	}()
 
 	clientCtx, clientCancel := context.WithCancel(outgoingCtx)
-	// TODO(mwitkow): Add a `forwarded` header to metadata, https://en.wikipedia.org/wiki/X-Forwarded-For.
+	// 转发记录(via-forwarded-*)由director的Forwarder写入outgoing metadata
 	clientStream, err := grpc.NewClientStream(clientCtx, clientStreamDescForProxying, backendConn, fullMethodName)
 	if err != nil {
 		return err
@@ -75,8 +135,8 @@ func (s *handler) handler(srv interface{}, serverStream grpc.ServerStream) error
 	// Explicitly *do not close* s2cErrChan and c2sErrChan, otherwise the select below will not terminate.
 	// Channels do not have to be closed, it is just a control flow mechanism, see
 	// https://groups.google.com/forum/#!msg/golang-nuts/pZwdYRGxCIk/qpbHxRRPJdUJ
-	s2cErrChan := s.forwardServerToClient(serverStream, clientStream)
-	c2sErrChan := s.forwardClientToServer(clientStream, serverStream)
+	s2cErrChan := s.forwardServerToClient(info, serverStream, clientStream, forwarded)
+	c2sErrChan := s.forwardClientToServer(info, clientStream, serverStream, forwarded)
 	// We don't know which side is going to stop sending first, so we need a select between the two.
 	for i := 0; i < 2; i++ {
 		select {
@@ -91,13 +151,22 @@ func (s *handler) handler(srv interface{}, serverStream grpc.ServerStream) error
 				// to cancel the clientStream to the backend, let all of its goroutines be freed up by the CancelFunc and
 				// exit with an error to the stack
 				clientCancel()
+				if ie, ok := s2cErr.(*interceptorError); ok {
+					return ie.err
+				}
 				return status.Errorf(codes.Internal, "failed proxying s2c: %v", s2cErr)
 			}
 		case c2sErr := <-c2sErrChan:
 			// This happens when the clientStream has nothing else to offer (io.EOF), returned a gRPC error. In those two
 			// cases we may have received Trailers as part of the call. In case of other errors (stream closed) the trailers
 			// will be nil.
-			serverStream.SetTrailer(clientStream.Trailer())
+			trailer := clientStream.Trailer()
+			s.interceptor.Trailer(info, trailer)
+			serverStream.SetTrailer(trailer)
+			if ie, ok := c2sErr.(*interceptorError); ok {
+				clientCancel()
+				return ie.err
+			}
 			// c2sErr will contain RPC error from client code. If not io.EOF return the RPC error as server stream error.
 			if c2sErr != io.EOF {
 				return c2sErr
@@ -108,7 +177,7 @@ func (s *handler) handler(srv interface{}, serverStream grpc.ServerStream) error
 	return status.Errorf(codes.Internal, "gRPC proxying should never reach this stage.")
 }
 
-func (s *handler) forwardClientToServer(src grpc.ClientStream, dst grpc.ServerStream) chan error {
+func (s *handler) forwardClientToServer(info *StreamInfo, src grpc.ClientStream, dst grpc.ServerStream, forwarded func(direction string, size int)) chan error {
 	ret := make(chan error, 1)
 	go func() {
 		f := &frame{}
@@ -126,21 +195,32 @@ func (s *handler) forwardClientToServer(src grpc.ClientStream, dst grpc.ServerSt
 					ret <- err
 					break
 				}
+				if err := s.interceptor.Header(info, md); err != nil {
+					ret <- &interceptorError{err: err}
+					break
+				}
 				if err := dst.SendHeader(md); err != nil {
 					ret <- err
 					break
 				}
 			}
+			payload, err := s.interceptor.ResponseFrame(info, f.payload)
+			if err != nil {
+				ret <- &interceptorError{err: err}
+				break
+			}
+			f.payload = payload
 			if err := dst.SendMsg(f); err != nil {
 				ret <- err
 				break
 			}
+			forwarded(directionResponse, len(f.payload))
 		}
 	}()
 	return ret
 }
 
-func (s *handler) forwardServerToClient(src grpc.ServerStream, dst grpc.ClientStream) chan error {
+func (s *handler) forwardServerToClient(info *StreamInfo, src grpc.ServerStream, dst grpc.ClientStream, forwarded func(direction string, size int)) chan error {
 	ret := make(chan error, 1)
 	go func() {
 		f := &frame{}
@@ -149,10 +229,17 @@ func (s *handler) forwardServerToClient(src grpc.ServerStream, dst grpc.ClientSt
 				ret <- err // this can be io.EOF which is happy case
 				break
 			}
+			payload, err := s.interceptor.RequestFrame(info, f.payload)
+			if err != nil {
+				ret <- &interceptorError{err: err}
+				break
+			}
+			f.payload = payload
 			if err := dst.SendMsg(f); err != nil {
 				ret <- err
 				break
 			}
+			forwarded(directionRequest, len(f.payload))
 		}
 	}()
 	return ret
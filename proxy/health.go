@@ -0,0 +1,126 @@
+package proxy
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+	"via/logging"
+)
+
+// HealthStatus is the result of the last health check of a registered task instance.
+type HealthStatus int
+
+const (
+	// HealthUnknown is an instance not checked yet. It is routed to like a serving one.
+	HealthUnknown HealthStatus = iota
+	// HealthServing is an instance that passed its last health check.
+	HealthServing
+	// HealthNotServing is an instance that failed its last health check. The director doesn't route to it.
+	HealthNotServing
+)
+
+func (s HealthStatus) String() string {
+	switch s {
+	case HealthUnknown:
+		return "unknown"
+	case HealthServing:
+		return "serving"
+	case HealthNotServing:
+		return "not_serving"
+	}
+	return fmt.Sprintf("HealthStatus(%d)", int(s))
+}
+
+// Health returns the result of the last health check of the task.
+func (t *SignupTask) Health() HealthStatus {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.health
+}
+
+// setHealth 记录健康检查的结果，返回结果是否变化
+func (t *SignupTask) setHealth(health HealthStatus) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	changed := t.health != health
+	t.health = health
+	return changed
+}
+
+// HealthChecker periodically checks every registered task instance with the standard grpc.health.v1 service and
+// marks the instances failing the check HealthNotServing, so the director stops routing to them until they pass a
+// check again. A task service that doesn't implement the health service passes the check as long as it answers.
+type HealthChecker struct {
+	registry Registry
+	interval time.Duration
+	timeout  time.Duration
+	service  string
+}
+
+// NewHealthChecker returns a HealthChecker checking the instances in registry every interval, each check failing
+// after timeout. service is the service name sent in the health check request, empty checks the whole task
+// service. Call Run to start checking.
+func NewHealthChecker(registry Registry, interval, timeout time.Duration, service string) *HealthChecker {
+	return &HealthChecker{registry: registry, interval: interval, timeout: timeout, service: service}
+}
+
+// Run checks the registered instances every interval until ctx is done.
+func (h *HealthChecker) Run(ctx context.Context) {
+	ticker := time.NewTicker(h.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			h.checkAll(ctx)
+		}
+	}
+}
+
+// checkAll 并发检查所有注册的实例，等所有检查结束后返回，结果变化的实例通知registry的watch
+func (h *HealthChecker) checkAll(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, task := range h.registry.List() {
+		if task.Conn == nil {
+			continue
+		}
+		wg.Add(1)
+		go func(task *SignupTask) {
+			defer wg.Done()
+			health, err := h.check(ctx, task)
+			if !task.setHealth(health) {
+				return
+			}
+			if health == HealthNotServing {
+				logging.Warnf("task server %s failed its health check, %+v: %v", task.Address, task.Key(), err)
+			} else {
+				logging.Infof("task server %s is %s, %+v", task.Address, health, task.Key())
+			}
+			h.registry.Updated(task)
+		}(task)
+	}
+	wg.Wait()
+}
+
+// check 调用实例的grpc.health.v1服务，没有实现健康检查服务的实例只要能应答就算作正常
+func (h *HealthChecker) check(ctx context.Context, task *SignupTask) (HealthStatus, error) {
+	ctx, cancel := context.WithTimeout(ctx, h.timeout)
+	defer cancel()
+	resp, err := healthpb.NewHealthClient(task.Conn).Check(ctx, &healthpb.HealthCheckRequest{Service: h.service})
+	if status.Code(err) == codes.Unimplemented {
+		return HealthServing, nil
+	}
+	if err != nil {
+		return HealthNotServing, err
+	}
+	if resp.Status != healthpb.HealthCheckResponse_SERVING {
+		return HealthNotServing, fmt.Errorf("health status %s", resp.Status)
+	}
+	return HealthServing, nil
+}
@@ -0,0 +1,94 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+// startHealthBackend starts a task service exposing the health service and returns its health server.
+func startHealthBackend(t *testing.T) (*grpc.ClientConn, *health.Server) {
+	healthServer := health.NewServer()
+	s := grpc.NewServer()
+	healthpb.RegisterHealthServer(s, healthServer)
+	return startServer(t, s), healthServer
+}
+
+func TestHealthCheck(t *testing.T) {
+	registry := NewMemoryRegistry()
+	conn, healthServer := startHealthBackend(t)
+	checked := &SignupTask{TaskId: "task", PartyId: "checked", Address: "checked", Conn: conn}
+	//没有实现健康检查服务的task服务只要能应答就算作正常
+	unimplemented := &SignupTask{TaskId: "task", PartyId: "unimplemented", Address: "unimplemented",
+		Conn: startServer(t, grpc.NewServer())}
+	unreachable := &SignupTask{TaskId: "task", PartyId: "unreachable", Address: "unreachable",
+		Conn: dialBuf(t, "bufnet-unreachable")}
+	for _, task := range []*SignupTask{checked, unimplemented, unreachable} {
+		if _, err := registry.Register(task); err != nil {
+			t.Fatal(err)
+		}
+		if task.Health() != HealthUnknown {
+			t.Fatalf("expected a task not checked yet to be unknown, got %v", task.Health())
+		}
+	}
+	_, watch := registry.Watch()
+	defer watch.Stop()
+
+	checker := NewHealthChecker(registry, time.Minute, time.Second, "")
+	checker.checkAll(context.Background())
+	for task, want := range map[*SignupTask]HealthStatus{checked: HealthServing, unimplemented: HealthServing, unreachable: HealthNotServing} {
+		if got := task.Health(); got != want {
+			t.Errorf("task %s: expected %v, got %v", task.PartyId, want, got)
+		}
+	}
+	if n := len(watch.Events()); n != 3 {
+		t.Fatalf("expected an update event per changed task, got %d", n)
+	}
+
+	healthServer.SetServingStatus("", healthpb.HealthCheckResponse_NOT_SERVING)
+	checker.checkAll(context.Background())
+	if checked.Health() != HealthNotServing {
+		t.Fatalf("expected the not serving task to fail its check, got %v", checked.Health())
+	}
+	if n := len(watch.Events()); n != 4 {
+		t.Fatalf("expected only the changed task to be updated, got %d events", n)
+	}
+
+	healthServer.SetServingStatus("", healthpb.HealthCheckResponse_SERVING)
+	checker.checkAll(context.Background())
+	if checked.Health() != HealthServing {
+		t.Fatalf("expected the task to pass its check again, got %v", checked.Health())
+	}
+}
+
+func TestProxySkipsUnhealthyInstances(t *testing.T) {
+	registry := NewMemoryRegistry()
+	healthy := &SignupTask{TaskId: "task", PartyId: "p1", Address: "healthy", Conn: startBackend(t, tagHandler("healthy"))}
+	unhealthy := &SignupTask{TaskId: "task", PartyId: "p1", Address: "unhealthy", Conn: startBackend(t, tagHandler("unhealthy"))}
+	registry.Register(healthy)
+	registry.Register(unhealthy)
+	unhealthy.setHealth(HealthNotServing)
+	proxy := startProxy(t, registry)
+
+	for i := 0; i < 4; i++ {
+		out, err := echo(context.Background(), proxy, "task", "p1", []byte("x"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(out) != "healthyx" {
+			t.Fatalf("expected every call to go to the healthy instance, got %q", out)
+		}
+	}
+
+	healthy.setHealth(HealthNotServing)
+	_, err := echo(context.Background(), proxy, "task", "p1", []byte("x"))
+	if status.Code(err) != codes.Unavailable {
+		t.Fatalf("expected Unavailable when every instance is unhealthy, got %v", err)
+	}
+}
@@ -0,0 +1,241 @@
+package proxy
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"via/logging"
+)
+
+// StreamInfo describes a proxied stream to the FrameInterceptors.
+type StreamInfo struct {
+	Context context.Context //调用方的stream的context，可以取出incoming metadata和peer
+	Method  string
+	Key     TaskKey //metadata中的task_id/party_id/service_type
+	Backend string  //转发到的task服务或下一跳VIA的地址
+}
+
+// FrameInterceptor observes the streams proxied by the handler and may refuse them or change their frames. A
+// request frame goes from the caller to the task service, a response frame from the task service back to the
+// caller. The hooks of one stream may run concurrently from the goroutines of both directions.
+//
+// An error returned by a hook aborts the stream with that error, which should be a gRPC status error.
+// Embed BaseFrameInterceptor to implement only some of the hooks.
+type FrameInterceptor interface {
+	// OpenStream is called before the stream is opened to the backend.
+	OpenStream(info *StreamInfo) error
+	// RequestFrame is called with the payload of each request frame before it is forwarded, and returns the
+	// payload to forward.
+	RequestFrame(info *StreamInfo, payload []byte) ([]byte, error)
+	// ResponseFrame is called with the payload of each response frame before it is forwarded, and returns the
+	// payload to forward.
+	ResponseFrame(info *StreamInfo, payload []byte) ([]byte, error)
+	// Header is called with the header of the backend, which it may change, before it is sent to the caller.
+	Header(info *StreamInfo, header metadata.MD) error
+	// Trailer is called with the trailer of the backend, which it may change, before it is sent to the caller.
+	Trailer(info *StreamInfo, trailer metadata.MD)
+	// CloseStream is called when a stream OpenStream accepted ends, with its error or nil.
+	CloseStream(info *StreamInfo, err error)
+}
+
+// BaseFrameInterceptor is a FrameInterceptor accepting every stream and forwarding every frame unchanged.
+type BaseFrameInterceptor struct{}
+
+func (BaseFrameInterceptor) OpenStream(info *StreamInfo) error { return nil }
+
+func (BaseFrameInterceptor) RequestFrame(info *StreamInfo, payload []byte) ([]byte, error) {
+	return payload, nil
+}
+
+func (BaseFrameInterceptor) ResponseFrame(info *StreamInfo, payload []byte) ([]byte, error) {
+	return payload, nil
+}
+
+func (BaseFrameInterceptor) Header(info *StreamInfo, header metadata.MD) error { return nil }
+
+func (BaseFrameInterceptor) Trailer(info *StreamInfo, trailer metadata.MD) {}
+
+func (BaseFrameInterceptor) CloseStream(info *StreamInfo, err error) {}
+
+// WithFrameInterceptors sets the FrameInterceptors of the handler, called in order on stream open, frames and
+// headers, and in reverse order on trailers and stream close.
+func WithFrameInterceptors(interceptors ...FrameInterceptor) HandlerOption {
+	return func(h *handler) {
+		h.interceptor = ChainFrameInterceptors(interceptors...)
+	}
+}
+
+// ChainFrameInterceptors returns a FrameInterceptor calling interceptors in order on stream open, frames and
+// headers, and in reverse order on trailers and stream close. If one of them refuses a stream, the ones that
+// accepted it before are closed.
+func ChainFrameInterceptors(interceptors ...FrameInterceptor) FrameInterceptor {
+	if len(interceptors) == 1 {
+		return interceptors[0]
+	}
+	return chain(interceptors)
+}
+
+type chain []FrameInterceptor
+
+func (c chain) OpenStream(info *StreamInfo) error {
+	for i, interceptor := range c {
+		if err := interceptor.OpenStream(info); err != nil {
+			for j := i - 1; j >= 0; j-- {
+				c[j].CloseStream(info, err)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+func (c chain) RequestFrame(info *StreamInfo, payload []byte) ([]byte, error) {
+	for _, interceptor := range c {
+		var err error
+		if payload, err = interceptor.RequestFrame(info, payload); err != nil {
+			return nil, err
+		}
+	}
+	return payload, nil
+}
+
+func (c chain) ResponseFrame(info *StreamInfo, payload []byte) ([]byte, error) {
+	for _, interceptor := range c {
+		var err error
+		if payload, err = interceptor.ResponseFrame(info, payload); err != nil {
+			return nil, err
+		}
+	}
+	return payload, nil
+}
+
+func (c chain) Header(info *StreamInfo, header metadata.MD) error {
+	for _, interceptor := range c {
+		if err := interceptor.Header(info, header); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c chain) Trailer(info *StreamInfo, trailer metadata.MD) {
+	for i := len(c) - 1; i >= 0; i-- {
+		c[i].Trailer(info, trailer)
+	}
+}
+
+func (c chain) CloseStream(info *StreamInfo, err error) {
+	for i := len(c) - 1; i >= 0; i-- {
+		c[i].CloseStream(info, err)
+	}
+}
+
+// interceptorError 是FrameInterceptor中止stream的错误，handler原样返回给调用方
+type interceptorError struct {
+	err error
+}
+
+func (e *interceptorError) Error() string {
+	return e.err.Error()
+}
+
+// FrameInterceptorFactory creates a FrameInterceptor from the parameters of its config.
+type FrameInterceptorFactory func(params map[string]string) (FrameInterceptor, error)
+
+var frameInterceptors = struct {
+	sync.Mutex
+	factories map[string]FrameInterceptorFactory
+}{factories: make(map[string]FrameInterceptorFactory)}
+
+// RegisterFrameInterceptor makes the FrameInterceptor created by factory available under name to
+// NewFrameInterceptor, typically from the init function of the package implementing it. It panics if name is
+// already registered.
+func RegisterFrameInterceptor(name string, factory FrameInterceptorFactory) {
+	frameInterceptors.Lock()
+	defer frameInterceptors.Unlock()
+	if _, exists := frameInterceptors.factories[name]; exists {
+		panic(fmt.Sprintf("frame interceptor %s is already registered", name))
+	}
+	frameInterceptors.factories[name] = factory
+}
+
+// NewFrameInterceptor creates the FrameInterceptor registered under name with params.
+func NewFrameInterceptor(name string, params map[string]string) (FrameInterceptor, error) {
+	frameInterceptors.Lock()
+	factory, ok := frameInterceptors.factories[name]
+	frameInterceptors.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown frame interceptor %s, registered: %v", name, FrameInterceptorNames())
+	}
+	return factory(params)
+}
+
+// FrameInterceptorNames returns the sorted names of the registered FrameInterceptors.
+func FrameInterceptorNames() []string {
+	frameInterceptors.Lock()
+	defer frameInterceptors.Unlock()
+	names := make([]string, 0, len(frameInterceptors.factories))
+	for name := range frameInterceptors.factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func init() {
+	RegisterFrameInterceptor("max_frame_size", newMaxFrameSize)
+	RegisterFrameInterceptor("audit", newAudit)
+}
+
+// maxFrameSize 拒绝payload超过maxBytes的frame，两个方向都检查
+type maxFrameSize struct {
+	BaseFrameInterceptor
+	maxBytes int
+}
+
+func newMaxFrameSize(params map[string]string) (FrameInterceptor, error) {
+	maxBytes, err := strconv.Atoi(params["maxBytes"])
+	if err != nil || maxBytes <= 0 {
+		return nil, fmt.Errorf("max_frame_size requires a positive maxBytes, got %q", params["maxBytes"])
+	}
+	return &maxFrameSize{maxBytes: maxBytes}, nil
+}
+
+func (m *maxFrameSize) check(info *StreamInfo, payload []byte) ([]byte, error) {
+	if len(payload) > m.maxBytes {
+		return nil, status.Errorf(codes.ResourceExhausted, "frame of %d bytes exceeds the limit of %d bytes", len(payload), m.maxBytes)
+	}
+	return payload, nil
+}
+
+func (m *maxFrameSize) RequestFrame(info *StreamInfo, payload []byte) ([]byte, error) {
+	return m.check(info, payload)
+}
+
+func (m *maxFrameSize) ResponseFrame(info *StreamInfo, payload []byte) ([]byte, error) {
+	return m.check(info, payload)
+}
+
+// audit 在日志中记录每个stream的打开和结束
+type audit struct {
+	BaseFrameInterceptor
+}
+
+func newAudit(params map[string]string) (FrameInterceptor, error) {
+	return audit{}, nil
+}
+
+func (audit) OpenStream(info *StreamInfo) error {
+	logging.Infof("audit: open %s, %+v, backend: %s", info.Method, info.Key, info.Backend)
+	return nil
+}
+
+func (audit) CloseStream(info *StreamInfo, err error) {
+	logging.Infof("audit: close %s, %+v, code: %s", info.Method, info.Key, status.Code(err))
+}
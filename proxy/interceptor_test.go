@@ -0,0 +1,105 @@
+package proxy
+
+import (
+	"bytes"
+	"reflect"
+	"sync"
+	"testing"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// recordingInterceptor 记录调用的hook，把请求的payload转为大写
+type recordingInterceptor struct {
+	BaseFrameInterceptor
+	name   string
+	refuse bool
+	mu     *sync.Mutex
+	calls  *[]string
+}
+
+func (r *recordingInterceptor) record(hook string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	*r.calls = append(*r.calls, r.name+"."+hook)
+}
+
+func (r *recordingInterceptor) OpenStream(info *StreamInfo) error {
+	r.record("open")
+	if r.refuse {
+		return status.Error(codes.PermissionDenied, "refused")
+	}
+	return nil
+}
+
+func (r *recordingInterceptor) RequestFrame(info *StreamInfo, payload []byte) ([]byte, error) {
+	r.record("request")
+	return bytes.ToUpper(payload), nil
+}
+
+func (r *recordingInterceptor) CloseStream(info *StreamInfo, err error) {
+	r.record("close")
+}
+
+func startInterceptedProxy(t *testing.T, interceptors ...FrameInterceptor) *grpc.ClientConn {
+	registry := NewMemoryRegistry()
+	registry.Register(&SignupTask{TaskId: "task", PartyId: "partner_1", Address: "echo", Conn: startEcho(t)})
+	return startServer(t, grpc.NewServer(
+		grpc.ForceServerCodec(Codec()),
+		grpc.UnknownServiceHandler(TransparentHandler(GetDirector(registry), WithFrameInterceptors(interceptors...))),
+	))
+}
+
+func TestFrameInterceptorChain(t *testing.T) {
+	var mu sync.Mutex
+	var calls []string
+	first := &recordingInterceptor{name: "first", mu: &mu, calls: &calls}
+	second := &recordingInterceptor{name: "second", mu: &mu, calls: &calls}
+	proxyConn := startInterceptedProxy(t, first, second)
+
+	reply, err := echo(context.Background(), proxyConn, "task", "partner_1", []byte("ping"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(reply) != "PING" {
+		t.Fatalf("expected the request frame changed by the interceptors, got %q", reply)
+	}
+	expected := []string{"first.open", "second.open", "first.request", "second.request", "second.close", "first.close"}
+	if !reflect.DeepEqual(calls, expected) {
+		t.Fatalf("expected hooks %v, got %v", expected, calls)
+	}
+
+	calls = nil
+	second.refuse = true
+	if _, err := echo(context.Background(), proxyConn, "task", "partner_1", []byte("ping")); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("expected the refused stream to fail with PermissionDenied, got %v", err)
+	}
+	expected = []string{"first.open", "second.open", "first.close"}
+	if !reflect.DeepEqual(calls, expected) {
+		t.Fatalf("expected hooks %v, got %v", expected, calls)
+	}
+}
+
+func TestMaxFrameSizeInterceptor(t *testing.T) {
+	if _, err := NewFrameInterceptor("max_frame_size", nil); err == nil {
+		t.Fatal("expected max_frame_size without maxBytes to fail")
+	}
+	if _, err := NewFrameInterceptor("unknown", nil); err == nil {
+		t.Fatal("expected an unknown interceptor to fail")
+	}
+	interceptor, err := NewFrameInterceptor("max_frame_size", map[string]string{"maxBytes": "4"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxyConn := startInterceptedProxy(t, interceptor)
+
+	if _, err := echo(context.Background(), proxyConn, "task", "partner_1", []byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := echo(context.Background(), proxyConn, "task", "partner_1", []byte("ping!")); status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("expected the oversized frame to fail with ResourceExhausted, got %v", err)
+	}
+}
@@ -0,0 +1,183 @@
+package proxy
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+	"via/logging"
+
+	"golang.org/x/net/context"
+)
+
+// EvictReasonLeaseExpired is the Eviction reason of a task that stopped renewing its lease.
+const EvictReasonLeaseExpired = "lease expired"
+
+// 保留最近的驱逐记录数量
+const maxEvictions = 128
+
+// ErrLeaseNotFound is returned by Lessor.KeepAlive for a lease that expired, was revoked or never existed.
+var ErrLeaseNotFound = errors.New("lease not found")
+
+// Eviction records a task that the Lessor removed from the registry.
+type Eviction struct {
+	TaskId  string
+	PartyId string
+	Address string
+	LeaseId string
+	Reason  string
+	Time    time.Time
+}
+
+type lease struct {
+	task     *SignupTask
+	deadline time.Time
+}
+
+// Lessor grants a lease to every signed up task and evicts the tasks that don't renew it within the TTL, so a
+// crashed task service is not routed to forever.
+type Lessor struct {
+	registry Registry
+	ttl      time.Duration
+
+	mu        sync.Mutex
+	leases    map[string]*lease
+	evictions []Eviction //最近的驱逐记录，最旧的在前
+}
+
+// NewLessor returns a Lessor evicting expired tasks from registry. Call Run to start evicting.
+func NewLessor(registry Registry, ttl time.Duration) *Lessor {
+	return &Lessor{registry: registry, ttl: ttl, leases: make(map[string]*lease)}
+}
+
+// TTL returns the time a lease stays valid after it was granted or renewed.
+func (l *Lessor) TTL() time.Duration {
+	return l.ttl
+}
+
+// Grant grants a new lease to task, stores its id in task.LeaseId and returns it. The task should be granted its
+// lease before it is registered.
+func (l *Lessor) Grant(task *SignupTask) string {
+	id := newLeaseId()
+	task.LeaseId = id
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.leases[id] = &lease{task: task, deadline: time.Now().Add(l.ttl)}
+	return id
+}
+
+// Restore grants task its lease again after VIA restarted, keeping the id in task.LeaseId so the task goes on
+// renewing it. A task restored without a lease id is granted a new lease, which it can't renew, so it is evicted
+// after the TTL unless it signs up again.
+func (l *Lessor) Restore(task *SignupTask) {
+	if task.LeaseId == "" {
+		l.Grant(task)
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.leases[task.LeaseId] = &lease{task: task, deadline: time.Now().Add(l.ttl)}
+}
+
+// KeepAlive renews the lease and returns its TTL.
+func (l *Lessor) KeepAlive(leaseId string) (time.Duration, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	ls, ok := l.leases[leaseId]
+	if !ok {
+		return 0, ErrLeaseNotFound
+	}
+	ls.deadline = time.Now().Add(l.ttl)
+	return l.ttl, nil
+}
+
+// Revoke drops the lease without evicting its task, e.g. when the task unregistered itself.
+func (l *Lessor) Revoke(leaseId string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.leases, leaseId)
+}
+
+// Evicted returns the eviction of the task holding leaseId, if it is among the recent evictions.
+func (l *Lessor) Evicted(leaseId string) (Eviction, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i := len(l.evictions) - 1; i >= 0; i-- {
+		if l.evictions[i].LeaseId == leaseId {
+			return l.evictions[i], true
+		}
+	}
+	return Eviction{}, false
+}
+
+// Evictions returns the recent evictions, oldest first.
+func (l *Lessor) Evictions() []Eviction {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]Eviction(nil), l.evictions...)
+}
+
+// Run evicts the expired tasks until ctx is done.
+func (l *Lessor) Run(ctx context.Context) {
+	// 检查间隔取TTL的1/4，任务最多在过期后TTL/4内被驱逐
+	ticker := time.NewTicker(l.ttl / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			l.expire(now)
+		}
+	}
+}
+
+// expire evicts the tasks whose lease expired before now and returns their evictions.
+func (l *Lessor) expire(now time.Time) []Eviction {
+	var expired []*lease
+	l.mu.Lock()
+	for id, ls := range l.leases {
+		if now.After(ls.deadline) {
+			expired = append(expired, ls)
+			delete(l.leases, id)
+		}
+	}
+	l.mu.Unlock()
+
+	var evictions []Eviction
+	for _, ls := range expired {
+		task := ls.task
+		// 任务已注销，或者已被重新注册的任务替换时，仍然关闭它的连接(Close可以重复调用)
+		deleted := l.registry.Delete(task)
+		task.Close(true)
+		if !deleted {
+			continue
+		}
+
+		eviction := Eviction{TaskId: task.TaskId, PartyId: task.PartyId, Address: task.Address, LeaseId: task.LeaseId,
+			Reason: EvictReasonLeaseExpired, Time: now}
+		logging.Infof("task evicted, taskId: %s, partyId: %s, address: %s, reason: %s",
+			eviction.TaskId, eviction.PartyId, eviction.Address, eviction.Reason)
+		evictions = append(evictions, eviction)
+	}
+
+	if len(evictions) > 0 {
+		l.mu.Lock()
+		l.evictions = append(l.evictions, evictions...)
+		if n := len(l.evictions) - maxEvictions; n > 0 {
+			l.evictions = append([]Eviction(nil), l.evictions[n:]...)
+		}
+		l.mu.Unlock()
+	}
+	return evictions
+}
+
+func newLeaseId() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,83 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLessorExpire(t *testing.T) {
+	registry := NewMemoryRegistry()
+	lessor := NewLessor(registry, time.Minute)
+
+	alive := &SignupTask{TaskId: "task", PartyId: "alive"}
+	lessor.Grant(alive)
+	registry.Register(alive)
+	dead := &SignupTask{TaskId: "task", PartyId: "dead"}
+	lessor.Grant(dead)
+	registry.Register(dead)
+
+	if alive.LeaseId == "" || alive.LeaseId == dead.LeaseId {
+		t.Fatalf("expected distinct lease ids, got %q and %q", alive.LeaseId, dead.LeaseId)
+	}
+
+	// 只有alive续约，让dead的租约先过期
+	lessor.mu.Lock()
+	lessor.leases[dead.LeaseId].deadline = time.Now().Add(-time.Second)
+	lessor.mu.Unlock()
+	if ttl, err := lessor.KeepAlive(alive.LeaseId); err != nil || ttl != time.Minute {
+		t.Fatalf("expected keep alive to renew for a minute, got %v, %v", ttl, err)
+	}
+
+	evictions := lessor.expire(time.Now())
+	if len(evictions) != 1 || evictions[0].PartyId != "dead" || evictions[0].Reason != EvictReasonLeaseExpired {
+		t.Fatalf("expected dead to be evicted, got %v", evictions)
+	}
+	if instances := registry.Lookup(NewTaskKey("task", "dead", "")); len(instances) != 0 {
+		t.Fatal("expected dead to be removed from the registry")
+	}
+	if instances := registry.Lookup(NewTaskKey("task", "alive", "")); len(instances) != 1 {
+		t.Fatal("expected alive to stay registered")
+	}
+
+	if _, err := lessor.KeepAlive(dead.LeaseId); err != ErrLeaseNotFound {
+		t.Fatalf("expected ErrLeaseNotFound, got %v", err)
+	}
+	if eviction, ok := lessor.Evicted(dead.LeaseId); !ok || eviction.Reason != EvictReasonLeaseExpired {
+		t.Fatalf("expected eviction of dead to be recorded, got %v", eviction)
+	}
+}
+
+func TestLessorExpireReplacedTask(t *testing.T) {
+	registry := NewMemoryRegistry()
+	lessor := NewLessor(registry, time.Minute)
+
+	old := &SignupTask{TaskId: "task", PartyId: "party"}
+	lessor.Grant(old)
+	registry.Register(old)
+
+	// 重新注册替换了旧的task，旧租约过期不能驱逐新的task
+	renewed := &SignupTask{TaskId: "task", PartyId: "party"}
+	lessor.Grant(renewed)
+	registry.Register(renewed)
+
+	if evictions := lessor.expire(time.Now().Add(30 * time.Second)); len(evictions) != 0 {
+		t.Fatalf("expected no eviction before the TTL, got %v", evictions)
+	}
+	lessor.KeepAlive(renewed.LeaseId)
+	lessor.mu.Lock()
+	lessor.leases[old.LeaseId].deadline = time.Now().Add(-time.Second)
+	lessor.mu.Unlock()
+
+	if evictions := lessor.expire(time.Now()); len(evictions) != 0 {
+		t.Fatalf("expected the replaced task not to be evicted, got %v", evictions)
+	}
+	if instances := registry.Lookup(NewTaskKey("task", "party", "")); len(instances) != 1 || instances[0] != renewed {
+		t.Fatal("expected the renewed task to stay registered")
+	}
+	old.mu.Lock()
+	closing := old.closing
+	old.mu.Unlock()
+	if !closing {
+		t.Fatal("expected the expired replaced task to be closed")
+	}
+}
@@ -0,0 +1,370 @@
+package proxy
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// What the streams of a LimitRule are counted by.
+const (
+	LimitByParty  = "party"  //调用方：Forwarder校验的最初调用方，即证书身份，没有证书时为地址
+	LimitByTask   = "task"   //task_id
+	LimitByMethod = "method" //gRPC的完整方法名
+)
+
+// 超过的限制，用作指标的limit标签
+const (
+	limitStreamRate = "streams_per_second"
+	limitConcurrent = "concurrent_streams"
+	limitByteRate   = "bytes_per_second"
+)
+
+// LimitRule limits the streams of each calling party, task or method separately, or only those of Match. The
+// limits left zero are not enforced.
+type LimitRule struct {
+	By                   string  //LimitByParty, LimitByTask or LimitByMethod
+	Match                string  //只限制这个调用方、task或方法，为空时分别限制每一个
+	StreamsPerSecond     float64 //新建stream的速率
+	StreamBurst          int     //新建stream的突发数，0表示StreamsPerSecond向上取整
+	MaxConcurrentStreams int     //同时转发的stream数
+	BytesPerSecond       int64   //两个方向转发的payload字节数的速率
+	ByteBurst            int64   //字节数的突发数，0表示BytesPerSecond
+}
+
+// LimitUsage is the state of the limits of a LimitRule for one calling party, task or method.
+type LimitUsage struct {
+	By            string   `json:"by"`
+	Value         string   `json:"value"`
+	ActiveStreams int      `json:"active_streams"`
+	StreamTokens  *float64 `json:"stream_tokens,omitempty"` //剩余可新建的stream数，没有速率限制时为空
+	ByteTokens    *float64 `json:"byte_tokens,omitempty"`   //剩余可转发的字节数，没有速率限制时为空，透支时为负数
+	Limited       int64    `json:"limited"`                 //被拒绝的stream数
+}
+
+// Limiter enforces LimitRules on the streams proxied by the handlers created WithLimiter: a stream exceeding the
+// stream rate or the concurrent streams of a rule it matches is refused, and a stream exceeding its byte rate is
+// aborted, with ResourceExhausted. The byte rate may be overdrawn by one frame, so frames larger than the burst
+// still pass when the bucket is full.
+//
+// The LimitByParty rules count a stream for its authenticated caller, never for metadata the caller sets: the
+// origin recorded by the trusted VIAs that forwarded the call, or else the certificate identity of the direct
+// caller, or its address without a certificate. See Forwarder.
+type Limiter struct {
+	BaseFrameInterceptor
+	rules     []LimitRule
+	forwarder *Forwarder
+	limited   *prometheus.CounterVec
+	now       func() time.Time
+
+	states  sync.Map //limitKey -> *limitState，每个状态有自己的锁
+	streams sync.Map //*StreamInfo -> []*limitState，每个转发中的stream匹配的限制，按规则顺序
+	swept   int64    //上次清理空闲状态的时间，UnixNano，原子访问
+}
+
+type limitKey struct {
+	rule  int
+	value string
+}
+
+// limitState 是一条规则对一个调用方、task或方法的限制状态，字段由mu保护。
+// 一个stream匹配的多个状态按规则顺序加锁，避免死锁
+type limitState struct {
+	key limitKey
+
+	mu      sync.Mutex
+	streams *tokenBucket
+	bytes   *tokenBucket
+	active  int
+	limited int64
+	removed bool //已被sweep从states中删除，持有它的stream需要重新取出状态
+}
+
+// NewLimiter returns a Limiter enforcing rules. The LimitByParty rules identify the callers with forwarder, which
+// is required by them. If registerer is not nil, the via_proxy_rate_limited_total counter of the streams refused
+// or aborted is registered to it.
+func NewLimiter(rules []LimitRule, forwarder *Forwarder, registerer prometheus.Registerer) (*Limiter, error) {
+	for i, rule := range rules {
+		if rule.By != LimitByParty && rule.By != LimitByTask && rule.By != LimitByMethod {
+			return nil, fmt.Errorf("limit rule %d: unknown by %q", i, rule.By)
+		}
+		if rule.By == LimitByParty && forwarder == nil {
+			return nil, fmt.Errorf("limit rule %d: by %s requires a Forwarder identifying the callers", i, rule.By)
+		}
+	}
+	l := &Limiter{
+		rules:     rules,
+		forwarder: forwarder,
+		limited: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "via", Subsystem: "proxy", Name: "rate_limited_total",
+			Help: "Number of proxied streams refused or aborted by the limits, by rule and limit exceeded.",
+		}, []string{"by", "match", "limit"}),
+		now: time.Now,
+	}
+	if registerer != nil {
+		if err := registerer.Register(l.limited); err != nil {
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+// WithLimiter sets the Limiter of the handler, which is called before the FrameInterceptors.
+func WithLimiter(limiter *Limiter) HandlerOption {
+	return func(h *handler) {
+		h.limiter = limiter
+	}
+}
+
+// value 返回stream在规则中计数的调用方、task或方法，规则不适用于这个stream时返回false
+func (l *Limiter) value(rule LimitRule, info *StreamInfo) (string, bool) {
+	var value string
+	switch rule.By {
+	case LimitByParty:
+		value = l.forwarder.origin(info.Context)
+	case LimitByTask:
+		value = info.Key.TaskId
+	case LimitByMethod:
+		value = info.Method
+	}
+	return value, len(rule.Match) == 0 || rule.Match == value
+}
+
+func (l *Limiter) OpenStream(info *StreamInfo) error {
+	now := l.now()
+	l.sweep(now)
+
+	var keys []limitKey
+	for i, rule := range l.rules {
+		if value, ok := l.value(rule, info); ok {
+			keys = append(keys, limitKey{rule: i, value: value})
+		}
+	}
+	for {
+		states := make([]*limitState, 0, len(keys))
+		for _, key := range keys {
+			states = append(states, l.state(key, now))
+		}
+		removed, err := l.open(states, now)
+		if removed {
+			continue
+		}
+		if err == nil {
+			l.streams.Store(info, states)
+		}
+		return err
+	}
+}
+
+// state 返回key的限制状态，没有时创建
+func (l *Limiter) state(key limitKey, now time.Time) *limitState {
+	if state, ok := l.states.Load(key); ok {
+		return state.(*limitState)
+	}
+	state, _ := l.states.LoadOrStore(key, newLimitState(key, l.rules[key.rule], now))
+	return state.(*limitState)
+}
+
+// open 锁住stream匹配的全部状态，都未超过限制时才占用，被拒绝的stream不消耗其他规则的额度。
+// 有状态已被sweep删除时返回removed，需要重新取出状态
+func (l *Limiter) open(states []*limitState, now time.Time) (bool, error) {
+	for _, state := range states {
+		state.mu.Lock()
+	}
+	defer func() {
+		for _, state := range states {
+			state.mu.Unlock()
+		}
+	}()
+	for _, state := range states {
+		if state.removed {
+			return true, nil
+		}
+	}
+	for _, state := range states {
+		rule := l.rules[state.key.rule]
+		if rule.MaxConcurrentStreams > 0 && state.active >= rule.MaxConcurrentStreams {
+			return false, l.exceeded(state, limitConcurrent)
+		}
+		if state.streams != nil && state.streams.available(now) < 1 {
+			return false, l.exceeded(state, limitStreamRate)
+		}
+	}
+	for _, state := range states {
+		state.active++
+		if state.streams != nil {
+			state.streams.take(1)
+		}
+	}
+	return false, nil
+}
+
+func (l *Limiter) RequestFrame(info *StreamInfo, payload []byte) ([]byte, error) {
+	return l.frame(info, payload)
+}
+
+func (l *Limiter) ResponseFrame(info *StreamInfo, payload []byte) ([]byte, error) {
+	return l.frame(info, payload)
+}
+
+// frame 从stream匹配的所有字节数限制中扣除payload的字节数，额度已透支时中止stream。只锁有字节数限制的状态
+func (l *Limiter) frame(info *StreamInfo, payload []byte) ([]byte, error) {
+	value, ok := l.streams.Load(info)
+	if !ok {
+		return payload, nil
+	}
+	var states []*limitState
+	for _, state := range value.([]*limitState) {
+		if state.bytes != nil {
+			states = append(states, state)
+		}
+	}
+	if len(states) == 0 {
+		return payload, nil
+	}
+	for _, state := range states {
+		state.mu.Lock()
+	}
+	defer func() {
+		for _, state := range states {
+			state.mu.Unlock()
+		}
+	}()
+	now := l.now()
+	for _, state := range states {
+		if state.bytes.available(now) <= 0 {
+			return nil, l.exceeded(state, limitByteRate)
+		}
+	}
+	for _, state := range states {
+		state.bytes.take(float64(len(payload)))
+	}
+	return payload, nil
+}
+
+func (l *Limiter) CloseStream(info *StreamInfo, err error) {
+	value, ok := l.streams.LoadAndDelete(info)
+	if !ok {
+		return
+	}
+	for _, state := range value.([]*limitState) {
+		state.mu.Lock()
+		state.active--
+		state.mu.Unlock()
+	}
+}
+
+// exceeded 记录被拒绝的stream，返回ResourceExhausted，调用时持有state.mu
+func (l *Limiter) exceeded(state *limitState, limit string) error {
+	rule := l.rules[state.key.rule]
+	state.limited++
+	l.limited.WithLabelValues(rule.By, rule.Match, limit).Inc()
+	return status.Errorf(codes.ResourceExhausted, "%s limit of %s %q exceeded", limit, rule.By, state.key.value)
+}
+
+// sweep 每分钟删除一次空闲的限制状态：没有转发中的stream，额度也已经恢复满。只有一个goroutine执行清理
+func (l *Limiter) sweep(now time.Time) {
+	swept := atomic.LoadInt64(&l.swept)
+	if now.Sub(time.Unix(0, swept)) < time.Minute || !atomic.CompareAndSwapInt64(&l.swept, swept, now.UnixNano()) {
+		return
+	}
+	l.states.Range(func(key, value interface{}) bool {
+		state := value.(*limitState)
+		state.mu.Lock()
+		if state.active == 0 && state.streams.full(now) && state.bytes.full(now) {
+			state.removed = true
+			l.states.Delete(key)
+		}
+		state.mu.Unlock()
+		return true
+	})
+}
+
+// Usage returns the state of the limits of each rule for the calling parties, tasks and methods with recent
+// streams, sorted by rule and value.
+func (l *Limiter) Usage() []LimitUsage {
+	now := l.now()
+	var states []*limitState
+	l.states.Range(func(key, value interface{}) bool {
+		states = append(states, value.(*limitState))
+		return true
+	})
+	sort.Slice(states, func(i, j int) bool {
+		if states[i].key.rule != states[j].key.rule {
+			return states[i].key.rule < states[j].key.rule
+		}
+		return states[i].key.value < states[j].key.value
+	})
+	usage := make([]LimitUsage, 0, len(states))
+	for _, state := range states {
+		state.mu.Lock()
+		u := LimitUsage{By: l.rules[state.key.rule].By, Value: state.key.value, ActiveStreams: state.active, Limited: state.limited}
+		if state.streams != nil {
+			tokens := state.streams.available(now)
+			u.StreamTokens = &tokens
+		}
+		if state.bytes != nil {
+			tokens := state.bytes.available(now)
+			u.ByteTokens = &tokens
+		}
+		state.mu.Unlock()
+		usage = append(usage, u)
+	}
+	return usage
+}
+
+func newLimitState(key limitKey, rule LimitRule, now time.Time) *limitState {
+	state := &limitState{key: key}
+	if rule.StreamsPerSecond > 0 {
+		burst := float64(rule.StreamBurst)
+		if burst <= 0 {
+			burst = math.Ceil(rule.StreamsPerSecond)
+		}
+		state.streams = newTokenBucket(rule.StreamsPerSecond, burst, now)
+	}
+	if rule.BytesPerSecond > 0 {
+		burst := float64(rule.ByteBurst)
+		if burst <= 0 {
+			burst = float64(rule.BytesPerSecond)
+		}
+		state.bytes = newTokenBucket(float64(rule.BytesPerSecond), burst, now)
+	}
+	return state
+}
+
+// tokenBucket 是令牌桶，每秒补充rate个令牌，最多burst个
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate, burst float64, now time.Time) *tokenBucket {
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst, last: now}
+}
+
+// available 补充上次之后的令牌，返回当前的令牌数
+func (b *tokenBucket) available(now time.Time) float64 {
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens = math.Min(b.burst, b.tokens+elapsed*b.rate)
+		b.last = now
+	}
+	return b.tokens
+}
+
+func (b *tokenBucket) take(n float64) {
+	b.tokens -= n
+}
+
+// full nil的tokenBucket没有限制，总是满的
+func (b *tokenBucket) full(now time.Time) bool {
+	return b == nil || b.available(now) >= b.burst
+}
@@ -0,0 +1,149 @@
+package proxy
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// partyStream 返回证书身份为identity的调用方的stream
+func partyStream(identity string) *StreamInfo {
+	return &StreamInfo{Context: peerContext(identity, ""), Method: testMethod, Key: NewTaskKey("task", "partner_1", "")}
+}
+
+func newTestForwarder(t *testing.T) *Forwarder {
+	forwarder, err := NewForwarder("via-2", IdentityCommonName, []string{"via-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return forwarder
+}
+
+func TestLimiterRates(t *testing.T) {
+	limiter, err := NewLimiter([]LimitRule{{By: LimitByParty, StreamsPerSecond: 1, BytesPerSecond: 10}}, newTestForwarder(t), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	limiter.now = func() time.Time { return now }
+
+	first, second, other := partyStream("partner_2"), partyStream("partner_2"), partyStream("partner_3")
+	if err := limiter.OpenStream(first); err != nil {
+		t.Fatal(err)
+	}
+	if err := limiter.OpenStream(second); status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("expected the second stream of the party within a second to be refused, got %v", err)
+	}
+	if err := limiter.OpenStream(other); err != nil {
+		t.Fatalf("expected the stream of another party to be counted separately, got %v", err)
+	}
+
+	// 一个超过突发数的frame可以透支，之后的frame在额度恢复前被拒绝
+	if _, err := limiter.RequestFrame(first, make([]byte, 15)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := limiter.ResponseFrame(first, make([]byte, 1)); status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("expected the frame over the byte rate to be refused, got %v", err)
+	}
+
+	now = now.Add(time.Second)
+	if _, err := limiter.ResponseFrame(first, make([]byte, 1)); err != nil {
+		t.Fatalf("expected the byte rate to be refilled, got %v", err)
+	}
+	if err := limiter.OpenStream(second); err != nil {
+		t.Fatalf("expected the stream rate to be refilled, got %v", err)
+	}
+
+	usage := limiter.Usage()
+	if len(usage) != 2 || usage[0].Value != "partner_2" || usage[0].ActiveStreams != 2 || usage[0].Limited != 2 ||
+		usage[0].StreamTokens == nil || *usage[0].StreamTokens != 0 || usage[0].ByteTokens == nil || *usage[0].ByteTokens != 4 {
+		t.Fatalf("unexpected usage: %+v", usage)
+	}
+	limiter.CloseStream(first, nil)
+	limiter.CloseStream(second, nil)
+	if usage := limiter.Usage(); usage[0].ActiveStreams != 0 {
+		t.Fatalf("expected the closed streams to be released, got %+v", usage[0])
+	}
+}
+
+func TestLimiterAuthenticatedParty(t *testing.T) {
+	if _, err := NewLimiter([]LimitRule{{By: LimitByParty, StreamsPerSecond: 1}}, nil, nil); err == nil {
+		t.Fatal("expected the party rule without a Forwarder to be invalid")
+	}
+	limiter, err := NewLimiter([]LimitRule{{By: LimitByParty, StreamsPerSecond: 1}}, newTestForwarder(t), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	limiter.now = func() time.Time { return time.Unix(1000, 0) }
+	withMetadata := func(info *StreamInfo, md metadata.MD) *StreamInfo {
+		info.Context = metadata.NewIncomingContext(info.Context, md)
+		return info
+	}
+
+	if err := limiter.OpenStream(partyStream("partner_2")); err != nil {
+		t.Fatal(err)
+	}
+	// 调用方设置的source_party_id和伪造的转发记录不能绕过限制
+	spoofed := withMetadata(partyStream("partner_2"), metadata.Pairs(MetadataSourcePartyIdKey, "partner_9",
+		MetadataForwardedForKey, "partner_9", MetadataForwardedByKey, "via-9", MetadataForwardedHopsKey, Hop{For: "partner_9", By: "via-9"}.String()))
+	if err := limiter.OpenStream(spoofed); status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("expected the stream with a spoofed party to be counted for its certificate, got %v", err)
+	}
+
+	// 可信的VIA转发来的调用按转发记录中的最初调用方计数
+	relayed := func(origin string) *StreamInfo {
+		return withMetadata(partyStream("via-1"), metadata.Pairs(MetadataForwardedForKey, origin, MetadataForwardedByKey, "via-1",
+			MetadataForwardedHopsKey, Hop{For: origin, By: "via-1"}.String()))
+	}
+	if err := limiter.OpenStream(relayed("partner_3")); err != nil {
+		t.Fatal(err)
+	}
+	if err := limiter.OpenStream(relayed("partner_4")); err != nil {
+		t.Fatalf("expected the relayed callers to be counted separately, got %v", err)
+	}
+	if err := limiter.OpenStream(relayed("partner_3")); status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("expected the relayed caller to be limited, got %v", err)
+	}
+	usage := limiter.Usage()
+	if len(usage) != 3 || usage[0].Value != "partner_2" || usage[1].Value != "partner_3" || usage[2].Value != "partner_4" {
+		t.Fatalf("unexpected usage: %+v", usage)
+	}
+}
+
+func TestLimiterConcurrentStreams(t *testing.T) {
+	limiter, err := NewLimiter([]LimitRule{{By: LimitByTask, Match: "task", MaxConcurrentStreams: 1}}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	registry := NewMemoryRegistry()
+	registry.Register(&SignupTask{TaskId: "task", PartyId: "partner_1", Address: "echo", Conn: startEcho(t)})
+	registry.Register(&SignupTask{TaskId: "other", PartyId: "partner_1", Address: "echo", Conn: startEcho(t)})
+	proxyConn := startServer(t, grpc.NewServer(
+		grpc.ForceServerCodec(Codec()),
+		grpc.UnknownServiceHandler(TransparentHandler(GetDirector(registry), WithLimiter(limiter))),
+	))
+
+	stream := openEcho(t, proxyConn, "task", "partner_1")
+	if _, err := echo(context.Background(), proxyConn, "task", "partner_1", []byte("ping")); status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("expected the concurrent stream to be refused, got %v", err)
+	}
+	if _, err := echo(context.Background(), proxyConn, "other", "partner_1", []byte("ping")); err != nil {
+		t.Fatalf("expected the stream of a task the rule doesn't match to pass, got %v", err)
+	}
+
+	if err := stream.CloseSend(); err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.RecvMsg(&frame{}); err != io.EOF {
+		t.Fatalf("expected io.EOF, got %v", err)
+	}
+	if _, err := echo(context.Background(), proxyConn, "task", "partner_1", []byte("ping")); err != nil {
+		t.Fatalf("expected the stream to pass after the first one closed, got %v", err)
+	}
+}
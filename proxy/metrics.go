@@ -0,0 +1,345 @@
+package proxy
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// MetadataSourcePartyIdKey optionally carries the party id of the caller. It is set by the caller, so it is only
+// recorded in the access log: the metrics and the LimitByParty limits use the authenticated caller instead.
+const MetadataSourcePartyIdKey = "source_party_id"
+
+// 转发的方向，request是调用方到task服务，response是task服务到调用方
+const (
+	directionRequest  = "request"
+	directionResponse = "response"
+)
+
+// unknownLabel 是不能确定的标签值：未注册的任务的方法，没有证书的调用方
+const unknownLabel = "unknown"
+
+// Metrics collects the Prometheus metrics of the calls proxied by the handlers created WithMetrics. The stream
+// counts are labeled by full method name, task id, source and destination party, and the gRPC status code of
+// finished streams. The source party is the authenticated origin of the call, see Forwarder. The series of a task
+// are deleted once it has no registered instance and no stream in progress; calls routed to other VIAs are counted
+// without task id. The per-direction message and byte counters and the duration histogram, which hold many more
+// series each, are labeled by method and destination party only, so they don't grow with every task. Refused calls
+// are labeled by method only if their task is registered, so unknown methods don't add series.
+type Metrics struct {
+	started    *prometheus.CounterVec
+	finished   *prometheus.CounterVec
+	active     *prometheus.GaugeVec
+	messages   *prometheus.CounterVec
+	bytes      *prometheus.CounterVec
+	duration   *prometheus.HistogramVec
+	rejections *prometheus.CounterVec
+
+	registry  Registry
+	forwarder *Forwarder
+
+	mu    sync.Mutex
+	tasks map[string]*taskSeries //按task id记录的stream数的序列
+}
+
+// taskSeries 是一个task的stream数的序列，task结束且没有进行中的stream时删除
+type taskSeries struct {
+	streams  map[[4]string]bool //method, task_id, source_party, dest_party
+	finished map[[5]string]bool //以及code
+	active   int
+	ended    bool
+}
+
+// NewMetrics returns Metrics registered to registerer. If registry is not nil, the gauges of the tasks
+// registered in it are registered as well, and Run deletes the series of the tasks removed from it. The source
+// party is read with forwarder; without it the source party is not recorded.
+func NewMetrics(registerer prometheus.Registerer, registry Registry, forwarder *Forwarder) (*Metrics, error) {
+	streamLabels := []string{"method", "task_id", "source_party", "dest_party"}
+	withLabels := func(labels ...string) []string {
+		return append(append([]string(nil), streamLabels...), labels...)
+	}
+	//每个task都有的序列只用于stream数，各方向的counter和histogram不按task和调用方区分
+	trafficLabels := func(label string) []string {
+		return []string{"method", "dest_party", label}
+	}
+	m := &Metrics{
+		started: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "via", Subsystem: "proxy", Name: "streams_started_total",
+			Help: "Number of proxied streams started.",
+		}, streamLabels),
+		finished: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "via", Subsystem: "proxy", Name: "streams_finished_total",
+			Help: "Number of proxied streams finished, by gRPC status code.",
+		}, withLabels("code")),
+		active: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "via", Subsystem: "proxy", Name: "active_streams",
+			Help: "Number of proxied streams in progress.",
+		}, streamLabels),
+		messages: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "via", Subsystem: "proxy", Name: "messages_total",
+			Help: "Number of messages forwarded, by direction: request (caller to task) or response.",
+		}, trafficLabels("direction")),
+		bytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "via", Subsystem: "proxy", Name: "bytes_total",
+			Help: "Payload bytes of the messages forwarded, by direction: request (caller to task) or response.",
+		}, trafficLabels("direction")),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "via", Subsystem: "proxy", Name: "stream_duration_seconds",
+			Help:    "Duration of the proxied streams, by gRPC status code.",
+			Buckets: []float64{0.005, 0.01, 0.05, 0.1, 0.5, 1, 5, 10, 30, 60, 300, 1800},
+		}, trafficLabels("code")),
+		rejections: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "via", Subsystem: "proxy", Name: "director_rejections_total",
+			Help: "Number of calls the director refused to forward, by reason.",
+		}, []string{"method", "reason"}),
+		registry:  registry,
+		forwarder: forwarder,
+		tasks:     make(map[string]*taskSeries),
+	}
+	collectors := []prometheus.Collector{m.started, m.finished, m.active, m.messages, m.bytes, m.duration, m.rejections}
+	if registry != nil {
+		collectors = append(collectors, registryCollectors(registry)...)
+	}
+	for _, c := range collectors {
+		if err := registerer.Register(c); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// registryCollectors 在采集时统计registry中注册的任务
+func registryCollectors(registry Registry) []prometheus.Collector {
+	return []prometheus.Collector{
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: "via", Subsystem: "registry", Name: "tasks",
+			Help: "Number of tasks with at least one registered task service.",
+		}, func() float64 {
+			taskIds := make(map[string]bool)
+			for _, task := range registry.List() {
+				taskIds[task.TaskId] = true
+			}
+			return float64(len(taskIds))
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: "via", Subsystem: "registry", Name: "task_services",
+			Help: "Number of registered task service instances.",
+		}, func() float64 {
+			return float64(len(registry.List()))
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: "via", Subsystem: "registry", Name: "task_streams",
+			Help: "Number of streams forwarded to the registered task services in progress.",
+		}, func() float64 {
+			streams := 0
+			for _, task := range registry.List() {
+				streams += task.ActiveStreams()
+			}
+			return float64(streams)
+		}),
+	}
+}
+
+// Run deletes the series of the tasks removed from the registry until ctx is done. It returns at once if the
+// Metrics has no registry.
+func (m *Metrics) Run(ctx context.Context) {
+	if m.registry == nil {
+		return
+	}
+	_, watch := m.registry.Watch()
+	defer func() {
+		watch.Stop()
+	}()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event, ok := <-watch.Events():
+			if !ok {
+				//watch跟不上registry的变化时重新watch，期间删除的任务在重新watch后检查
+				_, watch = m.registry.Watch()
+				m.sweep()
+				continue
+			}
+			if event.Type == TaskRemoved && !m.registered(event.Task.TaskId) {
+				m.endTask(event.Task.TaskId)
+			}
+		}
+	}
+}
+
+// registered 返回registry中是否有taskId的实例，没有registry时都认为已注册
+func (m *Metrics) registered(taskId string) bool {
+	if m.registry == nil {
+		return true
+	}
+	for _, task := range m.registry.List() {
+		if task.TaskId == taskId {
+			return true
+		}
+	}
+	return false
+}
+
+// sweep 结束registry中已经没有实例的task
+func (m *Metrics) sweep() {
+	m.mu.Lock()
+	taskIds := make([]string, 0, len(m.tasks))
+	for taskId := range m.tasks {
+		taskIds = append(taskIds, taskId)
+	}
+	m.mu.Unlock()
+	for _, taskId := range taskIds {
+		if !m.registered(taskId) {
+			m.endTask(taskId)
+		}
+	}
+}
+
+// endTask 删除task的序列，还有进行中的stream时等最后一个stream结束后删除
+func (m *Metrics) endTask(taskId string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	series, ok := m.tasks[taskId]
+	if !ok {
+		return
+	}
+	if series.active > 0 {
+		series.ended = true
+		return
+	}
+	m.deleteSeries(taskId, series)
+}
+
+// deleteSeries 删除task的序列，调用方持有m.mu
+func (m *Metrics) deleteSeries(taskId string, series *taskSeries) {
+	for labels := range series.streams {
+		m.started.DeleteLabelValues(labels[:]...)
+		m.active.DeleteLabelValues(labels[:]...)
+	}
+	for labels := range series.finished {
+		m.finished.DeleteLabelValues(labels[:]...)
+	}
+	delete(m.tasks, taskId)
+}
+
+// sourceParty 返回调用的最初调用方的证书身份，直接调用方没有证书时返回unknown。
+// 调用方地址的端口每次连接都不同，不用作标签
+func (m *Metrics) sourceParty(ctx context.Context) string {
+	if m.forwarder == nil || len(m.forwarder.identities.Identities(ctx)) == 0 {
+		return unknownLabel
+	}
+	origin := m.forwarder.origin(ctx)
+	if host, _, err := net.SplitHostPort(origin); err == nil && net.ParseIP(host) != nil {
+		//可信的VIA转发来的没有证书的调用方
+		return unknownLabel
+	}
+	return origin
+}
+
+// reject 统计director拒绝的调用，m为nil时不统计
+func (m *Metrics) reject(ctx context.Context, method string, err error) {
+	if m == nil {
+		return
+	}
+	reason := "other"
+	if r, ok := err.(*rejection); ok {
+		reason = r.reason
+	}
+	//方法名由调用方决定，只记录已注册的任务的方法
+	md, _ := metadata.FromIncomingContext(ctx)
+	if taskId := first(md, MetadataTaskIdKey); m.registry == nil || taskId == "" || !m.registered(taskId) {
+		method = unknownLabel
+	}
+	m.rejections.WithLabelValues(method, reason).Inc()
+}
+
+// startStream 开始统计一个转发的stream，m为nil时返回nil，nil的streamMetrics不统计
+func (m *Metrics) startStream(ctx context.Context, method string) *streamMetrics {
+	if m == nil {
+		return nil
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	taskId, destParty := first(md, MetadataTaskIdKey), first(md, MetadataPartyIdKey)
+	//转发到其它VIA的调用的task id由调用方决定，不用作标签
+	if !m.registered(taskId) {
+		taskId = ""
+	}
+	labels := [4]string{method, taskId, m.sourceParty(ctx), destParty}
+	m.mu.Lock()
+	m.started.WithLabelValues(labels[:]...).Inc()
+	m.active.WithLabelValues(labels[:]...).Inc()
+	if taskId != "" {
+		series, ok := m.tasks[taskId]
+		if !ok {
+			series = &taskSeries{streams: make(map[[4]string]bool), finished: make(map[[5]string]bool)}
+			m.tasks[taskId] = series
+		}
+		series.streams[labels] = true
+		series.active++
+		series.ended = false
+	}
+	m.mu.Unlock()
+	return &streamMetrics{
+		m:            m,
+		labels:       labels,
+		start:        time.Now(),
+		reqMessages:  m.messages.WithLabelValues(method, destParty, directionRequest),
+		reqBytes:     m.bytes.WithLabelValues(method, destParty, directionRequest),
+		respMessages: m.messages.WithLabelValues(method, destParty, directionResponse),
+		respBytes:    m.bytes.WithLabelValues(method, destParty, directionResponse),
+	}
+}
+
+// streamMetrics 统计一个stream，各方向的counter在stream开始时取出，转发每个消息时不再查找label
+type streamMetrics struct {
+	m                       *Metrics
+	labels                  [4]string //method, task_id, source_party, dest_party
+	start                   time.Time
+	reqMessages, reqBytes   prometheus.Counter
+	respMessages, respBytes prometheus.Counter
+}
+
+// forwarded 统计转发的一个消息，size是frame的payload大小
+func (s *streamMetrics) forwarded(direction string, size int) {
+	if s == nil {
+		return
+	}
+	if direction == directionRequest {
+		s.reqMessages.Inc()
+		s.reqBytes.Add(float64(size))
+	} else {
+		s.respMessages.Inc()
+		s.respBytes.Add(float64(size))
+	}
+}
+
+// finish 按stream的结果统计结束的stream，已结束的task的最后一个stream结束时删除task的序列
+func (s *streamMetrics) finish(err error) {
+	if s == nil {
+		return
+	}
+	code := status.Code(err).String()
+	finished := [5]string{s.labels[0], s.labels[1], s.labels[2], s.labels[3], code}
+	s.m.duration.WithLabelValues(s.labels[0], s.labels[3], code).Observe(time.Since(s.start).Seconds())
+
+	m, taskId := s.m, s.labels[1]
+	//stream开始后task才被删除时，Run可能已经处理过删除事件
+	ended := taskId != "" && !m.registered(taskId)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.active.WithLabelValues(s.labels[:]...).Dec()
+	m.finished.WithLabelValues(finished[:]...).Inc()
+	if series, ok := m.tasks[taskId]; ok && taskId != "" {
+		series.finished[finished] = true
+		series.active--
+		if series.active == 0 && (series.ended || ended) {
+			m.deleteSeries(taskId, series)
+		}
+	}
+}
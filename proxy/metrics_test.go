@@ -0,0 +1,211 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+func TestMetrics(t *testing.T) {
+	registry := NewMemoryRegistry()
+	registry.Register(&SignupTask{TaskId: "task", PartyId: "partner_1", Address: "echo", Conn: startEcho(t)})
+	metrics, err := NewMetrics(prometheus.NewRegistry(), registry, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxyConn := startServer(t, grpc.NewServer(
+		grpc.ForceServerCodec(Codec()),
+		grpc.UnknownServiceHandler(TransparentHandler(GetDirector(registry), WithMetrics(metrics))),
+	))
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), MetadataSourcePartyIdKey, "partner_2")
+	if _, err := echo(ctx, proxyConn, "task", "partner_1", []byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := echo(ctx, proxyConn, "task", "partner_3", []byte("ping")); err == nil {
+		t.Fatal("expected the call to the unregistered party to fail")
+	}
+
+	labels := []string{testMethod, "task", unknownLabel, "partner_1"}
+	with := func(label string) []string {
+		return append(append([]string(nil), labels...), label)
+	}
+	cases := []struct {
+		name      string
+		collector prometheus.Collector
+		expected  float64
+	}{
+		{"started", metrics.started.WithLabelValues(labels...), 1},
+		{"active", metrics.active.WithLabelValues(labels...), 0},
+		{"finished", metrics.finished.WithLabelValues(with("OK")...), 1},
+		{"request messages", metrics.messages.WithLabelValues(testMethod, "partner_1", directionRequest), 1},
+		{"request bytes", metrics.bytes.WithLabelValues(testMethod, "partner_1", directionRequest), 4},
+		{"response bytes", metrics.bytes.WithLabelValues(testMethod, "partner_1", directionResponse), 4},
+		{"rejections", metrics.rejections.WithLabelValues(testMethod, "task_not_found"), 1},
+	}
+	for _, c := range cases {
+		if got := testutil.ToFloat64(c.collector); got != c.expected {
+			t.Errorf("%s: expected %v, got %v", c.name, c.expected, got)
+		}
+	}
+	if n := testutil.CollectAndCount(metrics.duration); n != 1 {
+		t.Errorf("expected one duration histogram, got %d", n)
+	}
+	//另一个task的调用不增加各方向的counter和histogram的序列
+	registry.Register(&SignupTask{TaskId: "other", PartyId: "partner_1", Address: "echo", Conn: startEcho(t)})
+	if _, err := echo(ctx, proxyConn, "other", "partner_1", []byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	if n := testutil.CollectAndCount(metrics.duration); n != 1 {
+		t.Errorf("expected the duration histogram to be shared by the tasks, got %d", n)
+	}
+	if n := testutil.CollectAndCount(metrics.bytes); n != 2 {
+		t.Errorf("expected a byte counter per direction, got %d", n)
+	}
+	if got := testutil.ToFloat64(metrics.bytes.WithLabelValues(testMethod, "partner_1", directionRequest)); got != 8 {
+		t.Errorf("expected the request bytes of both tasks, got %v", got)
+	}
+
+	registry.Register(&SignupTask{TaskId: "task2", PartyId: "partner_1", Address: "echo2"})
+	if got := testutil.ToFloat64(registryCollectors(registry)[0]); got != 3 {
+		t.Errorf("expected 3 registered tasks, got %v", got)
+	}
+}
+
+// waitForSeries 等待collector的序列数变为n
+func waitForSeries(t *testing.T, what string, collector prometheus.Collector, n int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for testutil.CollectAndCount(collector) != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d series of %s, got %d", n, what, testutil.CollectAndCount(collector))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestMetricsTaskRemoved(t *testing.T) {
+	registry := NewMemoryRegistry()
+	registry.Register(&SignupTask{TaskId: "task", PartyId: "partner_1", Address: "echo", Conn: startEcho(t)})
+	registry.Register(&SignupTask{TaskId: "other", PartyId: "partner_1", Address: "echo", Conn: startEcho(t)})
+	metrics, err := NewMetrics(prometheus.NewRegistry(), registry, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go metrics.Run(ctx)
+	proxyConn := startServer(t, grpc.NewServer(
+		grpc.ForceServerCodec(Codec()),
+		grpc.UnknownServiceHandler(TransparentHandler(GetDirector(registry), WithMetrics(metrics))),
+	))
+
+	for _, taskId := range []string{"task", "other"} {
+		if _, err := echo(context.Background(), proxyConn, taskId, "partner_1", []byte("ping")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stream := openEcho(t, proxyConn, "task", "partner_1")
+	waitForSeries(t, "started streams", metrics.started, 2)
+
+	//task结束时还有进行中的stream，序列保留到stream结束
+	registry.RemoveTask("task")
+	time.Sleep(50 * time.Millisecond)
+	if got := testutil.ToFloat64(metrics.active.WithLabelValues(testMethod, "task", unknownLabel, "partner_1")); got != 1 {
+		t.Fatalf("expected the stream in progress to be counted after the task was removed, got %v", got)
+	}
+	stream.CloseSend()
+	if err := stream.RecvMsg(&frame{}); err != io.EOF {
+		t.Fatalf("expected io.EOF, got %v", err)
+	}
+	waitForSeries(t, "started streams", metrics.started, 1)
+	waitForSeries(t, "active streams", metrics.active, 1)
+	waitForSeries(t, "finished streams", metrics.finished, 1)
+
+	registry.RemoveTask("other")
+	waitForSeries(t, "started streams", metrics.started, 0)
+	waitForSeries(t, "active streams", metrics.active, 0)
+	waitForSeries(t, "finished streams", metrics.finished, 0)
+}
+
+func TestMetricsSpoofedLabels(t *testing.T) {
+	registry := NewMemoryRegistry()
+	registry.Register(&SignupTask{TaskId: "task", PartyId: "partner_1", Address: "echo", Conn: startEcho(t)})
+	metrics, err := NewMetrics(prometheus.NewRegistry(), registry, newTestForwarder(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxyConn := startServer(t, grpc.NewServer(
+		grpc.ForceServerCodec(Codec()),
+		grpc.UnknownServiceHandler(TransparentHandler(GetDirector(registry), WithMetrics(metrics))),
+	))
+
+	// 调用方设置的source_party_id、伪造的转发记录和随意的方法名不增加序列
+	for i := 0; i < 20; i++ {
+		spoofed := fmt.Sprintf("partner_%d", i+10)
+		ctx := metadata.AppendToOutgoingContext(context.Background(), MetadataSourcePartyIdKey, spoofed,
+			MetadataForwardedForKey, spoofed, MetadataForwardedByKey, "via-1", MetadataForwardedHopsKey, Hop{For: spoofed, By: "via-1"}.String())
+		if _, err := echo(ctx, proxyConn, "task", "partner_1", []byte("ping")); err != nil {
+			t.Fatal(err)
+		}
+		ctx = metadata.AppendToOutgoingContext(ctx, MetadataTaskIdKey, fmt.Sprintf("task_%d", i), MetadataPartyIdKey, "partner_1")
+		stream, err := grpc.NewClientStream(ctx, clientStreamDescForProxying, proxyConn, fmt.Sprintf("/random%d.Service/Method%d", i, i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := stream.RecvMsg(&frame{}); err == nil || err == io.EOF {
+			t.Fatalf("expected the call to an unregistered task to be refused, got %v", err)
+		}
+	}
+	for _, c := range []struct {
+		name      string
+		collector prometheus.Collector
+		expected  int
+	}{
+		{"started streams", metrics.started, 1},
+		{"active streams", metrics.active, 1},
+		{"finished streams", metrics.finished, 1},
+		{"rejections", metrics.rejections, 1},
+	} {
+		if n := testutil.CollectAndCount(c.collector); n != c.expected {
+			t.Errorf("%s: expected %d series, got %d", c.name, c.expected, n)
+		}
+	}
+	if got := testutil.ToFloat64(metrics.started.WithLabelValues(testMethod, "task", unknownLabel, "partner_1")); got != 20 {
+		t.Errorf("expected the streams of the caller without certificate to be counted as unknown, got %v", got)
+	}
+	if got := testutil.ToFloat64(metrics.rejections.WithLabelValues(unknownLabel, "task_not_found")); got != 20 {
+		t.Errorf("expected the refused calls to be counted as unknown, got %v", got)
+	}
+}
+
+func TestMetricsSourceParty(t *testing.T) {
+	metrics := &Metrics{forwarder: newTestForwarder(t)}
+	relayed := func(origin string) context.Context {
+		return metadata.NewIncomingContext(peerContext("via-1", ""), metadata.Pairs(MetadataForwardedForKey, origin,
+			MetadataForwardedByKey, "via-1", MetadataForwardedHopsKey, Hop{For: origin, By: "via-1"}.String()))
+	}
+	spoofed := metadata.NewIncomingContext(peerContext("partner_2", ""), metadata.Pairs(MetadataSourcePartyIdKey, "partner_9",
+		MetadataForwardedForKey, "partner_9", MetadataForwardedByKey, "via-9", MetadataForwardedHopsKey, Hop{For: "partner_9", By: "via-9"}.String()))
+	cases := []struct {
+		ctx      context.Context
+		expected string
+	}{
+		{peerContext("partner_2", ""), "partner_2"},
+		{spoofed, "partner_2"},
+		{relayed("partner_3"), "partner_3"},
+		{relayed("10.0.0.1:50123"), unknownLabel},
+		{metadata.NewIncomingContext(context.Background(), metadata.Pairs(MetadataSourcePartyIdKey, "partner_9")), unknownLabel},
+	}
+	for i, c := range cases {
+		if got := metrics.sourceParty(c.ctx); got != c.expected {
+			t.Errorf("case %d: expected source party %q, got %q", i, c.expected, got)
+		}
+	}
+}
@@ -0,0 +1,345 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+const testMethod = "/test.EchoService/Echo"
+
+// echoHandler 是测试用的task服务，把收到的每个frame原样返回
+func echoHandler(srv interface{}, stream grpc.ServerStream) error {
+	for {
+		f := &frame{}
+		if err := stream.RecvMsg(f); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if err := stream.SendMsg(f); err != nil {
+			return err
+		}
+	}
+}
+
+// tagHandler 是测试用的task服务，在收到的每个frame前加上tag再返回，用来区分转发到了哪个task服务
+func tagHandler(tag string) grpc.StreamHandler {
+	return func(srv interface{}, stream grpc.ServerStream) error {
+		for {
+			f := &frame{}
+			if err := stream.RecvMsg(f); err != nil {
+				if err == io.EOF {
+					return nil
+				}
+				return err
+			}
+			if err := stream.SendMsg(&frame{payload: append([]byte(tag), f.payload...)}); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// bufNet 是测试用的内存网络，按地址找到对应的listener
+var bufNet = struct {
+	sync.Mutex
+	listeners map[string]*bufconn.Listener
+}{listeners: make(map[string]*bufconn.Listener)}
+
+// bufDialer dials the in-memory listener at address, it is used with grpc.WithContextDialer.
+func bufDialer(ctx context.Context, address string) (net.Conn, error) {
+	bufNet.Lock()
+	lis, ok := bufNet.listeners[address]
+	bufNet.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("no listener at %s", address)
+	}
+	return lis.Dial()
+}
+
+// listenBuf returns a new in-memory listener and its address.
+func listenBuf() (string, *bufconn.Listener) {
+	lis := bufconn.Listen(1 << 20)
+	bufNet.Lock()
+	defer bufNet.Unlock()
+	address := fmt.Sprintf("bufnet-%d", len(bufNet.listeners))
+	bufNet.listeners[address] = lis
+	return address, lis
+}
+
+// serveBuf serves s on a new in-memory listener and returns its address.
+func serveBuf(t *testing.T, s *grpc.Server) string {
+	address, lis := listenBuf()
+	serveOn(t, s, lis)
+	return address
+}
+
+func serveOn(t *testing.T, s *grpc.Server, lis net.Listener) {
+	go s.Serve(lis)
+	t.Cleanup(s.Stop)
+}
+
+// dialBuf returns a ClientConn using the proxy codec dialed to the in-memory listener at address.
+func dialBuf(t *testing.T, address string) *grpc.ClientConn {
+	conn, err := grpc.Dial(address,
+		grpc.WithContextDialer(bufDialer),
+		grpc.WithDefaultCallOptions(grpc.ForceCodec(Codec())),
+		grpc.WithInsecure(),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// startServer serves s on an in-memory listener and returns a ClientConn dialed to it.
+func startServer(t *testing.T, s *grpc.Server) *grpc.ClientConn {
+	return dialBuf(t, serveBuf(t, s))
+}
+
+// startEcho starts an echo task service and returns the VIA's connection to it.
+func startEcho(t *testing.T) *grpc.ClientConn {
+	return startBackend(t, echoHandler)
+}
+
+// startBackend starts a task service handling every call with handler and returns the VIA's connection to it.
+func startBackend(t *testing.T, handler grpc.StreamHandler) *grpc.ClientConn {
+	return startServer(t, grpc.NewServer(grpc.ForceServerCodec(Codec()), grpc.UnknownServiceHandler(handler)))
+}
+
+// startProxy starts a VIA proxy server directing to registry and returns a caller's connection to it.
+func startProxy(t *testing.T, registry Registry, opts ...DirectorOption) *grpc.ClientConn {
+	return dialBuf(t, serveProxy(t, registry, opts...))
+}
+
+// serveProxy starts a VIA proxy server directing to registry and returns its address.
+func serveProxy(t *testing.T, registry Registry, opts ...DirectorOption) string {
+	return serveBuf(t, newProxyServer(registry, opts...))
+}
+
+func newProxyServer(registry Registry, opts ...DirectorOption) *grpc.Server {
+	return grpc.NewServer(
+		grpc.ForceServerCodec(Codec()),
+		grpc.UnknownServiceHandler(TransparentHandler(GetDirector(registry, opts...))),
+	)
+}
+
+// echo sends payload through conn as taskId/partyId and returns what comes back.
+func echo(ctx context.Context, conn *grpc.ClientConn, taskId, partyId string, payload []byte) ([]byte, error) {
+	ctx = metadata.AppendToOutgoingContext(ctx, MetadataTaskIdKey, taskId, MetadataPartyIdKey, partyId)
+	stream, err := grpc.NewClientStream(ctx, clientStreamDescForProxying, conn, testMethod)
+	if err != nil {
+		return nil, err
+	}
+	if err := stream.SendMsg(&frame{payload: payload}); err != nil {
+		return nil, err
+	}
+	if err := stream.CloseSend(); err != nil {
+		return nil, err
+	}
+	f := &frame{}
+	if err := stream.RecvMsg(f); err != nil {
+		return nil, err
+	}
+	if err := stream.RecvMsg(&frame{}); err != io.EOF {
+		return nil, fmt.Errorf("expected io.EOF after the echo, got %v", err)
+	}
+	return f.payload, nil
+}
+
+func TestProxyUnregisteredTask(t *testing.T) {
+	proxyConn := startProxy(t, NewMemoryRegistry())
+	if _, err := echo(context.Background(), proxyConn, "task", "party", []byte("ping")); err == nil {
+		t.Fatal("expected proxying to an unregistered task to fail")
+	}
+}
+
+func TestProxyServiceType(t *testing.T) {
+	registry := NewMemoryRegistry()
+	registry.Register(&SignupTask{TaskId: "task", PartyId: "party", Conn: startBackend(t, tagHandler("default:"))})
+	registry.Register(&SignupTask{TaskId: "task", PartyId: "party", ServiceType: "data", Conn: startBackend(t, tagHandler("data:"))})
+	proxyConn := startProxy(t, registry)
+
+	cases := []struct {
+		serviceType string
+		expected    string
+	}{
+		{"", "default:ping"},
+		{DefaultServiceType, "default:ping"},
+		{"data", "data:ping"},
+	}
+	for _, c := range cases {
+		ctx := context.Background()
+		if c.serviceType != "" {
+			ctx = metadata.AppendToOutgoingContext(ctx, MetadataServiceTypeKey, c.serviceType)
+		}
+		got, err := echo(ctx, proxyConn, "task", "party", []byte("ping"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != c.expected {
+			t.Errorf("service type %q: expected %q, got %q", c.serviceType, c.expected, got)
+		}
+	}
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), MetadataServiceTypeKey, "compute")
+	if _, err := echo(ctx, proxyConn, "task", "party", []byte("ping")); err == nil {
+		t.Fatal("expected proxying to an unregistered service type to fail")
+	}
+}
+
+func TestProxyInstances(t *testing.T) {
+	registry := NewMemoryRegistry()
+	registry.Register(&SignupTask{TaskId: "task", PartyId: "party", Address: "a1", Conn: startBackend(t, tagHandler("a1:"))})
+	registry.Register(&SignupTask{TaskId: "task", PartyId: "party", Address: "a2", Conn: startBackend(t, tagHandler("a2:"))})
+	proxyConn := startProxy(t, registry)
+
+	counts := make(map[string]int)
+	for i := 0; i < 4; i++ {
+		got, err := echo(context.Background(), proxyConn, "task", "party", []byte("ping"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		counts[string(got)]++
+	}
+	if counts["a1:ping"] != 2 || counts["a2:ping"] != 2 {
+		t.Fatalf("expected the streams to be spread over both instances, got %v", counts)
+	}
+
+	registry.RemoveInstance(NewTaskKey("task", "party", ""), "a1")
+	for i := 0; i < 2; i++ {
+		if got, err := echo(context.Background(), proxyConn, "task", "party", []byte("ping")); err != nil || string(got) != "a2:ping" {
+			t.Fatalf("expected the remaining instance to answer, got %q, %v", got, err)
+		}
+	}
+}
+
+// Signs up and proxies to many parties at once. Run with -race.
+func TestProxyConcurrentSignup(t *testing.T) {
+	registry := NewMemoryRegistry()
+	backend := startEcho(t)
+	proxyConn := startProxy(t, registry)
+
+	const parties = 20
+	var wg sync.WaitGroup
+	errs := make(chan error, parties*10)
+	for i := 0; i < parties; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			partyId := fmt.Sprintf("party_%d", i)
+			if _, err := registry.Register(&SignupTask{TaskId: "task", PartyId: partyId, Conn: backend}); err != nil {
+				errs <- err
+				return
+			}
+			for j := 0; j < 10; j++ {
+				payload := []byte(fmt.Sprintf("%s-%d", partyId, j))
+				got, err := echo(context.Background(), proxyConn, "task", partyId, payload)
+				if err != nil {
+					errs <- err
+					continue
+				}
+				if !bytes.Equal(got, payload) {
+					errs <- fmt.Errorf("expected %q, got %q", payload, got)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+// openEcho opens a stream through conn and waits for the first echo, so the stream is in flight at the VIA.
+func openEcho(t *testing.T, conn *grpc.ClientConn, taskId, partyId string) grpc.ClientStream {
+	ctx := metadata.AppendToOutgoingContext(context.Background(), MetadataTaskIdKey, taskId, MetadataPartyIdKey, partyId)
+	stream, err := grpc.NewClientStream(ctx, clientStreamDescForProxying, conn, testMethod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.SendMsg(&frame{payload: []byte("ping")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.RecvMsg(&frame{}); err != nil {
+		t.Fatal(err)
+	}
+	return stream
+}
+
+func TestProxyCloseCancelStreams(t *testing.T) {
+	registry := NewMemoryRegistry()
+	task := &SignupTask{TaskId: "task", PartyId: "party", Conn: startEcho(t)}
+	registry.Register(task)
+	proxyConn := startProxy(t, registry)
+
+	stream := openEcho(t, proxyConn, "task", "party")
+	if n := task.ActiveStreams(); n != 1 {
+		t.Fatalf("expected 1 active stream, got %d", n)
+	}
+
+	registry.Remove(NewTaskKey("task", "party", ""))
+	task.Close(true)
+
+	if err := stream.RecvMsg(&frame{}); status.Code(err) != codes.Canceled {
+		t.Fatalf("expected in-flight stream to be canceled, got %v", err)
+	}
+	if state := task.Conn.GetState(); state != connectivity.Shutdown {
+		t.Fatalf("expected task connection to be closed, got %v", state)
+	}
+}
+
+func TestProxyCloseDrainStreams(t *testing.T) {
+	registry := NewMemoryRegistry()
+	task := &SignupTask{TaskId: "task", PartyId: "party", Conn: startEcho(t)}
+	registry.Register(task)
+	proxyConn := startProxy(t, registry)
+
+	stream := openEcho(t, proxyConn, "task", "party")
+
+	registry.Remove(NewTaskKey("task", "party", ""))
+	task.Close(false)
+
+	// the in-flight stream keeps working until it finishes
+	if err := stream.SendMsg(&frame{payload: []byte("pong")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.RecvMsg(&frame{}); err != nil {
+		t.Fatalf("expected in-flight stream to keep working, got %v", err)
+	}
+	if state := task.Conn.GetState(); state == connectivity.Shutdown {
+		t.Fatal("expected task connection to stay open while a stream is in flight")
+	}
+	stream.CloseSend()
+	if err := stream.RecvMsg(&frame{}); err != io.EOF {
+		t.Fatalf("expected io.EOF, got %v", err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for task.Conn.GetState() != connectivity.Shutdown {
+		if time.Now().After(deadline) {
+			t.Fatal("expected task connection to be closed after the stream finished")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if _, err := echo(context.Background(), proxyConn, "task", "party", []byte("ping")); err == nil {
+		t.Fatal("expected proxying to an unregistered task to fail")
+	}
+}
@@ -0,0 +1,306 @@
+package proxy
+
+import (
+	"errors"
+	"sync"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+)
+
+// DefaultServiceType is the service type of a task that signs up, or is called, without one.
+const DefaultServiceType = "default"
+
+// TaskKey identifies a registered task service: a party can expose one service per service type for a task.
+type TaskKey struct {
+	TaskId      string
+	PartyId     string
+	ServiceType string
+}
+
+// NewTaskKey returns the TaskKey of taskId/partyId/serviceType, using DefaultServiceType if serviceType is empty.
+func NewTaskKey(taskId, partyId, serviceType string) TaskKey {
+	if serviceType == "" {
+		serviceType = DefaultServiceType
+	}
+	return TaskKey{TaskId: taskId, PartyId: partyId, ServiceType: serviceType}
+}
+
+//任务的服务信息
+type SignupTask struct {
+	TaskId      string           //任务id
+	PartyId     string           //任务参与方唯一id
+	ServiceType string           //任务服务类型
+	Address     string           //任务服务地址,ip:port
+	Conn        *grpc.ClientConn //proxy到任务服务的grpc调用连接，此链接在任务服务到proxy注册后，由proxy建立
+	LeaseId     string           //注册时分配的租约id，未开启租约时为空
+	Owner       string           //注册者的身份，只有同一注册者可以再次注册或注销此任务服务，未开启注册认证时为空
+	Origin      string           //从集群中其他VIA实例同步来的实例为该VIA的地址，注册在本VIA的实例为空
+
+	mu         sync.Mutex
+	closing    bool                          //任务已注销，不再接受新的stream
+	health     HealthStatus                  //最近一次健康检查的结果
+	streams    map[uint64]context.CancelFunc //正在转发到此任务的stream
+	nextStream uint64
+	closeOnce  sync.Once
+}
+
+// Key returns the key the task is registered under.
+func (t *SignupTask) Key() TaskKey {
+	return NewTaskKey(t.TaskId, t.PartyId, t.ServiceType)
+}
+
+// track registers a proxied stream to the task and returns its context, which is canceled when the stream is
+// canceled by Close. The stream is released once ctx is done. It returns false if the task is already closing.
+func (t *SignupTask) track(ctx context.Context) (context.Context, bool) {
+	ctx, cancel := context.WithCancel(ctx)
+
+	t.mu.Lock()
+	if t.closing {
+		t.mu.Unlock()
+		cancel()
+		return ctx, false
+	}
+	if t.streams == nil {
+		t.streams = make(map[uint64]context.CancelFunc)
+	}
+	t.nextStream++
+	id := t.nextStream
+	t.streams[id] = cancel
+	t.mu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		t.mu.Lock()
+		delete(t.streams, id)
+		drained := t.closing && len(t.streams) == 0
+		t.mu.Unlock()
+		//注销时还有stream在转发，等最后一个stream结束再关闭连接
+		if drained {
+			t.closeConn()
+		}
+	}()
+	return ctx, true
+}
+
+// ActiveStreams returns the number of streams currently proxied to the task.
+func (t *SignupTask) ActiveStreams() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.streams)
+}
+
+// Close stops the task from accepting new streams and closes its connection.
+//
+// If cancelStreams is true the in-flight streams are canceled and the connection is closed at once, otherwise
+// the connection is closed after the last in-flight stream finishes. The task should be removed from its Registry
+// before it is closed.
+func (t *SignupTask) Close(cancelStreams bool) {
+	t.mu.Lock()
+	if t.closing {
+		t.mu.Unlock()
+		return
+	}
+	t.closing = true
+	cancels := make([]context.CancelFunc, 0, len(t.streams))
+	for _, cancel := range t.streams {
+		cancels = append(cancels, cancel)
+	}
+	t.mu.Unlock()
+
+	if !cancelStreams && len(cancels) > 0 {
+		return
+	}
+	for _, cancel := range cancels {
+		cancel()
+	}
+	t.closeConn()
+}
+
+func (t *SignupTask) closeConn() {
+	t.closeOnce.Do(func() {
+		if t.Conn != nil {
+			t.Conn.Close()
+		}
+	})
+}
+
+// Registry stores the task services signed up to this VIA and is used by the director to find the backend
+// connection of a proxied call. A key can hold several instances of a task service, e.g. the replicas a party
+// runs for one task; instances of a key are told apart by their address.
+//
+// Implementations must be safe for concurrent use: Signup handlers write to it while every proxied stream reads
+// from it on its own goroutine.
+type Registry interface {
+	// Register adds the task as an instance of its key, replacing the instance with the same address, and returns
+	// the replaced instance, or nil. The caller should close the replaced instance. It fails with ErrTaskOwned if the
+	// key is registered by another owner.
+	Register(task *SignupTask) (*SignupTask, error)
+	// Lookup returns the instances registered under key, in registration order.
+	Lookup(key TaskKey) []*SignupTask
+	// Remove deletes and returns all instances registered under key.
+	Remove(key TaskKey) []*SignupTask
+	// RemoveInstance deletes and returns the instance registered under key with address.
+	RemoveInstance(key TaskKey, address string) (*SignupTask, bool)
+	// Delete removes task only if it is still registered, so it never removes an instance that replaced it.
+	// It reports whether the task was removed.
+	Delete(task *SignupTask) bool
+	// RemoveTask deletes and returns all instances of all parties registered with taskId.
+	RemoveTask(taskId string) []*SignupTask
+	// Updated notifies the watches with a TaskUpdated event of task if it is still registered, after a change of
+	// its state such as its health. It reports whether task is registered.
+	Updated(task *SignupTask) bool
+	// List returns a snapshot of all registered instances.
+	List() []*SignupTask
+	// Watch returns a snapshot of all registered instances and a RegistryWatch receiving every change after it.
+	// The watch must be stopped once it is no longer used.
+	Watch() ([]*SignupTask, *RegistryWatch)
+}
+
+// ErrInvalidTask is returned by Registry.Register when the task misses its taskId or partyId.
+var ErrInvalidTask = errors.New("task id and party id are required")
+
+// ErrTaskOwned is returned by Registry.Register when the instances of the task are registered by another owner.
+var ErrTaskOwned = errors.New("task is registered by another owner")
+
+// memoryRegistry 是Registry的内存实现，用读写锁保护map。
+// 每个key的实例列表是copy-on-write的，修改时总是生成新的slice
+type memoryRegistry struct {
+	mu       sync.RWMutex
+	tasks    map[TaskKey][]*SignupTask
+	watchers watchers
+}
+
+// NewMemoryRegistry returns an empty, concurrency-safe, in-memory Registry.
+func NewMemoryRegistry() Registry {
+	return &memoryRegistry{tasks: make(map[TaskKey][]*SignupTask)}
+}
+
+func (r *memoryRegistry) Register(task *SignupTask) (*SignupTask, error) {
+	if task == nil || task.TaskId == "" || task.PartyId == "" {
+		return nil, ErrInvalidTask
+	}
+	key := task.Key()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	instances := make([]*SignupTask, 0, len(r.tasks[key])+1)
+	eventType := TaskAdded
+	var replaced *SignupTask
+	for _, instance := range r.tasks[key] {
+		if instance.Owner != task.Owner {
+			return nil, ErrTaskOwned
+		}
+		if instance.Address != task.Address {
+			instances = append(instances, instance)
+		} else {
+			eventType, replaced = TaskUpdated, instance
+		}
+	}
+	r.tasks[key] = append(instances, task)
+	r.watchers.notify(eventType, task)
+	return replaced, nil
+}
+
+func (r *memoryRegistry) Lookup(key TaskKey) []*SignupTask {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return append([]*SignupTask(nil), r.tasks[key]...)
+}
+
+func (r *memoryRegistry) Remove(key TaskKey) []*SignupTask {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	instances := r.tasks[key]
+	delete(r.tasks, key)
+	r.watchers.notify(TaskRemoved, instances...)
+	return instances
+}
+
+func (r *memoryRegistry) RemoveInstance(key TaskKey, address string) (*SignupTask, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, instance := range r.tasks[key] {
+		if instance.Address == address {
+			r.removeLocked(key, instance)
+			return instance, true
+		}
+	}
+	return nil, false
+}
+
+func (r *memoryRegistry) Delete(task *SignupTask) bool {
+	key := task.Key()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, instance := range r.tasks[key] {
+		if instance == task {
+			r.removeLocked(key, task)
+			return true
+		}
+	}
+	return false
+}
+
+// removeLocked 从key的实例列表中删除task，调用者需持有写锁
+func (r *memoryRegistry) removeLocked(key TaskKey, task *SignupTask) {
+	instances := make([]*SignupTask, 0, len(r.tasks[key]))
+	for _, instance := range r.tasks[key] {
+		if instance != task {
+			instances = append(instances, instance)
+		}
+	}
+	if len(instances) == 0 {
+		delete(r.tasks, key)
+	} else {
+		r.tasks[key] = instances
+	}
+	r.watchers.notify(TaskRemoved, task)
+}
+
+func (r *memoryRegistry) RemoveTask(taskId string) []*SignupTask {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var tasks []*SignupTask
+	for key, instances := range r.tasks {
+		if key.TaskId == taskId {
+			tasks = append(tasks, instances...)
+			delete(r.tasks, key)
+		}
+	}
+	r.watchers.notify(TaskRemoved, tasks...)
+	return tasks
+}
+
+func (r *memoryRegistry) Updated(task *SignupTask) bool {
+	key := task.Key()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, instance := range r.tasks[key] {
+		if instance == task {
+			r.watchers.notify(TaskUpdated, task)
+			return true
+		}
+	}
+	return false
+}
+
+func (r *memoryRegistry) List() []*SignupTask {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	tasks := make([]*SignupTask, 0, len(r.tasks))
+	for _, instances := range r.tasks {
+		tasks = append(tasks, instances...)
+	}
+	return tasks
+}
+
+func (r *memoryRegistry) Watch() ([]*SignupTask, *RegistryWatch) {
+	//持有读锁时快照和开始watch，写操作在写锁中通知，两者之间不会遗漏变化
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	tasks := make([]*SignupTask, 0, len(r.tasks))
+	for _, instances := range r.tasks {
+		tasks = append(tasks, instances...)
+	}
+	return tasks, r.watchers.add()
+}
@@ -0,0 +1,213 @@
+package proxy
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestMemoryRegistry(t *testing.T) {
+	registry := NewMemoryRegistry()
+
+	if _, err := registry.Register(&SignupTask{TaskId: "task"}); err != ErrInvalidTask {
+		t.Fatalf("expected ErrInvalidTask, got %v", err)
+	}
+
+	key := NewTaskKey("task", "p1", "")
+	first := &SignupTask{TaskId: "task", PartyId: "p1", Address: "a1"}
+	if old, err := registry.Register(first); err != nil || old != nil {
+		t.Fatalf("expected a new instance to replace nothing, got %v, %v", old, err)
+	}
+	replaced := &SignupTask{TaskId: "task", PartyId: "p1", Address: "a1"}
+	if old, err := registry.Register(replaced); err != nil || old != first {
+		t.Fatalf("expected the instance with the same address to be returned, got %v, %v", old, err)
+	}
+	instances := registry.Lookup(key)
+	if len(instances) != 1 || instances[0] != replaced {
+		t.Fatalf("expected re-registration of an address to replace its instance, got %v", instances)
+	}
+
+	if removed := registry.Remove(key); len(removed) != 1 {
+		t.Fatalf("expected 1 removed instance, got %v", removed)
+	}
+	if instances := registry.Lookup(key); len(instances) != 0 {
+		t.Fatalf("expected task to be gone, got %v", instances)
+	}
+	if removed := registry.Remove(key); len(removed) != 0 {
+		t.Fatalf("expected second remove to miss, got %v", removed)
+	}
+}
+
+func TestMemoryRegistryInstances(t *testing.T) {
+	registry := NewMemoryRegistry()
+	key := NewTaskKey("task", "p1", "")
+	a1 := &SignupTask{TaskId: "task", PartyId: "p1", Address: "a1"}
+	a2 := &SignupTask{TaskId: "task", PartyId: "p1", Address: "a2"}
+	a3 := &SignupTask{TaskId: "task", PartyId: "p1", Address: "a3"}
+	registry.Register(a1)
+	registry.Register(a2)
+	registry.Register(a3)
+
+	if instances := registry.Lookup(key); len(instances) != 3 || instances[0] != a1 || instances[2] != a3 {
+		t.Fatalf("expected 3 instances in registration order, got %v", instances)
+	}
+
+	if removed, ok := registry.RemoveInstance(key, "a2"); !ok || removed != a2 {
+		t.Fatalf("expected a2 to be removed, got %v", removed)
+	}
+	if _, ok := registry.RemoveInstance(key, "a2"); ok {
+		t.Fatal("expected second remove of a2 to miss")
+	}
+	if !registry.Delete(a1) {
+		t.Fatal("expected a1 to be deleted")
+	}
+	if registry.Delete(&SignupTask{TaskId: "task", PartyId: "p1", Address: "a3"}) {
+		t.Fatal("expected delete of an unregistered instance to miss")
+	}
+	if instances := registry.Lookup(key); len(instances) != 1 || instances[0] != a3 {
+		t.Fatalf("expected only a3 to be left, got %v", instances)
+	}
+}
+
+func TestMemoryRegistryOwner(t *testing.T) {
+	registry := NewMemoryRegistry()
+	key := NewTaskKey("task", "p1", "")
+	owned := &SignupTask{TaskId: "task", PartyId: "p1", Address: "a1", Owner: "task-p1"}
+	if _, err := registry.Register(owned); err != nil {
+		t.Fatal(err)
+	}
+
+	// 其他注册者不能替换或增加实例
+	for _, address := range []string{"a1", "a2"} {
+		hijack := &SignupTask{TaskId: "task", PartyId: "p1", Address: address, Owner: "task-p2"}
+		if _, err := registry.Register(hijack); err != ErrTaskOwned {
+			t.Fatalf("expected ErrTaskOwned, got %v", err)
+		}
+	}
+	if _, err := registry.Register(&SignupTask{TaskId: "task", PartyId: "p1", Address: "a2"}); err != ErrTaskOwned {
+		t.Fatalf("expected an anonymous registration to be rejected, got %v", err)
+	}
+
+	replica := &SignupTask{TaskId: "task", PartyId: "p1", Address: "a2", Owner: "task-p1"}
+	if _, err := registry.Register(replica); err != nil {
+		t.Fatalf("expected the owner to add an instance, got %v", err)
+	}
+	if instances := registry.Lookup(key); len(instances) != 2 || instances[0] != owned || instances[1] != replica {
+		t.Fatalf("expected the instances of the owner only, got %v", instances)
+	}
+}
+
+func TestMemoryRegistryServiceType(t *testing.T) {
+	registry := NewMemoryRegistry()
+	registry.Register(&SignupTask{TaskId: "task", PartyId: "p1", Address: "a1"})
+	registry.Register(&SignupTask{TaskId: "task", PartyId: "p1", ServiceType: "data", Address: "a2"})
+
+	if instances := registry.Lookup(NewTaskKey("task", "p1", DefaultServiceType)); len(instances) != 1 || instances[0].Address != "a1" {
+		t.Fatalf("expected a task without service type to be registered as the default, got %v", instances)
+	}
+	if instances := registry.Lookup(NewTaskKey("task", "p1", "data")); len(instances) != 1 || instances[0].Address != "a2" {
+		t.Fatalf("expected the data service, got %v", instances)
+	}
+	if n := len(registry.List()); n != 2 {
+		t.Fatalf("expected 2 tasks, got %d", n)
+	}
+}
+
+func TestMemoryRegistryRemoveTask(t *testing.T) {
+	registry := NewMemoryRegistry()
+	registry.Register(&SignupTask{TaskId: "task1", PartyId: "p1"})
+	registry.Register(&SignupTask{TaskId: "task1", PartyId: "p2"})
+	registry.Register(&SignupTask{TaskId: "task2", PartyId: "p1"})
+
+	if n := len(registry.RemoveTask("task1")); n != 2 {
+		t.Fatalf("expected 2 removed parties, got %d", n)
+	}
+	if tasks := registry.List(); len(tasks) != 1 || tasks[0].TaskId != "task2" {
+		t.Fatalf("expected only task2 to be left, got %v", tasks)
+	}
+}
+
+// Run with -race.
+func TestMemoryRegistryConcurrent(t *testing.T) {
+	registry := NewMemoryRegistry()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			key := NewTaskKey("task", fmt.Sprintf("party_%d", i%10), "")
+			address := fmt.Sprintf("address_%d", i%3)
+			for j := 0; j < 100; j++ {
+				task := &SignupTask{TaskId: key.TaskId, PartyId: key.PartyId, Address: address}
+				registry.Register(task)
+				registry.Lookup(key)
+				registry.List()
+				switch j % 10 {
+				case 0:
+					registry.Remove(key)
+				case 5:
+					registry.RemoveInstance(key, address)
+				case 7:
+					registry.Delete(task)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestMemoryRegistryWatch(t *testing.T) {
+	registry := NewMemoryRegistry()
+	existing := &SignupTask{TaskId: "task", PartyId: "p1", Address: "a1"}
+	registry.Register(existing)
+
+	tasks, watch := registry.Watch()
+	defer watch.Stop()
+	if len(tasks) != 1 || tasks[0] != existing {
+		t.Fatalf("expected the snapshot to hold the registered instance, got %v", tasks)
+	}
+
+	added := &SignupTask{TaskId: "task", PartyId: "p2", Address: "a2"}
+	updated := &SignupTask{TaskId: "task", PartyId: "p1", Address: "a1"}
+	registry.Register(added)
+	registry.Register(updated)
+	registry.RemoveTask("task")
+
+	expected := []RegistryEvent{{TaskAdded, added}, {TaskUpdated, updated}}
+	for _, event := range expected {
+		if actual := <-watch.Events(); actual != event {
+			t.Fatalf("expected %v %v, got %v %v", event.Type, event.Task, actual.Type, actual.Task)
+		}
+	}
+	removed := map[*SignupTask]bool{}
+	for i := 0; i < 2; i++ {
+		event := <-watch.Events()
+		if event.Type != TaskRemoved {
+			t.Fatalf("expected a removed event, got %v", event.Type)
+		}
+		removed[event.Task] = true
+	}
+	if !removed[added] || !removed[updated] {
+		t.Fatalf("expected both instances removed, got %v", removed)
+	}
+
+	watch.Stop()
+	if _, ok := <-watch.Events(); ok || !watch.Stopped() {
+		t.Fatal("expected the stopped watch to be closed")
+	}
+}
+
+func TestMemoryRegistryWatchOverflow(t *testing.T) {
+	registry := NewMemoryRegistry()
+	_, watch := registry.Watch()
+	defer watch.Stop()
+	for i := 0; i <= watchBuffer; i++ {
+		registry.Register(&SignupTask{TaskId: "task", PartyId: fmt.Sprintf("p%d", i)})
+	}
+	for range watch.Events() {
+	}
+	if watch.Stopped() {
+		t.Fatal("expected the watch falling behind to be closed without being stopped")
+	}
+}
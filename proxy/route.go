@@ -0,0 +1,188 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"google.golang.org/grpc"
+)
+
+// MetadataHopCountKey carries the number of VIAs a call has been forwarded through. Every VIA forwarding the
+// call to a remote VIA increments it and refuses to forward a call that already made MaxHops hops, so a routing
+// loop between VIAs can not forward a call forever.
+const MetadataHopCountKey = "via-hop-count"
+
+// DefaultMaxHops is the maximum number of VIA hops used when a RouteTable doesn't configure one.
+const DefaultMaxHops = 8
+
+// Route forwards the calls to a party, or to every party whose id starts with a prefix, to a remote VIA.
+type Route struct {
+	PartyId       string //精确匹配的参与方id
+	PartyIdPrefix string //参与方id前缀，PartyId为空时使用
+	Address       string //下一跳VIA的地址,ip:port
+}
+
+// RouteTable resolves the remote VIA owning a party that isn't registered locally and keeps one connection per
+// remote VIA. An exact party id route wins over the prefix routes, and the longest matching prefix wins among
+// those.
+type RouteTable struct {
+	maxHops  int
+	exact    map[string]string
+	prefixes []Route //按前缀长度从长到短排序
+	dialOpts []grpc.DialOption
+	local    []string //本VIA的监听地址，指向它们的路由不转发
+
+	mu    sync.Mutex
+	conns map[string]*grpc.ClientConn
+}
+
+// NewRouteTable returns a RouteTable dialing the remote VIAs with dialOpts. The proxy codec is always added to
+// the dial options. maxHops <= 0 uses DefaultMaxHops.
+func NewRouteTable(routes []Route, maxHops int, dialOpts ...grpc.DialOption) (*RouteTable, error) {
+	if maxHops <= 0 {
+		maxHops = DefaultMaxHops
+	}
+	table := &RouteTable{
+		maxHops:  maxHops,
+		exact:    make(map[string]string),
+		dialOpts: append([]grpc.DialOption{grpc.WithDefaultCallOptions(grpc.ForceCodec(Codec()))}, dialOpts...),
+		conns:    make(map[string]*grpc.ClientConn),
+	}
+	for i, route := range routes {
+		if route.Address == "" {
+			return nil, fmt.Errorf("route %d: address is required", i)
+		}
+		switch {
+		case route.PartyId != "" && route.PartyIdPrefix != "":
+			return nil, fmt.Errorf("route %d: only one of partyId and partyIdPrefix can be set", i)
+		case route.PartyId != "":
+			if _, exists := table.exact[route.PartyId]; exists {
+				return nil, fmt.Errorf("route %d: duplicated route for party %s", i, route.PartyId)
+			}
+			table.exact[route.PartyId] = route.Address
+		case route.PartyIdPrefix != "":
+			table.prefixes = append(table.prefixes, route)
+		default:
+			return nil, fmt.Errorf("route %d: partyId or partyIdPrefix is required", i)
+		}
+	}
+	// 插入排序，保证最长前缀优先匹配，相同长度时保持配置顺序
+	for i := 1; i < len(table.prefixes); i++ {
+		for j := i; j > 0 && len(table.prefixes[j].PartyIdPrefix) > len(table.prefixes[j-1].PartyIdPrefix); j-- {
+			table.prefixes[j], table.prefixes[j-1] = table.prefixes[j-1], table.prefixes[j]
+		}
+	}
+	return table, nil
+}
+
+// MaxHops returns the maximum number of VIAs a call can be forwarded through.
+func (t *RouteTable) MaxHops() int {
+	return t.maxHops
+}
+
+// SetLocal sets the listen addresses of this VIA. The director refuses to forward a call whose route points to one
+// of them, e.g. the entry of a local party in a shared party directory, instead of forwarding it to itself until
+// the hop limit. Call it before the table is used.
+func (t *RouteTable) SetLocal(addresses ...string) {
+	t.local = addresses
+}
+
+// IsLocal reports whether address is one of the listen addresses set with SetLocal. A listener on all the
+// interfaces matches the loopback and interface addresses of this host with the same port.
+func (t *RouteTable) IsLocal(address string) bool {
+	for _, listen := range t.local {
+		if sameListener(address, listen) {
+			return true
+		}
+	}
+	return false
+}
+
+// sameListener 判断address是否指向监听地址listen
+func sameListener(address, listen string) bool {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return address == listen
+	}
+	listenHost, listenPort, err := net.SplitHostPort(listen)
+	if err != nil || port != listenPort {
+		return address == listen
+	}
+	if host == listenHost {
+		return true
+	}
+	ip := parseHost(host)
+	if ip == nil {
+		return false
+	}
+	listenIP := parseHost(listenHost)
+	switch {
+	case listenHost == "" || listenIP != nil && listenIP.IsUnspecified():
+		//监听所有地址时，本机的任何地址都指向它
+		return ip.IsLoopback() || ip.IsUnspecified() || isInterfaceIP(ip)
+	case listenIP != nil:
+		return ip.Equal(listenIP) || ip.IsLoopback() && listenIP.IsLoopback()
+	}
+	return false
+}
+
+// parseHost 解析地址中的IP，localhost作为回环地址
+func parseHost(host string) net.IP {
+	if host == "localhost" {
+		return net.IPv4(127, 0, 0, 1)
+	}
+	return net.ParseIP(host)
+}
+
+func isInterfaceIP(ip net.IP) bool {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Resolve returns the address of the remote VIA the calls to partyId are forwarded to.
+func (t *RouteTable) Resolve(partyId string) (string, bool) {
+	if address, ok := t.exact[partyId]; ok {
+		return address, true
+	}
+	for _, route := range t.prefixes {
+		if strings.HasPrefix(partyId, route.PartyIdPrefix) {
+			return route.Address, true
+		}
+	}
+	return "", false
+}
+
+// Conn returns the connection to the remote VIA at address, dialing it on first use.
+func (t *RouteTable) Conn(address string) (*grpc.ClientConn, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if conn, ok := t.conns[address]; ok {
+		return conn, nil
+	}
+	conn, err := grpc.Dial(address, t.dialOpts...)
+	if err != nil {
+		return nil, err
+	}
+	t.conns[address] = conn
+	return conn, nil
+}
+
+// Close closes the connections to the remote VIAs.
+func (t *RouteTable) Close() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for address, conn := range t.conns {
+		conn.Close()
+		delete(t.conns, address)
+	}
+}
@@ -0,0 +1,133 @@
+package proxy
+
+import (
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestRouteTableResolve(t *testing.T) {
+	table, err := NewRouteTable([]Route{
+		{PartyIdPrefix: "bank_", Address: "via-bank"},
+		{PartyIdPrefix: "bank_sh_", Address: "via-bank-sh"},
+		{PartyId: "bank_sh_1", Address: "via-bank-sh-1"},
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := map[string]string{
+		"bank_sh_1": "via-bank-sh-1",
+		"bank_sh_2": "via-bank-sh",
+		"bank_bj_1": "via-bank",
+	}
+	for partyId, expected := range cases {
+		if address, ok := table.Resolve(partyId); !ok || address != expected {
+			t.Errorf("party %s: expected %s, got %s", partyId, expected, address)
+		}
+	}
+	if address, ok := table.Resolve("insurer_1"); ok {
+		t.Errorf("expected no route for insurer_1, got %s", address)
+	}
+	if table.MaxHops() != DefaultMaxHops {
+		t.Errorf("expected default max hops, got %d", table.MaxHops())
+	}
+}
+
+func TestRouteTableInvalid(t *testing.T) {
+	invalid := [][]Route{
+		{{PartyId: "p1"}},
+		{{Address: "via"}},
+		{{PartyId: "p1", PartyIdPrefix: "p", Address: "via"}},
+		{{PartyId: "p1", Address: "via1"}, {PartyId: "p1", Address: "via2"}},
+	}
+	for _, routes := range invalid {
+		if _, err := NewRouteTable(routes, 0); err == nil {
+			t.Errorf("expected routes %v to be invalid", routes)
+		}
+	}
+}
+
+func TestProxyMultiHop(t *testing.T) {
+	// VIA2后面有task服务，VIA1通过路由把调用转发给VIA2
+	registry2 := NewMemoryRegistry()
+	registry2.Register(&SignupTask{TaskId: "task", PartyId: "remote_party", Conn: startBackend(t, tagHandler("via2:"))})
+	via2 := serveProxy(t, registry2)
+
+	routes := mustRouteTable(t, []Route{{PartyIdPrefix: "remote_", Address: via2}}, 0)
+	via1 := startProxy(t, NewMemoryRegistry(), WithRoutes(routes))
+
+	got, err := echo(context.Background(), via1, "task", "remote_party", []byte("ping"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "via2:ping" {
+		t.Fatalf("expected the call to reach the task behind VIA2, got %q", got)
+	}
+
+	if _, err := echo(context.Background(), via1, "task", "unknown_party", []byte("ping")); err == nil {
+		t.Fatal("expected a call to an unrouted party to fail")
+	}
+}
+
+func TestProxyRoutingLoop(t *testing.T) {
+	// VIA1和VIA2互相把对方作为remote_前缀的下一跳，调用在两者之间循环，直到超过最大跳数
+	address1, lis1 := listenBuf()
+	address2, lis2 := listenBuf()
+	routes1 := mustRouteTable(t, []Route{{PartyIdPrefix: "remote_", Address: address2}}, 3)
+	routes2 := mustRouteTable(t, []Route{{PartyIdPrefix: "remote_", Address: address1}}, 3)
+	serveOn(t, newProxyServer(NewMemoryRegistry(), WithRoutes(routes1)), lis1)
+	serveOn(t, newProxyServer(NewMemoryRegistry(), WithRoutes(routes2)), lis2)
+
+	_, err := echo(context.Background(), dialBuf(t, address1), "task", "remote_party", []byte("ping"))
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("expected the routing loop to be stopped, got %v", err)
+	}
+}
+
+func TestRouteTableIsLocal(t *testing.T) {
+	table := mustRouteTable(t, nil, 0)
+	table.SetLocal(":10031", "127.0.0.1:10041")
+	cases := map[string]bool{
+		"127.0.0.1:10031": true,
+		"localhost:10031": true,
+		"0.0.0.0:10031":   true,
+		"127.0.0.1:10041": true,
+		"localhost:10041": true,
+		"127.0.0.1:20031": false,
+		"192.0.2.1:10031": false,
+		"10.0.0.1:10041":  false,
+		"via2:10031":      false,
+	}
+	for address, expected := range cases {
+		if table.IsLocal(address) != expected {
+			t.Errorf("address %s: expected local %v", address, expected)
+		}
+	}
+}
+
+func TestProxyRefusesRouteToSelf(t *testing.T) {
+	// 共用的参与方目录中本VIA的参与方指向本VIA，参与方未注册时直接拒绝，而不是转发给自己
+	address, lis := listenBuf()
+	routes := mustRouteTable(t, []Route{{PartyId: "local_party", Address: address}}, 3)
+	routes.SetLocal(address)
+	serveOn(t, newProxyServer(NewMemoryRegistry(), WithRoutes(routes)), lis)
+
+	_, err := echo(context.Background(), dialBuf(t, address), "task", "local_party", []byte("ping"))
+	if status.Code(err) != codes.FailedPrecondition || !strings.Contains(err.Error(), "routes to this VIA") {
+		t.Fatalf("expected the route to this VIA to be refused, got %v", err)
+	}
+}
+
+func mustRouteTable(t *testing.T, routes []Route, maxHops int) *RouteTable {
+	table, err := NewRouteTable(routes, maxHops, grpc.WithContextDialer(bufDialer), grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(table.Close)
+	return table
+}
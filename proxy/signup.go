@@ -0,0 +1,199 @@
+package proxy
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// Metadata of the HMAC token authenticating the registration calls of a task service. The token is the hex
+// HMAC-SHA256, keyed by the secret of the key id, of the timestamp, the nonce and the SignupClaims of the call,
+// see SignupToken. A token is accepted once.
+const (
+	MetadataSignupKeyIdKey     = "via-signup-key-id"
+	MetadataSignupTimestampKey = "via-signup-timestamp" //unix秒
+	MetadataSignupNonceKey     = "via-signup-nonce"     //每个token不同的随机数
+	MetadataSignupTokenKey     = "via-signup-token"
+)
+
+// SignupClaims is the registration call a signup token is signed for, so the token can't be reused for another
+// call, party or address.
+type SignupClaims struct {
+	Method      string //注册服务的完整方法名，如/via.VIAService/Signup
+	TaskId      string
+	PartyId     string //EndTask时为空
+	ServiceType string //请求中的serviceType，没有时为空
+	Address     string //请求中task服务的地址，没有时为空
+}
+
+// DefaultSignupTokenMaxAge is how far the timestamp of a signup token may be from the clock of VIA.
+const DefaultSignupTokenMaxAge = 5 * time.Minute
+
+// SignupSecret is a shared secret task services sign their registration calls with. It may only register the
+// PartyIds, or any party if PartyIds is empty.
+type SignupSecret struct {
+	KeyId    string
+	Secret   string
+	PartyIds []string
+}
+
+// SignupAuthenticator authenticates the registration calls (Signup, Unregister, EndTask) of the task services, by
+// the identity in their client certificate, by an HMAC token in their metadata, or by both. The authenticated
+// identity, or else the key id of the token, is the owner of the task services the caller registers.
+type SignupAuthenticator struct {
+	authorizer *Authorizer             //按证书身份认证，为nil时不校验证书
+	secrets    map[string]SignupSecret //按HMAC token认证，为空时不校验token
+	maxAge     time.Duration
+	now        func() time.Time
+
+	mu    sync.Mutex
+	used  map[string]time.Time //已使用的token及其过期时间，过期前再次使用时拒绝
+	swept time.Time
+}
+
+// NewSignupAuthenticator returns a SignupAuthenticator requiring the caller certificate to be allowed by
+// authorizer, if not nil, and a valid token of one of secrets, if any. maxAge bounds the clock skew of tokens,
+// 0 means DefaultSignupTokenMaxAge.
+func NewSignupAuthenticator(authorizer *Authorizer, secrets []SignupSecret, maxAge time.Duration) (*SignupAuthenticator, error) {
+	if authorizer == nil && len(secrets) == 0 {
+		return nil, fmt.Errorf("signup authentication requires identity rules or secrets")
+	}
+	if maxAge <= 0 {
+		maxAge = DefaultSignupTokenMaxAge
+	}
+	a := &SignupAuthenticator{authorizer: authorizer, secrets: make(map[string]SignupSecret), maxAge: maxAge, now: time.Now,
+		used: make(map[string]time.Time)}
+	for _, secret := range secrets {
+		if len(secret.KeyId) == 0 || len(secret.Secret) == 0 {
+			return nil, fmt.Errorf("signup secret requires a key id and a secret")
+		}
+		if _, ok := a.secrets[secret.KeyId]; ok {
+			return nil, fmt.Errorf("duplicate signup key id %s", secret.KeyId)
+		}
+		a.secrets[secret.KeyId] = secret
+	}
+	return a, nil
+}
+
+// Authenticate returns the owner of the registration call claims of ctx for the task service of key. A nil key,
+// e.g. for EndTask, authenticates the caller without checking which parties it may register. The token of the
+// call must be signed for claims and not used before. It returns an Unauthenticated or PermissionDenied error if
+// the caller can't be authenticated.
+func (a *SignupAuthenticator) Authenticate(ctx context.Context, claims SignupClaims, key *TaskKey) (string, error) {
+	var owner string
+	if a.authorizer != nil {
+		identity, err := a.authorizer.Identity(ctx, key)
+		if err != nil {
+			return "", err
+		}
+		owner = identity
+	}
+	if len(a.secrets) > 0 {
+		keyId, err := a.verifyToken(ctx, claims, key)
+		if err != nil {
+			return "", err
+		}
+		if len(owner) == 0 {
+			owner = keyId
+		}
+	}
+	return owner, nil
+}
+
+// verifyToken 校验metadata中的HMAC token，返回其key id
+func (a *SignupAuthenticator) verifyToken(ctx context.Context, claims SignupClaims, key *TaskKey) (string, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	keyId, timestamp, token := first(md, MetadataSignupKeyIdKey), first(md, MetadataSignupTimestampKey), first(md, MetadataSignupTokenKey)
+	nonce := first(md, MetadataSignupNonceKey)
+	if len(keyId) == 0 || len(timestamp) == 0 || len(nonce) == 0 || len(token) == 0 {
+		return "", status.Errorf(codes.Unauthenticated, "signup token is required")
+	}
+	secret, ok := a.secrets[keyId]
+	if !ok {
+		return "", status.Errorf(codes.Unauthenticated, "unknown signup key id %s", keyId)
+	}
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return "", status.Errorf(codes.Unauthenticated, "invalid %s: %s", MetadataSignupTimestampKey, timestamp)
+	}
+	now := a.now()
+	if skew := now.Sub(time.Unix(unix, 0)); skew > a.maxAge || skew < -a.maxAge {
+		return "", status.Errorf(codes.Unauthenticated, "signup token expired")
+	}
+	expected := SignupToken(secret.Secret, unix, nonce, claims)
+	if !hmac.Equal([]byte(token), []byte(expected)) {
+		return "", status.Errorf(codes.Unauthenticated, "invalid signup token")
+	}
+	//时间戳超过maxAge的token已被拒绝，只需要记住maxAge内使用过的token
+	if !a.use(token, time.Unix(unix, 0).Add(a.maxAge), now) {
+		return "", status.Errorf(codes.Unauthenticated, "signup token already used")
+	}
+	if key != nil && !matches(secret.PartyIds, key.PartyId) {
+		return "", status.Errorf(codes.PermissionDenied, "signup key %s is not allowed to register party %s", keyId, key.PartyId)
+	}
+	return keyId, nil
+}
+
+// use 记录token已被使用，token在expiry之前已被使用过时返回false
+func (a *SignupAuthenticator) use(token string, expiry, now time.Time) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if now.Sub(a.swept) >= a.maxAge {
+		a.swept = now
+		for used, usedExpiry := range a.used {
+			if now.After(usedExpiry) {
+				delete(a.used, used)
+			}
+		}
+	}
+	if usedExpiry, ok := a.used[token]; ok && !now.After(usedExpiry) {
+		return false
+	}
+	a.used[token] = expiry
+	return true
+}
+
+func first(md metadata.MD, key string) string {
+	if values := md.Get(key); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// SignupToken returns the HMAC token of the registration call claims at the unix time timestamp with nonce.
+func SignupToken(secret string, timestamp int64, nonce string, claims SignupClaims) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d\n", timestamp)
+	//每个字段带有长度，字段之间不能互相拼接
+	for _, field := range []string{nonce, claims.Method, claims.TaskId, claims.PartyId, claims.ServiceType, claims.Address} {
+		fmt.Fprintf(mac, "%d:%s\n", len(field), field)
+	}
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// WithSignupToken returns ctx with the outgoing metadata authenticating the registration call claims with the
+// secret of keyId. Every call needs its own token, a token is only accepted once.
+func WithSignupToken(ctx context.Context, keyId, secret string, claims SignupClaims) context.Context {
+	timestamp := time.Now().Unix()
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		panic(fmt.Errorf("failed to generate the signup nonce: %v", err))
+	}
+	nonceHex := hex.EncodeToString(nonce)
+	return metadata.AppendToOutgoingContext(ctx,
+		MetadataSignupKeyIdKey, keyId,
+		MetadataSignupTimestampKey, strconv.FormatInt(timestamp, 10),
+		MetadataSignupNonceKey, nonceHex,
+		MetadataSignupTokenKey, SignupToken(secret, timestamp, nonceHex, claims),
+	)
+}
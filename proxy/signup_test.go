@@ -0,0 +1,156 @@
+package proxy
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const testSignupMethod = "/via.VIAService/Signup"
+
+// signupClaims 返回注册taskId/partyId的claims
+func signupClaims(taskId, partyId string) SignupClaims {
+	return SignupClaims{Method: testSignupMethod, TaskId: taskId, PartyId: partyId, Address: "127.0.0.1:10040"}
+}
+
+// incomingToken 把客户端的outgoing token转成VIA收到的incoming metadata
+func incomingToken(ctx context.Context, keyId, secret string, claims SignupClaims) context.Context {
+	md, _ := metadata.FromOutgoingContext(WithSignupToken(context.Background(), keyId, secret, claims))
+	return metadata.NewIncomingContext(ctx, md)
+}
+
+func TestSignupAuthenticatorToken(t *testing.T) {
+	a, err := NewSignupAuthenticator(nil, []SignupSecret{
+		{KeyId: "k1", Secret: "s1", PartyIds: []string{"p1"}},
+		{KeyId: "k2", Secret: "s2"},
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := NewTaskKey("task", "p1", "")
+	claims := signupClaims("task", "p1")
+
+	owner, err := a.Authenticate(incomingToken(context.Background(), "k1", "s1", claims), claims, &key)
+	if err != nil || owner != "k1" {
+		t.Fatalf("expected k1 to own the task, got %q, %v", owner, err)
+	}
+	endTask := SignupClaims{Method: "/via.VIAService/EndTask", TaskId: "task"}
+	if _, err := a.Authenticate(incomingToken(context.Background(), "k2", "s2", endTask), endTask, nil); err != nil {
+		t.Fatalf("expected the EndTask token to be valid, got %v", err)
+	}
+
+	moved := claims
+	moved.Address = "10.0.0.1:10040"
+	unregister := claims
+	unregister.Method = "/via.VIAService/Unregister"
+	dataService := claims
+	dataService.ServiceType = "data"
+	cases := []struct {
+		ctx  context.Context
+		code codes.Code
+	}{
+		{context.Background(), codes.Unauthenticated},
+		{incomingToken(context.Background(), "k1", "wrong", claims), codes.Unauthenticated},
+		{incomingToken(context.Background(), "k3", "s1", claims), codes.Unauthenticated},
+		// token是为其他参与方、其他地址、其他方法或其他服务类型签发的
+		{incomingToken(context.Background(), "k2", "s2", signupClaims("task", "p2")), codes.Unauthenticated},
+		{incomingToken(context.Background(), "k2", "s2", moved), codes.Unauthenticated},
+		{incomingToken(context.Background(), "k2", "s2", unregister), codes.Unauthenticated},
+		{incomingToken(context.Background(), "k2", "s2", dataService), codes.Unauthenticated},
+	}
+	for i, c := range cases {
+		if _, err := a.Authenticate(c.ctx, claims, &key); status.Code(err) != c.code {
+			t.Errorf("case %d: expected %v, got %v", i, c.code, err)
+		}
+	}
+
+	other := NewTaskKey("task", "p2", "")
+	if _, err := a.Authenticate(incomingToken(context.Background(), "k1", "s1", signupClaims("task", "p2")), signupClaims("task", "p2"), &other); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("expected k1 not to register p2, got %v", err)
+	}
+
+	// 过期的token
+	a.now = func() time.Time { return time.Now().Add(time.Hour) }
+	if _, err := a.Authenticate(incomingToken(context.Background(), "k1", "s1", claims), claims, &key); status.Code(err) != codes.Unauthenticated {
+		t.Fatalf("expected the expired token to be rejected, got %v", err)
+	}
+}
+
+func TestSignupAuthenticatorReplay(t *testing.T) {
+	a, err := NewSignupAuthenticator(nil, []SignupSecret{{KeyId: "k1", Secret: "s1"}}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := NewTaskKey("task", "p1", "")
+	claims := signupClaims("task", "p1")
+	ctx := incomingToken(context.Background(), "k1", "s1", claims)
+	if _, err := a.Authenticate(ctx, claims, &key); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Authenticate(ctx, claims, &key); status.Code(err) != codes.Unauthenticated {
+		t.Fatalf("expected the replayed token to be rejected, got %v", err)
+	}
+	// 同一秒内为同一调用签发的另一个token有不同的nonce
+	if _, err := a.Authenticate(incomingToken(context.Background(), "k1", "s1", claims), claims, &key); err != nil {
+		t.Fatalf("expected a new token for the same call to be accepted, got %v", err)
+	}
+
+	// 过期的token被清理，不会一直占用内存
+	now := time.Now()
+	a.now = func() time.Time { return now.Add(2 * time.Minute) }
+	a.use("fresh", now.Add(3*time.Minute), now.Add(2*time.Minute))
+	if len(a.used) != 1 {
+		t.Fatalf("expected only the unexpired token to be kept, got %d", len(a.used))
+	}
+}
+
+func TestSignupAuthenticatorIdentity(t *testing.T) {
+	authorizer, err := NewAuthorizer(IdentityCommonName, []AccessRule{{Identity: "io-p1", PartyIds: []string{"p1"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := NewSignupAuthenticator(authorizer, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := NewTaskKey("task", "p1", "")
+	if owner, err := a.Authenticate(peerContext("io-p1", ""), signupClaims("task", "p1"), &key); err != nil || owner != "io-p1" {
+		t.Fatalf("expected io-p1 to own the task, got %q, %v", owner, err)
+	}
+	if _, err := a.Authenticate(peerContext("io-p2", ""), signupClaims("task", "p1"), &key); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("expected io-p2 to be denied, got %v", err)
+	}
+	if _, err := a.Authenticate(context.Background(), signupClaims("task", "p1"), &key); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("expected a caller without certificate to be denied, got %v", err)
+	}
+}
+
+func TestSignupToken(t *testing.T) {
+	claims := signupClaims("task", "p1")
+	token := SignupToken("secret", 1600000000, "nonce", claims)
+	if token != SignupToken("secret", 1600000000, "nonce", claims) {
+		t.Fatal("expected the token to be deterministic")
+	}
+	// 字段之间有长度和分隔符，task/p1不能拼成tas/kp1
+	shifted := claims
+	shifted.TaskId, shifted.PartyId = "tas", "kp1"
+	for _, other := range []string{
+		SignupToken("secret", 1600000001, "nonce", claims),
+		SignupToken("secret", 1600000000, "nonce2", claims),
+		SignupToken("secret", 1600000000, "nonce", signupClaims("task", "p2")),
+		SignupToken("other", 1600000000, "nonce", claims),
+		SignupToken("secret", 1600000000, "nonce", shifted),
+	} {
+		if other == token {
+			t.Fatalf("expected a different token, got %s", other)
+		}
+	}
+	if _, err := strconv.ParseUint(token[:8], 16, 64); err != nil || len(token) != 64 {
+		t.Fatalf("expected a hex sha256 token, got %s", token)
+	}
+}
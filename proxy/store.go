@@ -0,0 +1,202 @@
+package proxy
+
+import (
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+
+	"go.etcd.io/bbolt"
+	"google.golang.org/grpc"
+	"via/logging"
+)
+
+// tasksBucket 保存注册记录的bucket，key是taskId/partyId/serviceType/address，value是JSON格式的taskRecord
+var tasksBucket = []byte("tasks")
+
+// taskRecord 是一个注册的task服务实例在数据库中的记录，重启后用来重新拨号和注册
+type taskRecord struct {
+	TaskId      string    `json:"task_id"`
+	PartyId     string    `json:"party_id"`
+	ServiceType string    `json:"service_type"`
+	Address     string    `json:"address"`
+	LeaseId     string    `json:"lease_id,omitempty"`
+	Owner       string    `json:"owner,omitempty"`
+	Registered  time.Time `json:"registered"`
+}
+
+func recordKey(task *SignupTask) []byte {
+	key := task.Key()
+	return []byte(strings.Join([]string{key.TaskId, key.PartyId, key.ServiceType, task.Address}, "\x00"))
+}
+
+// PersistentRegistry is a Registry keeping its instances in memory, like NewMemoryRegistry, and storing them in
+// a bbolt database file, so the instances registered before VIA restarted can be restored with Restore.
+type PersistentRegistry struct {
+	*memoryRegistry
+	db *bbolt.DB
+
+	//写操作先修改内存再写数据库，两步之间不能交错，否则数据库和内存可能不一致
+	writeMu sync.Mutex
+}
+
+// NewPersistentRegistry opens, or creates, the database file of a PersistentRegistry. The registry starts empty;
+// call Restore to register the stored instances again.
+func NewPersistentRegistry(file string) (*PersistentRegistry, error) {
+	db, err := bbolt.Open(file, 0600, &bbolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Update(func(tx *bbolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(tasksBucket)
+		return err
+	}); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &PersistentRegistry{memoryRegistry: NewMemoryRegistry().(*memoryRegistry), db: db}, nil
+}
+
+// Restore registers the stored instances again, with the connections dial returns for their addresses, and
+// returns them. The instances are dialed concurrently; dial should only return once the task server is reachable,
+// e.g. with a blocking dial and a timeout, since the instances that fail to dial are dropped from the database.
+func (r *PersistentRegistry) Restore(dial func(address string) (*grpc.ClientConn, error)) ([]*SignupTask, error) {
+	var records []taskRecord
+	if err := r.db.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket(tasksBucket).ForEach(func(k, v []byte) error {
+			var record taskRecord
+			if err := json.Unmarshal(v, &record); err != nil {
+				logging.Warnf("dropping invalid task record %q: %v", k, err)
+				return nil
+			}
+			records = append(records, record)
+			return nil
+		})
+	}); err != nil {
+		return nil, err
+	}
+
+	//并发拨号，连接不上的task服务不会让VIA启动等待太久
+	tasks := make([]*SignupTask, len(records))
+	errs := make([]error, len(records))
+	var wg sync.WaitGroup
+	for i, record := range records {
+		tasks[i] = &SignupTask{TaskId: record.TaskId, PartyId: record.PartyId, ServiceType: record.ServiceType,
+			Address: record.Address, LeaseId: record.LeaseId, Owner: record.Owner}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			tasks[i].Conn, errs[i] = dial(tasks[i].Address)
+		}(i)
+	}
+	wg.Wait()
+
+	r.writeMu.Lock()
+	defer r.writeMu.Unlock()
+	var restored, failed []*SignupTask
+	for i, task := range tasks {
+		err := errs[i]
+		if err == nil {
+			_, err = r.memoryRegistry.Register(task)
+		}
+		if err != nil {
+			logging.Warnf("failed to restore task server %s, %+v: %v", task.Address, task.Key(), err)
+			if task.Conn != nil {
+				task.Conn.Close()
+			}
+			failed = append(failed, task)
+			continue
+		}
+		restored = append(restored, task)
+	}
+	return restored, r.delete(failed...)
+}
+
+// Close closes the database file.
+func (r *PersistentRegistry) Close() error {
+	return r.db.Close()
+}
+
+func (r *PersistentRegistry) Register(task *SignupTask) (*SignupTask, error) {
+	r.writeMu.Lock()
+	defer r.writeMu.Unlock()
+	replaced, err := r.memoryRegistry.Register(task)
+	if err != nil {
+		return nil, err
+	}
+	//从集群中其他VIA实例同步来的实例不保存，重启后重新从它们同步
+	if task.Origin != "" {
+		return replaced, nil
+	}
+	//内存中的注册已经生效，写数据库失败只影响重启后的恢复
+	if err := r.put(task); err != nil {
+		logging.Errorf("failed to store task server %s, %+v: %v", task.Address, task.Key(), err)
+	}
+	return replaced, nil
+}
+
+func (r *PersistentRegistry) Remove(key TaskKey) []*SignupTask {
+	r.writeMu.Lock()
+	defer r.writeMu.Unlock()
+	return r.deleted(r.memoryRegistry.Remove(key))
+}
+
+func (r *PersistentRegistry) RemoveInstance(key TaskKey, address string) (*SignupTask, bool) {
+	r.writeMu.Lock()
+	defer r.writeMu.Unlock()
+	task, ok := r.memoryRegistry.RemoveInstance(key, address)
+	if ok {
+		r.deleted([]*SignupTask{task})
+	}
+	return task, ok
+}
+
+func (r *PersistentRegistry) Delete(task *SignupTask) bool {
+	r.writeMu.Lock()
+	defer r.writeMu.Unlock()
+	if !r.memoryRegistry.Delete(task) {
+		return false
+	}
+	r.deleted([]*SignupTask{task})
+	return true
+}
+
+func (r *PersistentRegistry) RemoveTask(taskId string) []*SignupTask {
+	r.writeMu.Lock()
+	defer r.writeMu.Unlock()
+	return r.deleted(r.memoryRegistry.RemoveTask(taskId))
+}
+
+// deleted 从数据库中删除已从内存中删除的实例，并原样返回它们
+func (r *PersistentRegistry) deleted(tasks []*SignupTask) []*SignupTask {
+	if err := r.delete(tasks...); err != nil {
+		logging.Errorf("failed to delete %d task records: %v", len(tasks), err)
+	}
+	return tasks
+}
+
+func (r *PersistentRegistry) put(task *SignupTask) error {
+	value, err := json.Marshal(taskRecord{TaskId: task.TaskId, PartyId: task.PartyId, ServiceType: task.ServiceType,
+		Address: task.Address, LeaseId: task.LeaseId, Owner: task.Owner, Registered: time.Now()})
+	if err != nil {
+		return err
+	}
+	return r.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(tasksBucket).Put(recordKey(task), value)
+	})
+}
+
+func (r *PersistentRegistry) delete(tasks ...*SignupTask) error {
+	if len(tasks) == 0 {
+		return nil
+	}
+	return r.db.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(tasksBucket)
+		for _, task := range tasks {
+			if err := bucket.Delete(recordKey(task)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
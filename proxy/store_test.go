@@ -0,0 +1,98 @@
+package proxy
+
+import (
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"google.golang.org/grpc"
+)
+
+func TestPersistentRegistryRestore(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "via.db")
+	registry, err := NewPersistentRegistry(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	registry.Register(&SignupTask{TaskId: "task", PartyId: "p1", Address: "a1", LeaseId: "lease-1", Owner: "owner"})
+	registry.Register(&SignupTask{TaskId: "task", PartyId: "p1", Address: "a2"})
+	registry.Register(&SignupTask{TaskId: "task", PartyId: "p2", ServiceType: "data", Address: "a3"})
+	registry.Register(&SignupTask{TaskId: "other", PartyId: "p1", Address: "a4"})
+	registry.RemoveInstance(NewTaskKey("task", "p1", ""), "a2")
+	registry.RemoveTask("other")
+	if err := registry.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	registry, err = NewPersistentRegistry(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer registry.Close()
+	if tasks := registry.List(); len(tasks) != 0 {
+		t.Fatalf("expected the registry to start empty, got %v", tasks)
+	}
+	var mu sync.Mutex
+	var dialed []string
+	restored, err := registry.Restore(func(address string) (*grpc.ClientConn, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		dialed = append(dialed, address)
+		return dialBuf(t, address), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(restored) != 2 || len(dialed) != 2 {
+		t.Fatalf("expected the 2 remaining instances to be dialed and restored, got %v", restored)
+	}
+
+	instances := registry.Lookup(NewTaskKey("task", "p1", ""))
+	if len(instances) != 1 || instances[0].Address != "a1" || instances[0].LeaseId != "lease-1" ||
+		instances[0].Owner != "owner" || instances[0].Conn == nil {
+		t.Fatalf("unexpected restored instance: %+v", instances)
+	}
+	if instances := registry.Lookup(NewTaskKey("task", "p2", "data")); len(instances) != 1 {
+		t.Fatalf("expected the instance of the data service type to be restored, got %v", instances)
+	}
+	if _, err := registry.Register(&SignupTask{TaskId: "task", PartyId: "p1", Address: "a5", Owner: "intruder"}); err != ErrTaskOwned {
+		t.Fatalf("expected the restored owner to be kept, got %v", err)
+	}
+}
+
+func TestPersistentRegistryRestoreDropsUnreachable(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "via.db")
+	registry, err := NewPersistentRegistry(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	registry.Register(&SignupTask{TaskId: "task", PartyId: "p1", Address: "up"})
+	registry.Register(&SignupTask{TaskId: "task", PartyId: "p2", Address: "down"})
+	registry.Close()
+
+	dial := func(address string) (*grpc.ClientConn, error) {
+		if address == "down" {
+			return nil, errors.New("context deadline exceeded")
+		}
+		return dialBuf(t, address), nil
+	}
+	registry, err = NewPersistentRegistry(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored, err := registry.Restore(dial); err != nil || len(restored) != 1 || restored[0].Address != "up" {
+		t.Fatalf("expected only the reachable instance to be restored, got %v, %v", restored, err)
+	}
+	registry.Close()
+
+	// 连接不上的实例已从数据库中删除，下次重启不再拨号
+	registry, err = NewPersistentRegistry(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer registry.Close()
+	if restored, err := registry.Restore(dial); err != nil || len(restored) != 1 {
+		t.Fatalf("expected the unreachable instance to be dropped from the database, got %v, %v", restored, err)
+	}
+}
@@ -0,0 +1,108 @@
+package proxy
+
+import (
+	"sync/atomic"
+
+	"go.opentelemetry.io/otel/attribute"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// Attributes of the span of a proxied stream.
+const (
+	AttributeMethod        = attribute.Key("rpc.method")
+	AttributeStatusCode    = attribute.Key("rpc.grpc.status_code")
+	AttributeTaskId        = attribute.Key("via.task_id")
+	AttributePartyId       = attribute.Key("via.party_id")
+	AttributeServiceType   = attribute.Key("via.service_type")
+	AttributeBackend       = attribute.Key("via.backend")
+	AttributeRequestBytes  = attribute.Key("via.request_bytes")
+	AttributeResponseBytes = attribute.Key("via.response_bytes")
+)
+
+// WithTracer sets the tracer of the span the handler starts for each stream. The span is a child of the W3C
+// traceparent in the incoming metadata, if any, and its context is propagated to the task service or next VIA
+// in the outgoing metadata. Without a tracer the traceparent is forwarded unchanged.
+func WithTracer(tracer trace.Tracer) HandlerOption {
+	return func(h *handler) {
+		h.tracer = tracer
+	}
+}
+
+// traceContext 按W3C Trace Context格式读写metadata中的traceparent和tracestate
+var traceContext = propagation.TraceContext{}
+
+// metadataCarrier 把gRPC metadata作为propagation的carrier
+type metadataCarrier metadata.MD
+
+func (c metadataCarrier) Get(key string) string {
+	return first(metadata.MD(c), key)
+}
+
+func (c metadataCarrier) Set(key, value string) {
+	metadata.MD(c).Set(key, value)
+}
+
+func (c metadataCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for key := range c {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// streamSpan 是一个转发的stream的span
+type streamSpan struct {
+	span trace.Span
+}
+
+// startSpan 从incoming metadata中取出父span，开始stream的span，tracer为nil时返回nil，nil的streamSpan不记录
+func startSpan(tracer trace.Tracer, ctx context.Context, method string) (context.Context, *streamSpan) {
+	if tracer == nil {
+		return ctx, nil
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	parent := traceContext.Extract(ctx, metadataCarrier(md))
+	_, span := tracer.Start(parent, method, trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(
+		AttributeMethod.String(method),
+		AttributeTaskId.String(first(md, MetadataTaskIdKey)),
+		AttributePartyId.String(first(md, MetadataPartyIdKey)),
+		AttributeServiceType.String(first(md, MetadataServiceTypeKey)),
+	))
+	// 只把span放进stream的context，不替换其中的取消和deadline
+	return trace.ContextWithSpan(ctx, span), &streamSpan{span: span}
+}
+
+// inject 把span的上下文写入outgoingCtx的metadata，转发给task服务或下一跳VIA
+func (s *streamSpan) inject(outgoingCtx context.Context, backend string) context.Context {
+	if s == nil {
+		return outgoingCtx
+	}
+	s.span.SetAttributes(AttributeBackend.String(backend))
+	md, _ := metadata.FromOutgoingContext(outgoingCtx)
+	md = md.Copy()
+	traceContext.Inject(trace.ContextWithSpan(outgoingCtx, s.span), metadataCarrier(md))
+	return metadata.NewOutgoingContext(outgoingCtx, md)
+}
+
+// finish 记录stream的结果和转发的字节数，并结束span
+func (s *streamSpan) finish(err error, stats *streamStats) {
+	if s == nil {
+		return
+	}
+	code := status.Code(err)
+	s.span.SetAttributes(
+		AttributeStatusCode.Int(int(code)),
+		AttributeRequestBytes.Int64(atomic.LoadInt64(&stats.requestBytes)),
+		AttributeResponseBytes.Int64(atomic.LoadInt64(&stats.responseBytes)),
+	)
+	if code != codes.OK {
+		s.span.SetStatus(otelcodes.Error, status.Convert(err).Message())
+	}
+	s.span.End()
+}
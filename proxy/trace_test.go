@@ -0,0 +1,98 @@
+package proxy
+
+import (
+	"testing"
+
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+const (
+	testTraceId    = "4bf92f3577b34da6a3ce929d0e0e4736"
+	testParentSpan = "00f067aa0ba902b7"
+)
+
+// traceparentHandler 是测试用的task服务，返回收到的traceparent
+func traceparentHandler(srv interface{}, stream grpc.ServerStream) error {
+	md, _ := metadata.FromIncomingContext(stream.Context())
+	if err := stream.RecvMsg(&frame{}); err != nil {
+		return err
+	}
+	return stream.SendMsg(&frame{payload: []byte(first(md, "traceparent"))})
+}
+
+func startTracedProxy(t *testing.T, registry Registry) (*grpc.ClientConn, *tracetest.SpanRecorder) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	t.Cleanup(func() { provider.Shutdown(context.Background()) })
+	conn := startServer(t, grpc.NewServer(
+		grpc.ForceServerCodec(Codec()),
+		grpc.UnknownServiceHandler(TransparentHandler(GetDirector(registry), WithTracer(provider.Tracer("via/proxy")))),
+	))
+	return conn, recorder
+}
+
+func TestTracePropagation(t *testing.T) {
+	registry := NewMemoryRegistry()
+	registry.Register(&SignupTask{TaskId: "task", PartyId: "partner_1", Address: "backend", Conn: startBackend(t, traceparentHandler)})
+	proxyConn, recorder := startTracedProxy(t, registry)
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "traceparent", "00-"+testTraceId+"-"+testParentSpan+"-01")
+	got, err := echo(ctx, proxyConn, "task", "partner_1", []byte("ping"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	spans := recorder.Ended()
+	if len(spans) != 1 {
+		t.Fatalf("expected one span, got %d", len(spans))
+	}
+	span := spans[0]
+	if span.SpanContext().TraceID().String() != testTraceId || span.Parent().SpanID().String() != testParentSpan {
+		t.Fatalf("expected the span to continue the caller's trace, got %v parent %v", span.SpanContext(), span.Parent())
+	}
+	// task服务收到的traceparent是VIA的span
+	expected := "00-" + testTraceId + "-" + span.SpanContext().SpanID().String() + "-01"
+	if string(got) != expected {
+		t.Fatalf("expected the task to receive traceparent %s, got %s", expected, got)
+	}
+
+	attributes := make(map[string]string)
+	for _, kv := range span.Attributes() {
+		attributes[string(kv.Key)] = kv.Value.Emit()
+	}
+	for key, value := range map[string]string{
+		string(AttributeMethod):        testMethod,
+		string(AttributeTaskId):        "task",
+		string(AttributePartyId):       "partner_1",
+		string(AttributeStatusCode):    "0",
+		string(AttributeRequestBytes):  "4",
+		string(AttributeResponseBytes): "55",
+	} {
+		if attributes[key] != value {
+			t.Errorf("expected %s=%s, got %q", key, value, attributes[key])
+		}
+	}
+	if len(attributes[string(AttributeBackend)]) == 0 {
+		t.Error("expected the backend address attribute")
+	}
+}
+
+func TestTraceRejected(t *testing.T) {
+	proxyConn, recorder := startTracedProxy(t, NewMemoryRegistry())
+	if _, err := echo(context.Background(), proxyConn, "task", "partner_1", []byte("ping")); err == nil {
+		t.Fatal("expected the call to the unregistered task to fail")
+	}
+	spans := recorder.Ended()
+	if len(spans) != 1 || spans[0].Status().Code.String() != "Error" {
+		t.Fatalf("expected an error span for the rejected call, got %v", spans)
+	}
+	// 没有traceparent时开始新的trace
+	if spans[0].Parent().IsValid() || !spans[0].SpanContext().IsValid() || spans[0].SpanKind() != trace.SpanKindServer {
+		t.Fatalf("expected a new root server span, got %v", spans[0].SpanContext())
+	}
+}
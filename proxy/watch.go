@@ -0,0 +1,113 @@
+package proxy
+
+import (
+	"fmt"
+	"sync"
+)
+
+// RegistryEventType is the kind of change of a RegistryEvent.
+type RegistryEventType int
+
+const (
+	// TaskAdded is a new instance of a task service.
+	TaskAdded RegistryEventType = iota
+	// TaskUpdated is an instance registered again, replacing the instance with the same key and address, or an
+	// instance whose health changed.
+	TaskUpdated
+	// TaskRemoved is an instance unregistered, expired or removed with its task.
+	TaskRemoved
+)
+
+func (t RegistryEventType) String() string {
+	switch t {
+	case TaskAdded:
+		return "added"
+	case TaskUpdated:
+		return "updated"
+	case TaskRemoved:
+		return "removed"
+	}
+	return fmt.Sprintf("RegistryEventType(%d)", int(t))
+}
+
+// RegistryEvent is a change of the instances registered in a Registry.
+type RegistryEvent struct {
+	Type RegistryEventType
+	Task *SignupTask
+}
+
+// watchBuffer 是每个watch缓存的事件数，超过时watch被关闭，调用方需要重新watch
+const watchBuffer = 256
+
+// RegistryWatch receives the changes of a Registry after the snapshot returned with it by Registry.Watch.
+type RegistryWatch struct {
+	events   chan RegistryEvent
+	watchers *watchers
+	stopped  bool //由watchers.mu保护
+}
+
+// Events returns the channel of the changes. It is closed when the watch is stopped, or when the watcher can't
+// keep up with the changes, in which case Stopped reports false and the registry should be watched again.
+func (w *RegistryWatch) Events() <-chan RegistryEvent {
+	return w.events
+}
+
+// Stop stops the watch and closes its channel.
+func (w *RegistryWatch) Stop() {
+	w.watchers.stop(w)
+}
+
+// Stopped reports whether the watch was stopped by Stop, rather than closed for falling behind.
+func (w *RegistryWatch) Stopped() bool {
+	w.watchers.mu.Lock()
+	defer w.watchers.mu.Unlock()
+	return w.stopped
+}
+
+// watchers 把Registry的变化广播给所有的watch。
+// notify由Registry在持有写锁时调用，add在持有读锁时调用，保证快照和之后的事件之间没有遗漏
+type watchers struct {
+	mu      sync.Mutex
+	watches map[*RegistryWatch]bool
+}
+
+func (w *watchers) add() *RegistryWatch {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.watches == nil {
+		w.watches = make(map[*RegistryWatch]bool)
+	}
+	watch := &RegistryWatch{events: make(chan RegistryEvent, watchBuffer), watchers: w}
+	w.watches[watch] = true
+	return watch
+}
+
+func (w *watchers) stop(watch *RegistryWatch) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	watch.stopped = true
+	w.remove(watch)
+}
+
+// remove 删除并关闭watch，调用者需持有w.mu
+func (w *watchers) remove(watch *RegistryWatch) {
+	if w.watches[watch] {
+		delete(w.watches, watch)
+		close(watch.events)
+	}
+}
+
+func (w *watchers) notify(eventType RegistryEventType, tasks ...*SignupTask) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, task := range tasks {
+		for watch := range w.watches {
+			select {
+			case watch.events <- RegistryEvent{Type: eventType, Task: task}:
+			default:
+				//不阻塞Registry的写操作，跟不上的watch直接关闭
+				w.remove(watch)
+			}
+		}
+	}
+}
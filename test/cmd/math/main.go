@@ -2,8 +2,6 @@ package main
 
 import (
 	"crypto/rand"
-	"crypto/tls"
-	"crypto/x509"
 	"flag"
 	"fmt"
 	"golang.org/x/net/context"
@@ -12,12 +10,12 @@ import (
 	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/reflection"
 	"io"
-	"io/ioutil"
 	"log"
 	"math/big"
 	"net"
 	"via/conf"
 	"via/proxy"
+	"via/tlsutil"
 
 	"time"
 	"via/test"
@@ -29,8 +27,12 @@ var (
 	localVia   string
 	destVia    string
 	partner    string
+	destParty  string
 	tlsFile    string
 	tlsEnabled = false
+	keyId      string
+	secret     string
+	waitParty  time.Duration
 	commands   map[string]Command
 )
 
@@ -38,14 +40,17 @@ var (
 type Command func(*mathServer) error
 
 const DefaultTaskId string = "testTaskId"
-const DefaultPartyId string = "testPartyId"
 
 func init() {
 	flag.StringVar(&partner, "partner", "partner_1", "partner")
 	flag.StringVar(&address, "address", ":10040", "Math server listen address")
 	flag.StringVar(&localVia, "localVia", ":10031", "local VIA address")
-	flag.StringVar(&destVia, "destVia", ":20031", "dest VIA address")
+	flag.StringVar(&destVia, "destVia", "", "dest VIA address, empty sends the calls to the local VIA which forwards them to the VIA of destPartner")
+	flag.StringVar(&destParty, "destPartner", "partner_2", "partner to call")
 	flag.StringVar(&tlsFile, "tls", "", "TLS config file")
+	flag.StringVar(&keyId, "signupKeyId", "", "key id of the signup secret, required if VIA authenticates signup by token")
+	flag.StringVar(&secret, "signupSecret", "", "signup secret")
+	flag.DurationVar(&waitParty, "waitPartner", time.Minute, "how long to wait for destPartner to sign up, 0 doesn't wait")
 	flag.Parse()
 
 	if len(tlsFile) > 0 {
@@ -67,9 +72,17 @@ type mathServer struct {
 func (s *mathServer) dialDestVIA() {
 	ctx := context.Background()
 	ctx = metadata.AppendToOutgoingContext(ctx, proxy.MetadataTaskIdKey, DefaultTaskId)
-	ctx = metadata.AppendToOutgoingContext(ctx, proxy.MetadataPartyIdKey, DefaultPartyId)
+	ctx = metadata.AppendToOutgoingContext(ctx, proxy.MetadataPartyIdKey, destParty)
+	ctx = metadata.AppendToOutgoingContext(ctx, proxy.MetadataSourcePartyIdKey, partner)
 	s.ctx = ctx
 
+	// 没有指定对方的VIA时，调用都发给本地VIA，由本地VIA转发给对方所在的VIA
+	if len(destVia) == 0 {
+		log.Printf("send the calls to %s through local VIA server: %v", destParty, localVia)
+		s.client = test.NewMathServiceClient(dialLocalVIA())
+		return
+	}
+
 	if tlsEnabled {
 		if conn, err := grpc.Dial(destVia, grpc.WithTransportCredentials(tlsCredentialsAsClient)); err != nil {
 			log.Fatalf("did not connect to dest VIA server: %v", err)
@@ -89,6 +102,9 @@ func (s *mathServer) dialDestVIA() {
 
 func (s *mathServer) Sum_Unary(ctx context.Context, metricList *test.MetricList) (*test.SumResponse, error) {
 	log.Printf("服务(unary)：求列表之和：%v", metricList.Metric)
+	if origin, ok := proxy.ForwardedOrigin(ctx); ok {
+		log.Printf("调用来自：%s，经过：%v", origin.For, origin.Hops)
+	}
 	var sum int64
 	for _, metric := range metricList.Metric {
 		sum += metric
@@ -157,21 +173,61 @@ func (s *mathServer) Sum_BidiStreaming(stream test.MathService_Sum_BidiStreaming
 	}
 }
 
-func signupTask() error {
+func dialLocalVIA() *grpc.ClientConn {
 	log.Printf("dial to local VIA server on %v", localVia)
+	return dialVIA(localVia)
+}
 
+func dialVIA(address string) *grpc.ClientConn {
 	var conn *grpc.ClientConn
 	var err error
 
 	if tlsCredentialsAsClient == nil {
-		conn, err = grpc.Dial(localVia, grpc.WithInsecure())
+		conn, err = grpc.Dial(address, grpc.WithInsecure())
 	} else {
-		conn, err = grpc.Dial(localVia, grpc.WithTransportCredentials(tlsCredentialsAsClient))
+		conn, err = grpc.Dial(address, grpc.WithTransportCredentials(tlsCredentialsAsClient))
 	}
 
 	if err != nil {
-		log.Fatalf("did not connect to local VIA server: %v", err)
+		log.Fatalf("did not connect to VIA server %s: %v", address, err)
 	}
+	return conn
+}
+
+// waitForDestParty 等待对方参与方注册完成，超时后不再等待。没有指定destVia时由本地VIA向对方所在的VIA询问
+func waitForDestParty() {
+	if waitParty <= 0 {
+		return
+	}
+	viaAddress := destVia
+	if len(viaAddress) == 0 {
+		viaAddress = localVia
+	}
+	conn := dialVIA(viaAddress)
+	defer conn.Close()
+
+	log.Printf("waiting for %s to sign up, asking VIA server %s", destParty, viaAddress)
+	//比VIA的等待时间多留一些，以便收到未注册的参与方
+	ctx, cancel := context.WithTimeout(context.Background(), waitParty+5*time.Second)
+	defer cancel()
+	r, err := via.NewVIAServiceClient(conn).WaitForParties(ctx, &via.WaitForPartiesReq{
+		TaskId:        DefaultTaskId,
+		PartyIds:      []string{destParty},
+		TimeoutMillis: waitParty.Milliseconds(),
+	})
+	if err != nil {
+		log.Printf("failed to wait for %s: %v", destParty, err)
+		return
+	}
+	if !r.Result {
+		log.Printf("stopped waiting, not signed up yet: %v", r.MissingPartyIds)
+		return
+	}
+	log.Printf("%s signed up", destParty)
+}
+
+func signupTask() (*via.SignupResp, error) {
+	conn := dialLocalVIA()
 	defer conn.Close()
 
 	log.Printf("signup task to local VIA server %v", localVia)
@@ -180,13 +236,107 @@ func signupTask() error {
 
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
+	req := &via.SignupReq{TaskId: DefaultTaskId, PartyId: partner, Address: address}
+	ctx = withSignupToken(ctx, proxy.SignupClaims{Method: signupMethod, TaskId: req.TaskId, PartyId: req.PartyId,
+		ServiceType: req.ServiceType, Address: req.Address})
 
-	r, err := c.Signup(ctx, &via.SignupReq{TaskId: DefaultTaskId, PartyId: DefaultPartyId, Address: address})
+	r, err := c.Signup(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("Signup task result: %v, leaseId: %s, ttl: %ds", r.Result, r.LeaseId, r.Ttl)
+	return r, nil
+}
+
+// keepAlive 定期向local VIA续约，直到租约失效。续约的stream断开时(如VIA重启)按退避间隔重新连接，
+// 退避间隔不超过ttl/3，在租约过期前有多次重试的机会
+func keepAlive(leaseId string, ttl time.Duration) {
+	conn := dialLocalVIA()
+	defer conn.Close()
+
+	backoff := keepAliveMinBackoff
+	for {
+		renewed, gone := renewLease(via.NewVIAServiceClient(conn), leaseId, ttl)
+		if gone {
+			return
+		}
+		if renewed {
+			backoff = keepAliveMinBackoff
+		}
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > ttl/3 {
+			backoff = ttl / 3
+		}
+	}
+}
+
+// 续约的stream断开后重新连接的最小间隔，每次失败加倍
+const keepAliveMinBackoff = 100 * time.Millisecond
+
+// renewLease 在一个KeepAlive stream上续约，直到stream断开，返回是否续约成功过，以及租约是否已失效
+func renewLease(client via.VIAServiceClient, leaseId string, ttl time.Duration) (bool, bool) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	renewed := false
+	stream, err := client.KeepAlive(ctx)
+	if err != nil {
+		log.Printf("failed to keep alive the lease: %v", err)
+		return renewed, false
+	}
+	for {
+		if err := stream.Send(&via.KeepAliveReq{LeaseId: leaseId}); err != nil {
+			log.Printf("failed to keep alive the lease: %v", err)
+			return renewed, false
+		}
+		resp, err := stream.Recv()
+		if err != nil {
+			log.Printf("failed to keep alive the lease: %v", err)
+			return renewed, false
+		}
+		if resp.Ttl == 0 {
+			log.Printf("lease %s is gone, reason: %s", leaseId, resp.Reason)
+			return renewed, true
+		}
+		renewed = true
+		//在租约过期前续约
+		time.Sleep(ttl / 3)
+	}
+}
+
+// 注册请求的完整方法名，签入signup token
+const (
+	signupMethod     = "/via.VIAService/Signup"
+	unregisterMethod = "/via.VIAService/Unregister"
+)
+
+// withSignupToken 配置了signup密钥时，在注册请求中携带为这个请求签发的HMAC token
+func withSignupToken(ctx context.Context, claims proxy.SignupClaims) context.Context {
+	if len(keyId) == 0 {
+		return ctx
+	}
+	return proxy.WithSignupToken(ctx, keyId, secret, claims)
+}
+
+func unregisterTask() error {
+	conn := dialLocalVIA()
+	defer conn.Close()
+
+	log.Printf("unregister task from local VIA server %v", localVia)
+
+	c := via.NewVIAServiceClient(conn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req := &via.UnregisterReq{TaskId: DefaultTaskId, PartyId: partner}
+	ctx = withSignupToken(ctx, proxy.SignupClaims{Method: unregisterMethod, TaskId: req.TaskId, PartyId: req.PartyId})
+
+	r, err := c.Unregister(ctx, req)
 	if err != nil {
 		return err
 	}
 
-	log.Printf("Signup task result: %v", r.Result)
+	log.Printf("Unregister task result: %v", r.Result)
 	return nil
 }
 
@@ -324,12 +474,16 @@ func main() {
 	}()
 
 	// Signup TASK
-	if err := signupTask(); err != nil {
+	signupResp, err := signupTask()
+	if err != nil {
 		log.Fatalf("failed to signup task to local VIA server: %v", err)
 	}
+	if signupResp.Ttl > 0 {
+		go keepAlive(signupResp.LeaseId, time.Duration(signupResp.Ttl)*time.Second)
+	}
 
-	//等待所有的任务都注册完成
-	time.Sleep(time.Duration(5) * time.Second)
+	//等待对方参与方注册完成
+	waitForDestParty()
 
 	var cmdLine string
 
@@ -337,6 +491,9 @@ func main() {
 		fmt.Println("Please input command：unary|serverStreaming|clientStreaming|bidi|quit")
 		fmt.Scanln(&cmdLine)
 		if cmdLine == "quit" {
+			if err := unregisterTask(); err != nil {
+				log.Printf("failed to unregister task from local VIA server: %v", err)
+			}
 			break
 		} else {
 			// Execute command
@@ -364,62 +521,11 @@ func init() {
 
 	log.Printf("配置文件中，tlsConfig.Tls.Mode=%s", tlsConfig.Tls.Mode)
 
-	// Load io's certificate and private key
-	ioCert, err := tls.LoadX509KeyPair(tlsConfig.Tls.IoCertFile, tlsConfig.Tls.IoKeyFile)
-	if err != nil {
-		log.Fatalf("failed to load VIA certificate and private key. %v", err)
-	}
-
-	//当是SSL，拨号VIA需要携带统一的ca证书库
-	caPool := loadCaPool()
-
-	if tlsConfig.Tls.Mode == "one_way" {
-		// VIA单向ssl，VIA接收的是ssl流，转给node时，node也必须是ssl的，因此，此时node需要以ssl监听
-		// 加载io自己的证书，无需ca证书库（此时和VIA单向ssl的tls.config一样）
-		log.Printf("VIA单向SSL")
-		serverSSLConfig := &tls.Config{
-			Certificates: []tls.Certificate{ioCert},
-			ClientAuth:   tls.NoClientCert,
-		}
-		tlsCredentialsAsServer = credentials.NewTLS(serverSSLConfig)
-
-		clientSSLConfig := &tls.Config{
-			RootCAs: caPool,
-		}
-		tlsCredentialsAsClient = credentials.NewTLS(clientSSLConfig)
-
-	} else if tlsConfig.Tls.Mode == "two_way" {
-		// VIA双向ssl
-		// 加载io自己的证书，以及ca证书库
-		log.Printf("VIA双向SSL")
-		serverSSLConfig := &tls.Config{
-			Certificates: []tls.Certificate{ioCert},
-			ClientAuth:   tls.RequireAndVerifyClientCert,
-			ClientCAs:    caPool,
-		}
-		tlsCredentialsAsServer = credentials.NewTLS(serverSSLConfig)
-
-		clientSSLConfig := &tls.Config{
-			Certificates: []tls.Certificate{ioCert},
-			RootCAs:      caPool,
-		}
-		tlsCredentialsAsClient = credentials.NewTLS(clientSSLConfig)
-	} else {
-		log.Fatalf("Tls.Mode value error: %s", tlsConfig.Tls.Mode)
-	}
-}
-
-func loadCaPool() *x509.CertPool {
-	// Load certificate of the CA who signed server's certificate
-	pemServerCA, err := ioutil.ReadFile("cert/ca.crt")
+	// VIA单向ssl，VIA接收的是ssl流，转给node时，node也必须是ssl的，因此，此时node需要以ssl监听
+	// 加载io自己的证书，以及ca证书库
+	var err error
+	tlsCredentialsAsServer, tlsCredentialsAsClient, err = tlsutil.NewCredentials(tlsConfig.Tls.IoOptions())
 	if err != nil {
-		log.Fatalf("failed to read CA cert file. %v", err)
+		log.Fatalf("failed to load TLS credentials. %v", err)
 	}
-
-	caPool := x509.NewCertPool()
-	if !caPool.AppendCertsFromPEM(pemServerCA) {
-		log.Fatalf("failed to add CA cert to cert pool. %v", err)
-	}
-
-	return caPool
 }
@@ -0,0 +1,118 @@
+package tlsutil
+
+import (
+	"fmt"
+
+	"github.com/tjfoc/gmsm/gmtls"
+	"github.com/tjfoc/gmsm/gmtls/gmcredentials"
+	"github.com/tjfoc/gmsm/x509"
+	"google.golang.org/grpc/credentials"
+)
+
+// LoadGMCertPool is LoadCertPool for SM2 CA certificates.
+func LoadGMCertPool(paths []string) (*x509.CertPool, error) {
+	pool := x509.NewCertPool()
+	if err := loadCaFiles(paths, pool.AppendCertsFromPEM); err != nil {
+		return nil, err
+	}
+	return pool, nil
+}
+
+func checkGMMode(mode string) error {
+	if !IsGM(mode) {
+		return fmt.Errorf("Tls.Mode value error: %s", mode)
+	}
+	return nil
+}
+
+// loadGMKeyPairs 加载国密的签名证书和加密证书，签名证书在前
+func loadGMKeyPairs(o Options) ([]gmtls.Certificate, error) {
+	signCert, err := gmtls.LoadX509KeyPair(o.SignCertFile, o.SignKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load sign certificate and private key. %v", err)
+	}
+	encryptCert, err := gmtls.LoadX509KeyPair(o.EncryptCertFile, o.EncryptKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load encrypt certificate and private key. %v", err)
+	}
+	return []gmtls.Certificate{signCert, encryptCert}, nil
+}
+
+// GMServerConfig returns the gmtls.Config of a GM/T 0024 server, which presents its sign and encrypt
+// certificates. In gm_two_way mode clients must present a certificate signed by one of the CAs.
+func GMServerConfig(o Options) (*gmtls.Config, error) {
+	if err := checkGMMode(o.Mode); err != nil {
+		return nil, err
+	}
+	certs, err := loadGMKeyPairs(o)
+	if err != nil {
+		return nil, err
+	}
+
+	switch o.Mode {
+	case ModeGMOneWay:
+		return &gmtls.Config{
+			GMSupport:    &gmtls.GMSupport{},
+			Certificates: certs,
+			ClientAuth:   gmtls.NoClientCert,
+		}, nil
+	case ModeGMTwoWay:
+		caPool, err := LoadGMCertPool(o.CaFiles)
+		if err != nil {
+			return nil, err
+		}
+		return &gmtls.Config{
+			GMSupport:    &gmtls.GMSupport{},
+			Certificates: certs,
+			ClientAuth:   gmtls.RequireAndVerifyClientCert,
+			ClientCAs:    caPool,
+		}, nil
+	default:
+		return nil, fmt.Errorf("Tls.Mode value error: %s", o.Mode)
+	}
+}
+
+// GMClientConfig returns the gmtls.Config of a GM/T 0024 client, which trusts the servers signed by one of the
+// CAs. In gm_two_way mode the client presents its sign certificate.
+func GMClientConfig(o Options) (*gmtls.Config, error) {
+	if err := checkGMMode(o.Mode); err != nil {
+		return nil, err
+	}
+	caPool, err := LoadGMCertPool(o.CaFiles)
+	if err != nil {
+		return nil, err
+	}
+
+	switch o.Mode {
+	case ModeGMOneWay:
+		return &gmtls.Config{
+			GMSupport: &gmtls.GMSupport{},
+			RootCAs:   caPool,
+		}, nil
+	case ModeGMTwoWay:
+		//客户端出示Certificates中的第一个证书，即签名证书
+		certs, err := loadGMKeyPairs(o)
+		if err != nil {
+			return nil, err
+		}
+		return &gmtls.Config{
+			GMSupport:    &gmtls.GMSupport{},
+			Certificates: certs,
+			RootCAs:      caPool,
+		}, nil
+	default:
+		return nil, fmt.Errorf("Tls.Mode value error: %s", o.Mode)
+	}
+}
+
+func newGMCredentials(o Options) (credentials.TransportCredentials, credentials.TransportCredentials, error) {
+	serverConfig, err := GMServerConfig(o)
+	if err != nil {
+		return nil, nil, err
+	}
+	clientConfig, err := GMClientConfig(o)
+	if err != nil {
+		return nil, nil, err
+	}
+	return gmcredentials.NewTLS(serverConfig), gmcredentials.NewTLS(clientConfig), nil
+}
@@ -0,0 +1,119 @@
+package tlsutil
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/tjfoc/gmsm/gmtls"
+	"golang.org/x/net/context"
+)
+
+// cert/gm_cert中的国密证书，服务端证书的SAN是127.0.0.1
+const gmCertDir = "../cert/gm_cert/"
+
+func gmOptions(mode, name string) Options {
+	return Options{
+		Mode:            mode,
+		SignCertFile:    gmCertDir + name + "_sign.crt",
+		SignKeyFile:     gmCertDir + name + "_sign.key",
+		EncryptCertFile: gmCertDir + name + "_encrypt.crt",
+		EncryptKeyFile:  gmCertDir + name + "_encrypt.key",
+		CaFiles:         []string{gmCertDir + "ca.crt"},
+	}
+}
+
+// gmHandshake runs a GM/T 0024 handshake between serverConfig and clientConfig over an in-memory connection.
+func gmHandshake(serverConfig, clientConfig *gmtls.Config) error {
+	serverConn, clientConn := net.Pipe()
+	defer serverConn.Close()
+	defer clientConn.Close()
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- gmtls.Server(serverConn, serverConfig).Handshake()
+	}()
+	clientConfig = clientConfig.Clone()
+	clientConfig.ServerName = "127.0.0.1"
+	clientErr := gmtls.Client(clientConn, clientConfig).Handshake()
+	serverConn.Close()
+	serverErr := <-errs
+	if clientErr != nil {
+		return clientErr
+	}
+	return serverErr
+}
+
+func TestGMTwoWay(t *testing.T) {
+	serverConfig, err := GMServerConfig(gmOptions(ModeGMTwoWay, "server"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientConfig, err := GMClientConfig(gmOptions(ModeGMTwoWay, "client"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := gmHandshake(serverConfig, clientConfig); err != nil {
+		t.Fatalf("gm_two_way handshake failed: %v", err)
+	}
+
+	// 双向模式下不出示证书的客户端被拒绝
+	anonymous, err := GMClientConfig(gmOptions(ModeGMOneWay, "client"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := gmHandshake(serverConfig, anonymous); err == nil {
+		t.Fatal("expected a client without certificate to be rejected")
+	}
+}
+
+func TestGMOneWay(t *testing.T) {
+	serverConfig, err := GMServerConfig(gmOptions(ModeGMOneWay, "server"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientConfig, err := GMClientConfig(Options{Mode: ModeGMOneWay, CaFiles: []string{gmCertDir + "ca.crt"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := gmHandshake(serverConfig, clientConfig); err != nil {
+		t.Fatalf("gm_one_way handshake failed: %v", err)
+	}
+}
+
+func TestGMCredentials(t *testing.T) {
+	serverCreds, _, err := NewCredentials(gmOptions(ModeGMTwoWay, "server"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, clientCreds, err := NewCredentials(gmOptions(ModeGMTwoWay, "client"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serverConn, clientConn := net.Pipe()
+	defer serverConn.Close()
+	defer clientConn.Close()
+	errs := make(chan error, 1)
+	go func() {
+		_, _, err := serverCreds.ServerHandshake(serverConn)
+		errs <- err
+	}()
+	if _, _, err := clientCreds.ClientHandshake(context.Background(), "127.0.0.1:10031", clientConn); err != nil {
+		t.Fatalf("client handshake failed: %v", err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatalf("server handshake failed: %v", err)
+	}
+}
+
+func TestGMInvalidMode(t *testing.T) {
+	for _, mode := range []string{"", ModeTwoWay} {
+		if _, err := GMServerConfig(Options{Mode: mode}); err == nil || !strings.Contains(err.Error(), "Tls.Mode") {
+			t.Errorf("expected mode %q to fail, got %v", mode, err)
+		}
+		if _, err := GMClientConfig(Options{Mode: mode}); err == nil || !strings.Contains(err.Error(), "Tls.Mode") {
+			t.Errorf("expected mode %q to fail, got %v", mode, err)
+		}
+	}
+}
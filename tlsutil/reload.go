@@ -0,0 +1,262 @@
+package tlsutil
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+	"via/logging"
+
+	"github.com/tjfoc/gmsm/gmtls"
+	"github.com/tjfoc/gmsm/gmtls/gmcredentials"
+	gmx509 "github.com/tjfoc/gmsm/x509"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/credentials"
+)
+
+// Reloader holds the TLS credentials of a process and reloads its certificates, keys and CAs from disk, so
+// certificates can be rotated without a restart. Reloading only affects new handshakes: established connections,
+// and the streams on them, keep running.
+//
+// Servers pick up the reloaded certificates through GetConfigForClient. crypto/tls has no such hook for the trusted
+// CAs of a client, so the client credentials instead delegate every handshake to the latest loaded credentials.
+type Reloader struct {
+	o Options
+
+	mu                 sync.RWMutex
+	serverConfig       *tls.Config
+	gmServerConfig     *gmtls.Config
+	client             credentials.TransportCredentials
+	serverNameOverride string
+	stamp              string
+}
+
+// NewReloader loads the credentials of o.
+func NewReloader(o Options) (*Reloader, error) {
+	r := &Reloader{o: o}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload loads the certificates, keys and CAs again. If any of them fails to load, the current credentials are
+// kept and the error is returned.
+func (r *Reloader) Reload() error {
+	stamp := fileStamp(r.files())
+	var serverConfig *tls.Config
+	var gmServerConfig *gmtls.Config
+	var client credentials.TransportCredentials
+	var certs []string
+	if IsGM(r.o.Mode) {
+		config, err := GMServerConfig(r.o)
+		if err != nil {
+			return err
+		}
+		clientConfig, err := GMClientConfig(r.o)
+		if err != nil {
+			return err
+		}
+		config.NextProtos = []string{"h2"}
+		gmServerConfig, client = config, gmcredentials.NewTLS(clientConfig)
+		certs = describeGMCerts(config.Certificates)
+	} else {
+		config, err := ServerConfig(r.o)
+		if err != nil {
+			return err
+		}
+		clientConfig, err := ClientConfig(r.o)
+		if err != nil {
+			return err
+		}
+		config.NextProtos = []string{"h2"}
+		serverConfig, client = config, credentials.NewTLS(clientConfig)
+		certs = describeCerts(config.Certificates)
+	}
+
+	r.mu.Lock()
+	if r.serverNameOverride != "" {
+		client.OverrideServerName(r.serverNameOverride)
+	}
+	r.serverConfig, r.gmServerConfig, r.client, r.stamp = serverConfig, gmServerConfig, client, stamp
+	r.mu.Unlock()
+
+	for _, cert := range certs {
+		logging.Infof("loaded TLS certificate %s", cert)
+	}
+	return nil
+}
+
+// Watch checks the certificate, key and CA files every interval until ctx is done, and reloads them when any of
+// them changes. A change that fails to load, e.g. a certificate written before its key, is logged and retried at
+// the next change.
+func (r *Reloader) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			stamp := fileStamp(r.files())
+			r.mu.Lock()
+			changed := stamp != r.stamp
+			r.stamp = stamp
+			r.mu.Unlock()
+			if !changed {
+				continue
+			}
+			logging.Infof("TLS certificate files changed, reloading")
+			if err := r.Reload(); err != nil {
+				logging.Errorf("failed to reload TLS certificates, keep using the current ones: %v", err)
+			}
+		}
+	}
+}
+
+// ServerCredentials returns the credentials of a gRPC server, which always hands out the latest certificates.
+func (r *Reloader) ServerCredentials() credentials.TransportCredentials {
+	if IsGM(r.o.Mode) {
+		return gmcredentials.NewTLS(&gmtls.Config{
+			GMSupport: &gmtls.GMSupport{},
+			GetConfigForClient: func(*gmtls.ClientHelloInfo) (*gmtls.Config, error) {
+				r.mu.RLock()
+				defer r.mu.RUnlock()
+				return r.gmServerConfig, nil
+			},
+		})
+	}
+	return credentials.NewTLS(&tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			r.mu.RLock()
+			defer r.mu.RUnlock()
+			return r.serverConfig, nil
+		},
+	})
+}
+
+// ClientCredentials returns the credentials of gRPC clients, which always handshake with the latest certificates
+// and CAs.
+func (r *Reloader) ClientCredentials() credentials.TransportCredentials {
+	return &reloadingCredentials{r: r}
+}
+
+func (r *Reloader) current() credentials.TransportCredentials {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.client
+}
+
+// files 返回需要监视的证书、私钥和CA文件
+func (r *Reloader) files() []string {
+	var files []string
+	for _, file := range []string{r.o.CertFile, r.o.KeyFile, r.o.SignCertFile, r.o.SignKeyFile, r.o.EncryptCertFile, r.o.EncryptKeyFile} {
+		if len(file) > 0 {
+			files = append(files, file)
+		}
+	}
+	return append(files, r.o.CaFiles...)
+}
+
+// reloadingCredentials 把客户端的握手交给Reloader最新加载的credentials
+type reloadingCredentials struct {
+	r *Reloader
+}
+
+func (c *reloadingCredentials) ClientHandshake(ctx context.Context, authority string, conn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	return c.r.current().ClientHandshake(ctx, authority, conn)
+}
+
+func (c *reloadingCredentials) ServerHandshake(conn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	return c.r.current().ServerHandshake(conn)
+}
+
+func (c *reloadingCredentials) Info() credentials.ProtocolInfo {
+	return c.r.current().Info()
+}
+
+func (c *reloadingCredentials) Clone() credentials.TransportCredentials {
+	return &reloadingCredentials{r: c.r}
+}
+
+func (c *reloadingCredentials) OverrideServerName(serverNameOverride string) error {
+	c.r.mu.Lock()
+	defer c.r.mu.Unlock()
+	c.r.serverNameOverride = serverNameOverride
+	return c.r.client.OverrideServerName(serverNameOverride)
+}
+
+// fileStamp 返回文件内容的摘要，目录包括其中的每个文件，用来发现文件的变化。
+// 不使用修改时间，因为同一时钟周期内写入的文件修改时间可能相同
+func fileStamp(paths []string) string {
+	h := sha256.New()
+	var add func(path string, recurse bool)
+	add = func(path string, recurse bool) {
+		io.WriteString(h, path)
+		info, err := os.Stat(path)
+		if err != nil {
+			io.WriteString(h, err.Error())
+			return
+		}
+		if !info.IsDir() {
+			buf, err := ioutil.ReadFile(path)
+			if err != nil {
+				io.WriteString(h, err.Error())
+			}
+			h.Write(buf)
+			return
+		}
+		if recurse {
+			files, _ := ioutil.ReadDir(path)
+			for _, file := range files {
+				add(filepath.Join(path, file.Name()), false)
+			}
+		}
+	}
+	for _, path := range paths {
+		add(path, true)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func describeCerts(certs []tls.Certificate) []string {
+	var descriptions []string
+	for _, cert := range certs {
+		if len(cert.Certificate) == 0 {
+			continue
+		}
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			continue
+		}
+		descriptions = append(descriptions, describe(leaf.Subject.String(), leaf.NotAfter))
+	}
+	return descriptions
+}
+
+func describeGMCerts(certs []gmtls.Certificate) []string {
+	var descriptions []string
+	for _, cert := range certs {
+		if len(cert.Certificate) == 0 {
+			continue
+		}
+		leaf, err := gmx509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			continue
+		}
+		descriptions = append(descriptions, describe(leaf.Subject.String(), leaf.NotAfter))
+	}
+	return descriptions
+}
+
+func describe(subject string, notAfter time.Time) string {
+	return fmt.Sprintf("subject: %s, expires: %s", subject, notAfter.Format(time.RFC3339))
+}
@@ -0,0 +1,171 @@
+package tlsutil
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/tjfoc/gmsm/gmtls/gmcredentials"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/credentials"
+)
+
+// peerName runs a handshake between the server and client credentials and returns the common name of the
+// certificate the server presented.
+func peerName(server, client credentials.TransportCredentials) (string, error) {
+	return peerNameAt(server, client, "localhost:10031")
+}
+
+func peerNameAt(server, client credentials.TransportCredentials, authority string) (string, error) {
+	serverConn, clientConn := net.Pipe()
+	defer serverConn.Close()
+	defer clientConn.Close()
+
+	errs := make(chan error, 1)
+	go func() {
+		_, _, err := server.ServerHandshake(serverConn)
+		errs <- err
+	}()
+	_, authInfo, clientErr := client.ClientHandshake(context.Background(), authority, clientConn)
+	serverConn.Close()
+	serverErr := <-errs
+	if clientErr != nil {
+		return "", clientErr
+	}
+	if serverErr != nil {
+		return "", serverErr
+	}
+	switch info := authInfo.(type) {
+	case credentials.TLSInfo:
+		return info.State.PeerCertificates[0].Subject.CommonName, nil
+	case gmcredentials.TLSInfo:
+		return info.State.PeerCertificates[0].Subject.CommonName, nil
+	}
+	return "", nil
+}
+
+// rotate 用ca给commonName签发新证书，替换certFile和keyFile
+func rotate(t *testing.T, ca *testCA, certFile, keyFile, commonName string) {
+	newCert, newKey := ca.issue(t, commonName)
+	if err := os.Rename(newCert, certFile); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(newKey, keyFile); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func newReloaders(t *testing.T) (*testCA, Options, *Reloader, *Reloader) {
+	dir := tempDir(t)
+	ca := newTestCA(t, dir, "ca")
+	serverCert, serverKey := ca.issue(t, "via-1")
+	clientCert, clientKey := ca.issue(t, "task")
+	caFiles := []string{dir + "/ca.crt"}
+
+	serverOptions := Options{Mode: ModeTwoWay, CertFile: serverCert, KeyFile: serverKey, CaFiles: caFiles}
+	server, err := NewReloader(serverOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := NewReloader(Options{Mode: ModeTwoWay, CertFile: clientCert, KeyFile: clientKey, CaFiles: caFiles})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ca, serverOptions, server, client
+}
+
+func TestReload(t *testing.T) {
+	ca, options, server, client := newReloaders(t)
+	if name, err := peerName(server.ServerCredentials(), client.ClientCredentials()); err != nil || name != "via-1" {
+		t.Fatalf("expected via-1, got %q, %v", name, err)
+	}
+
+	rotate(t, ca, options.CertFile, options.KeyFile, "via-2")
+	if err := server.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if name, err := peerName(server.ServerCredentials(), client.ClientCredentials()); err != nil || name != "via-2" {
+		t.Fatalf("expected the reloaded via-2, got %q, %v", name, err)
+	}
+
+	// 加载失败时继续使用当前的证书
+	if err := ioutil.WriteFile(options.KeyFile, []byte("broken"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Reload(); err == nil {
+		t.Fatal("expected the broken key to fail to load")
+	}
+	if name, err := peerName(server.ServerCredentials(), client.ClientCredentials()); err != nil || name != "via-2" {
+		t.Fatalf("expected via-2 to be kept, got %q, %v", name, err)
+	}
+}
+
+func TestReloadCA(t *testing.T) {
+	_, options, server, client := newReloaders(t)
+
+	// 服务端换成新CA签发的证书，客户端在信任新CA之前握手失败
+	dir := tempDir(t)
+	newCA := newTestCA(t, dir, "ca2")
+	rotate(t, newCA, options.CertFile, options.KeyFile, "via-2")
+	if err := server.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := peerName(server.ServerCredentials(), client.ClientCredentials()); err == nil {
+		t.Fatal("expected the certificate of an untrusted CA to be rejected")
+	}
+
+	client.o.CaFiles = append(client.o.CaFiles, dir+"/ca2.crt")
+	server.o.CaFiles = client.o.CaFiles
+	if err := client.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if name, err := peerName(server.ServerCredentials(), client.ClientCredentials()); err != nil || name != "via-2" {
+		t.Fatalf("expected via-2, got %q, %v", name, err)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	ca, options, server, client := newReloaders(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go server.Watch(ctx, 10*time.Millisecond)
+
+	rotate(t, ca, options.CertFile, options.KeyFile, "via-2")
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		name, err := peerName(server.ServerCredentials(), client.ClientCredentials())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if name == "via-2" {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the changed certificate to be reloaded, still got %s", name)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestReloadGM(t *testing.T) {
+	server, err := NewReloader(gmOptions(ModeGMTwoWay, "server"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := NewReloader(gmOptions(ModeGMTwoWay, "client"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	name, err := peerNameAt(server.ServerCredentials(), client.ClientCredentials(), "127.0.0.1:10031")
+	if err != nil || name != "server" {
+		t.Fatalf("expected the gm server certificate, got %q, %v", name, err)
+	}
+}
@@ -0,0 +1,200 @@
+// Package tlsutil builds the TLS credentials VIA and the task services use for their gRPC servers and clients.
+package tlsutil
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"google.golang.org/grpc/credentials"
+)
+
+// TLS modes.
+const (
+	ModeOneWay   = "one_way"    //单向SSL，只有服务端出示证书
+	ModeTwoWay   = "two_way"    //双向SSL，服务端和客户端互相校验证书
+	ModeGMOneWay = "gm_one_way" //国密单向SSL(GM/T 0024)，服务端出示签名和加密双证书
+	ModeGMTwoWay = "gm_two_way" //国密双向SSL(GM/T 0024)，客户端也出示证书
+)
+
+// Options describes the certificates of one process, used both when it serves and when it dials.
+type Options struct {
+	Mode     string
+	CertFile string
+	KeyFile  string
+	// SignCertFile, SignKeyFile, EncryptCertFile and EncryptKeyFile are the SM2 sign and encrypt key pairs used in
+	// the gm modes instead of CertFile and KeyFile.
+	SignCertFile    string
+	SignKeyFile     string
+	EncryptCertFile string
+	EncryptKeyFile  string
+	// CaFiles lists the PEM files, or directories of PEM files, of the CAs trusted to sign the certificate of the
+	// other side. Several CAs can be trusted at once, e.g. the CAs of every organization of a consortium.
+	CaFiles []string
+}
+
+// 目录中作为CA证书加载的文件后缀
+var caFileExts = []string{".crt", ".pem", ".cer"}
+
+// LoadCertPool returns a pool of the certificates in the PEM files of paths. A directory adds every .crt, .pem
+// and .cer file directly in it. Every file, and every directory, must hold at least one certificate.
+func LoadCertPool(paths []string) (*x509.CertPool, error) {
+	pool := x509.NewCertPool()
+	if err := loadCaFiles(paths, pool.AppendCertsFromPEM); err != nil {
+		return nil, err
+	}
+	return pool, nil
+}
+
+// loadCaFiles 读取paths中的CA证书文件，交给appendPEM加入证书库，标准证书库和国密证书库共用
+func loadCaFiles(paths []string, appendPEM func(pem []byte) bool) error {
+	if len(paths) == 0 {
+		return fmt.Errorf("no CA cert file")
+	}
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return fmt.Errorf("failed to read CA cert file. %v", err)
+		}
+		if !info.IsDir() {
+			if err := appendCertFile(appendPEM, path); err != nil {
+				return err
+			}
+			continue
+		}
+
+		files, err := ioutil.ReadDir(path)
+		if err != nil {
+			return fmt.Errorf("failed to read CA cert directory. %v", err)
+		}
+		loaded := 0
+		for _, file := range files {
+			if file.IsDir() || !hasCaFileExt(file.Name()) {
+				continue
+			}
+			if err := appendCertFile(appendPEM, filepath.Join(path, file.Name())); err != nil {
+				return err
+			}
+			loaded++
+		}
+		if loaded == 0 {
+			return fmt.Errorf("no CA cert file in directory %s", path)
+		}
+	}
+	return nil
+}
+
+func appendCertFile(appendPEM func(pem []byte) bool, file string) error {
+	pem, err := ioutil.ReadFile(file)
+	if err != nil {
+		return fmt.Errorf("failed to read CA cert file. %v", err)
+	}
+	if !appendPEM(pem) {
+		return fmt.Errorf("failed to add CA cert to cert pool, no certificate in %s", file)
+	}
+	return nil
+}
+
+func hasCaFileExt(name string) bool {
+	for _, ext := range caFileExts {
+		if strings.HasSuffix(name, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+func checkMode(mode string) error {
+	if mode != ModeOneWay && mode != ModeTwoWay {
+		return fmt.Errorf("Tls.Mode value error: %s", mode)
+	}
+	return nil
+}
+
+// ServerConfig returns the tls.Config of a server. In two_way mode clients must present a certificate signed by
+// one of the CAs.
+func ServerConfig(o Options) (*tls.Config, error) {
+	if err := checkMode(o.Mode); err != nil {
+		return nil, err
+	}
+	cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load certificate and private key. %v", err)
+	}
+
+	switch o.Mode {
+	case ModeOneWay:
+		return &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			ClientAuth:   tls.NoClientCert,
+		}, nil
+	case ModeTwoWay:
+		caPool, err := LoadCertPool(o.CaFiles)
+		if err != nil {
+			return nil, err
+		}
+		return &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+			ClientCAs:    caPool,
+		}, nil
+	default:
+		return nil, fmt.Errorf("Tls.Mode value error: %s", o.Mode)
+	}
+}
+
+// ClientConfig returns the tls.Config of a client, which trusts the servers signed by one of the CAs. In
+// two_way mode the client presents its certificate.
+func ClientConfig(o Options) (*tls.Config, error) {
+	if err := checkMode(o.Mode); err != nil {
+		return nil, err
+	}
+	//当是SSL，拨号需要携带统一的ca证书库
+	caPool, err := LoadCertPool(o.CaFiles)
+	if err != nil {
+		return nil, err
+	}
+
+	switch o.Mode {
+	case ModeOneWay:
+		return &tls.Config{
+			RootCAs: caPool,
+		}, nil
+	case ModeTwoWay:
+		cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load certificate and private key. %v", err)
+		}
+		return &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			RootCAs:      caPool,
+		}, nil
+	default:
+		return nil, fmt.Errorf("Tls.Mode value error: %s", o.Mode)
+	}
+}
+
+// IsGM reports whether mode is one of the GM modes.
+func IsGM(mode string) bool {
+	return mode == ModeGMOneWay || mode == ModeGMTwoWay
+}
+
+// NewCredentials returns the transport credentials of the gRPC server and of the gRPC clients of a process.
+func NewCredentials(o Options) (server credentials.TransportCredentials, client credentials.TransportCredentials, err error) {
+	if IsGM(o.Mode) {
+		return newGMCredentials(o)
+	}
+	serverConfig, err := ServerConfig(o)
+	if err != nil {
+		return nil, nil, err
+	}
+	clientConfig, err := ClientConfig(o)
+	if err != nil {
+		return nil, nil, err
+	}
+	return credentials.NewTLS(serverConfig), credentials.NewTLS(clientConfig), nil
+}
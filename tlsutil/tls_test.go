@@ -0,0 +1,207 @@
+package tlsutil
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCA 是测试用的CA，签发的证书和私钥写到dir中
+type testCA struct {
+	dir  string
+	name string
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T, dir, name string) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	writePEM(t, filepath.Join(dir, name+".crt"), "CERTIFICATE", der)
+	return &testCA{dir: dir, name: name, cert: cert, key: key}
+}
+
+// issue signs a certificate for commonName, valid for localhost, and returns its cert and key files.
+func (ca *testCA) issue(t *testing.T, commonName string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile := filepath.Join(ca.dir, commonName+".pem.crt")
+	keyFile := filepath.Join(ca.dir, commonName+".key")
+	writePEM(t, certFile, "CERTIFICATE", der)
+	writePEM(t, keyFile, "EC PRIVATE KEY", keyDer)
+	return certFile, keyFile
+}
+
+func writePEM(t *testing.T, file, blockType string, der []byte) {
+	if err := ioutil.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "via-tlsutil")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+// handshake runs a TLS handshake between serverConfig and clientConfig over an in-memory connection.
+func handshake(serverConfig, clientConfig *tls.Config) error {
+	serverConn, clientConn := net.Pipe()
+	defer serverConn.Close()
+	defer clientConn.Close()
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- tls.Server(serverConn, serverConfig).Handshake()
+	}()
+	clientConfig = clientConfig.Clone()
+	clientConfig.ServerName = "localhost"
+	clientErr := tls.Client(clientConn, clientConfig).Handshake()
+	serverConn.Close()
+	serverErr := <-errs
+	if clientErr != nil {
+		return clientErr
+	}
+	return serverErr
+}
+
+func TestLoadCertPool(t *testing.T) {
+	dir := tempDir(t)
+	newTestCA(t, dir, "ca1")
+	newTestCA(t, dir, "ca2")
+	ioutil.WriteFile(filepath.Join(dir, "README"), []byte("not a cert"), 0600)
+
+	if _, err := LoadCertPool([]string{filepath.Join(dir, "ca1.crt")}); err != nil {
+		t.Fatalf("expected a CA file to load, got %v", err)
+	}
+	pool, err := LoadCertPool([]string{dir})
+	if err != nil {
+		t.Fatalf("expected a CA directory to load, got %v", err)
+	}
+	if n := len(pool.Subjects()); n != 2 {
+		t.Fatalf("expected the 2 CAs of the directory, got %d", n)
+	}
+
+	invalid := [][]string{
+		nil,
+		{filepath.Join(dir, "missing.crt")},
+		{filepath.Join(dir, "README")},
+		{tempDir(t)},
+	}
+	for _, paths := range invalid {
+		if _, err := LoadCertPool(paths); err == nil {
+			t.Errorf("expected %v to fail", paths)
+		}
+	}
+}
+
+// 服务端和客户端的证书由不同的CA签发，双方都信任两个CA
+func TestTwoWayMultipleCAs(t *testing.T) {
+	dir1, dir2 := tempDir(t), tempDir(t)
+	ca1 := newTestCA(t, dir1, "ca1")
+	ca2 := newTestCA(t, dir2, "ca2")
+	serverCert, serverKey := ca1.issue(t, "via")
+	clientCert, clientKey := ca2.issue(t, "task")
+
+	caFiles := []string{filepath.Join(dir1, "ca1.crt"), dir2}
+	serverConfig, err := ServerConfig(Options{Mode: ModeTwoWay, CertFile: serverCert, KeyFile: serverKey, CaFiles: caFiles})
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientConfig, err := ClientConfig(Options{Mode: ModeTwoWay, CertFile: clientCert, KeyFile: clientKey, CaFiles: caFiles})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := handshake(serverConfig, clientConfig); err != nil {
+		t.Fatalf("expected the handshake to succeed, got %v", err)
+	}
+
+	// 服务端只信任ca1时，拒绝ca2签发的客户端证书
+	serverConfig, err = ServerConfig(Options{Mode: ModeTwoWay, CertFile: serverCert, KeyFile: serverKey, CaFiles: caFiles[:1]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := handshake(serverConfig, clientConfig); err == nil {
+		t.Fatal("expected the client certificate of an untrusted CA to be rejected")
+	}
+}
+
+func TestOneWay(t *testing.T) {
+	dir := tempDir(t)
+	ca := newTestCA(t, dir, "ca")
+	serverCert, serverKey := ca.issue(t, "via")
+
+	options := Options{Mode: ModeOneWay, CertFile: serverCert, KeyFile: serverKey, CaFiles: []string{dir}}
+	if _, _, err := NewCredentials(options); err != nil {
+		t.Fatal(err)
+	}
+	serverConfig, _ := ServerConfig(options)
+	clientConfig, err := ClientConfig(Options{Mode: ModeOneWay, CaFiles: []string{filepath.Join(dir, "ca.crt")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := handshake(serverConfig, clientConfig); err != nil {
+		t.Fatalf("expected the handshake to succeed, got %v", err)
+	}
+}
+
+func TestInvalidMode(t *testing.T) {
+	for _, mode := range []string{"", "three_way"} {
+		if _, err := ServerConfig(Options{Mode: mode}); err == nil || !strings.Contains(err.Error(), "Tls.Mode") {
+			t.Errorf("expected mode %q to fail, got %v", mode, err)
+		}
+		if _, err := ClientConfig(Options{Mode: mode}); err == nil || !strings.Contains(err.Error(), "Tls.Mode") {
+			t.Errorf("expected mode %q to fail, got %v", mode, err)
+		}
+	}
+}